@@ -1,48 +1,91 @@
 package main
 
 import (
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"net"
 	"os"
+	"path/filepath"
+
+	"example.com/hello/config"
+	"example.com/hello/lucky2/protocol"
 )
 
 func main() {
-	serverAddress := "10.10.13.19:55000"
-	conn, err := net.Dial("tcp", serverAddress)
+	useTLS := flag.Bool("tls", false, "connect to the server over TLS")
+	caFile := flag.String("ca", "", "CA bundle used to verify the server (PEM)")
+	certFile := flag.String("cert", "", "client certificate for mutual TLS (PEM)")
+	keyFile := flag.String("key", "", "client private key for mutual TLS (PEM)")
+	serverAddress := flag.String("server", "10.10.13.19:55000", "address of the ingest server")
+	fileName := flag.String("file", "frame9.png", "file to send")
+	clientID := flag.String("client-id", "", "client ID sent with the file; defaults to the hostname")
+	contentType := flag.String("content-type", "image/png", "content type sent with the file")
+	settings := config.New(flag.CommandLine, "BETTERCLIENT")
+	settings.Check(func() error {
+		if (*certFile == "") != (*keyFile == "") {
+			return errors.New("-cert and -key must be given together")
+		}
+		return nil
+	})
+	settings.MustParse(os.Args[1:])
+
+	var tlsConfig *tls.Config
+	if *useTLS {
+		var err error
+		tlsConfig, err = protocol.ClientTLSConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fmt.Println("Error loading TLS configuration:", err)
+			return
+		}
+	}
+
+	conn, err := protocol.Dial(*serverAddress, tlsConfig)
 	if err != nil {
 		fmt.Println("Error connecting to server:", err)
 		return
 	}
 	defer conn.Close()
 
-	fileName := "frame9.png"
-	file, err := os.Open(fileName)
+	file, err := os.Open(*fileName)
 	if err != nil {
 		fmt.Println("Error opening file:", err)
 		return
 	}
 	defer file.Close()
 
-	// Sending the length of the filename
-	fileNameLen := int32(len(fileName))
-	if err := binary.Write(conn, binary.BigEndian, fileNameLen); err != nil {
-		fmt.Println("Error sending filename length:", err)
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Println("Error reading file size:", err)
 		return
 	}
 
-	// Sending the filename
-	if _, err := conn.Write([]byte(fileName)); err != nil {
-		fmt.Println("Error sending filename:", err)
+	checksum, err := protocol.Digest(file)
+	if err != nil {
+		fmt.Println("Error hashing file:", err)
 		return
 	}
 
-	// Sending the file content
-	if _, err := io.Copy(conn, file); err != nil {
-		fmt.Println("Error sending file data:", err)
+	// The hostname identifies this client in the server's metadata
+	if *clientID == "" {
+		*clientID, err = os.Hostname()
+		if err != nil {
+			fmt.Println("Error getting hostname:", err)
+			return
+		}
+	}
+
+	header := protocol.Header{
+		Filename:    filepath.Base(*fileName),
+		ClientID:    *clientID,
+		ContentType: *contentType,
+		Checksum:    checksum,
+	}
+	ack, err := protocol.Upload(conn, header, file, info.Size())
+	if err != nil {
+		fmt.Println("Error sending file:", err)
 		return
 	}
 
-	fmt.Println("File sent successfully!")
+	fmt.Println("File sent successfully! ID:", ack.FileID)
 }
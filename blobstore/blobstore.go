@@ -0,0 +1,195 @@
+// Package blobstore stores uploaded files behind one interface so the
+// ingest server and its tools can run against GridFS, a local directory or
+// memory.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("blobstore: file not found")
+	ErrUnavailable = errors.New("blobstore: backend unavailable")
+	// ErrDigestMismatch is returned by the Put of a deduplicating store
+	// when the content does not have the SHA-256 given in its metadata.
+	ErrDigestMismatch = errors.New("blobstore: content does not match its SHA-256")
+)
+
+// Metadata is stored alongside every file.
+type Metadata struct {
+	ClientID    string `bson:"clientID" json:"clientID"`
+	ContentType string `bson:"contentType,omitempty" json:"contentType,omitempty"`
+	SHA256      string `bson:"sha256,omitempty" json:"sha256,omitempty"`
+	// Uploader is the portal user who uploaded the file, if it did not
+	// come in through the ingest port.
+	Uploader string `bson:"uploader,omitempty" json:"uploader,omitempty"`
+	// Tags and Description are set by users after upload.
+	Tags        []string `bson:"tags,omitempty" json:"tags,omitempty"`
+	Description string   `bson:"description,omitempty" json:"description,omitempty"`
+	// Properties are what processing after the upload found out about the
+	// file, such as the dimensions of an image.
+	Properties map[string]string `bson:"properties,omitempty" json:"properties,omitempty"`
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	UploadDate time.Time `json:"uploadDate"`
+	Metadata   Metadata  `json:"metadata"`
+}
+
+// withProperties returns a copy of properties with props added.
+func withProperties(properties, props map[string]string) map[string]string {
+	merged := maps.Clone(properties)
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	maps.Copy(merged, props)
+	return merged
+}
+
+// contextReader fails reads once ctx is done, so a Put whose context is
+// cancelled is aborted instead of running to the end of its content.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ContextReader returns a reader of r that fails once ctx is done, for
+// callers that stream store content themselves.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{ctx, r}
+}
+
+// Usage is how much a set of files takes up. Bytes adds up their sizes;
+// StoredBytes counts content they share only once, so in a deduplicating
+// store it can be smaller.
+type Usage struct {
+	Files       int
+	Bytes       int64
+	StoredBytes int64
+}
+
+// BlobStore is a file store.
+type BlobStore interface {
+	// Put stores the content of r under name. If reading r fails, nothing
+	// is stored and the read error is returned. If meta.SHA256 is empty,
+	// Put records the digest of the content.
+	//
+	// A deduplicating store keeps content it already has only once, shared
+	// by every file with that content. The content is freed when the last
+	// of them is deleted.
+	Put(ctx context.Context, name string, meta Metadata, r io.Reader) (FileInfo, error)
+	// Get opens a file for reading. The reader can seek, so callers can
+	// serve byte ranges.
+	Get(ctx context.Context, id string) (io.ReadSeekCloser, FileInfo, error)
+	Stat(ctx context.Context, id string) (FileInfo, error)
+	// List returns the files selected by q in the order it asks for. An
+	// invalid q fails with ErrInvalidQuery.
+	List(ctx context.Context, q Query) ([]FileInfo, error)
+	// Count returns how many files q selects, ignoring its Offset and Limit.
+	Count(ctx context.Context, q Query) (int, error)
+	// Usage totals the files q selects, ignoring the order and paging.
+	Usage(ctx context.Context, q Query) (Usage, error)
+	// Folders returns the folders directly in q.Folder that hold a file q
+	// selects, sorted by name. Flat, the order and paging are ignored.
+	Folders(ctx context.Context, q Query) ([]string, error)
+	// Rename changes the name of one file.
+	Rename(ctx context.Context, id, name string) error
+	// Annotate replaces the user-defined tags and description of a file.
+	Annotate(ctx context.Context, id string, tags []string, description string) error
+	// SetProperties adds props to the properties of one file, replacing
+	// values under the same keys.
+	SetProperties(ctx context.Context, id string, props map[string]string) error
+	Delete(ctx context.Context, id string) error
+	Close() error
+}
+
+// Config selects a backend.
+type Config struct {
+	// Backend is "gridfs", "dir" or "memory".
+	Backend  string
+	MongoURI string
+	Database string
+	Dir      string
+	// Dedup makes the backend deduplicating.
+	Dedup bool
+	// Versions applies to every backend opened by Open.
+	Versions VersionPolicy
+}
+
+// RegisterFlags binds c to command line flags on fs.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Backend, "store", "gridfs", `file store backend: "gridfs", "dir" or "memory"`)
+	fs.StringVar(&c.MongoURI, "mongo-uri", "mongodb://localhost:27017", "MongoDB URI for the gridfs backend")
+	fs.StringVar(&c.Database, "database", "fileStore", "MongoDB database for the gridfs backend")
+	fs.StringVar(&c.Dir, "store-dir", "files", "directory for the dir backend")
+	fs.BoolVar(&c.Dedup, "dedup", false, "store identical content once, shared by every upload of it")
+	fs.Var(&c.Versions, "versions", `what to do when a filename is stored again: "all" keeps every revision, "last:N" keeps the newest N, "reject" refuses the upload`)
+}
+
+// Validate reports settings Open would fail on before connecting to
+// anything.
+func (c Config) Validate() error {
+	switch c.Backend {
+	case "gridfs":
+		if c.MongoURI == "" || c.Database == "" {
+			return errors.New("blobstore: the gridfs backend needs a MongoDB URI and database")
+		}
+	case "dir":
+		if c.Dir == "" {
+			return errors.New("blobstore: the dir backend needs a directory")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("blobstore: unknown backend %q", c.Backend)
+	}
+	return nil
+}
+
+// Open creates the backend selected by c.
+func Open(ctx context.Context, c Config) (BlobStore, error) {
+	var store BlobStore
+	var err error
+	switch c.Backend {
+	case "gridfs":
+		var g *GridFS
+		g, err = DialGridFS(ctx, c.MongoURI, c.Database)
+		if err == nil {
+			g.Dedup = c.Dedup
+		}
+		store = g
+	case "dir":
+		var d *Dir
+		d, err = NewDir(c.Dir)
+		if err == nil {
+			d.Dedup = c.Dedup
+		}
+		store = d
+	case "memory":
+		m := NewMemory()
+		m.Dedup = c.Dedup
+		store = m
+	default:
+		return nil, fmt.Errorf("blobstore: unknown backend %q", c.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return WithVersionPolicy(store, c.Versions), nil
+}
@@ -0,0 +1,485 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testBackends returns every backend that can run in this environment,
+// plain and deduplicating. Set BLOBSTORE_TEST_MONGO_URI to include GridFS.
+func testBackends(t *testing.T) map[string]func(t *testing.T) BlobStore {
+	backends := map[string]func(t *testing.T) BlobStore{}
+	for _, dedup := range []bool{false, true} {
+		suffix := ""
+		if dedup {
+			suffix = "-dedup"
+		}
+		backends["memory"+suffix] = func(t *testing.T) BlobStore {
+			m := NewMemory()
+			m.Dedup = dedup
+			return m
+		}
+		backends["dir"+suffix] = func(t *testing.T) BlobStore {
+			d, err := NewDir(t.TempDir())
+			assertNoError(t, err)
+			d.Dedup = dedup
+			return d
+		}
+		if uri := os.Getenv("BLOBSTORE_TEST_MONGO_URI"); uri != "" {
+			backends["gridfs"+suffix] = func(t *testing.T) BlobStore {
+				g, err := DialGridFS(context.Background(), uri, "blobstoreTest")
+				assertNoError(t, err)
+				g.Dedup = dedup
+				t.Cleanup(func() {
+					g.bucket.Drop()
+					g.blobs.Drop()
+					g.Close()
+				})
+				return g
+			}
+		}
+	}
+	return backends
+}
+
+var errBrokenReader = errors.New("connection reset")
+
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, errBrokenReader
+}
+
+func TestBlobStores(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			t.Run("put then get returns the content", func(t *testing.T) {
+				store := open(t)
+				meta := Metadata{ClientID: "cam-1", ContentType: "image/png", SHA256: "declared"}
+				if strings.HasSuffix(name, "-dedup") {
+					// Deduplicating stores check the digest
+					sum := sha256.Sum256([]byte("png bytes"))
+					meta.SHA256 = hex.EncodeToString(sum[:])
+				}
+
+				put, err := store.Put(ctx, "frame9.png", meta, strings.NewReader("png bytes"))
+				assertNoError(t, err)
+
+				r, info, err := store.Get(ctx, put.ID)
+				assertNoError(t, err)
+				defer r.Close()
+				body, _ := io.ReadAll(r)
+				if string(body) != "png bytes" {
+					t.Errorf("got body %q want %q", body, "png bytes")
+				}
+				if info.Name != "frame9.png" || info.Size != 9 || !reflect.DeepEqual(info.Metadata, meta) {
+					t.Errorf("got %+v", info)
+				}
+			})
+			t.Run("put records a digest", func(t *testing.T) {
+				store := open(t)
+
+				put, err := store.Put(ctx, "a.txt", Metadata{}, strings.NewReader("abc"))
+				assertNoError(t, err)
+
+				info, err := store.Stat(ctx, put.ID)
+				assertNoError(t, err)
+				const want = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+				if put.Metadata.SHA256 != want || info.Metadata.SHA256 != want {
+					t.Errorf("got digests %q and %q want %q", put.Metadata.SHA256, info.Metadata.SHA256, want)
+				}
+			})
+			t.Run("get can seek", func(t *testing.T) {
+				store := open(t)
+				put, _ := store.Put(ctx, "a.txt", Metadata{}, strings.NewReader("0123456789"))
+
+				r, _, err := store.Get(ctx, put.ID)
+				assertNoError(t, err)
+				defer r.Close()
+				size, err := r.Seek(0, io.SeekEnd)
+				assertNoError(t, err)
+				r.Seek(6, io.SeekStart)
+				tail, _ := io.ReadAll(r)
+				r.Seek(2, io.SeekStart)
+				middle := make([]byte, 3)
+				io.ReadFull(r, middle)
+
+				if size != 10 || string(tail) != "6789" || string(middle) != "234" {
+					t.Errorf("got size %d tail %q middle %q", size, tail, middle)
+				}
+			})
+			t.Run("failed read stores nothing", func(t *testing.T) {
+				store := open(t)
+
+				_, err := store.Put(ctx, "broken.png", Metadata{}, io.MultiReader(strings.NewReader("half"), brokenReader{}))
+				if !errors.Is(err, errBrokenReader) {
+					t.Errorf("got %v want %v", err, errBrokenReader)
+				}
+
+				files, err := store.List(ctx, Query{})
+				assertNoError(t, err)
+				if len(files) != 0 {
+					t.Errorf("got %d files want none", len(files))
+				}
+			})
+			t.Run("cancelled put stores nothing", func(t *testing.T) {
+				store := open(t)
+				cancelled, cancel := context.WithCancel(ctx)
+				cancel()
+
+				_, err := store.Put(cancelled, "late.png", Metadata{}, strings.NewReader("png bytes"))
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("got %v want %v", err, context.Canceled)
+				}
+
+				files, err := store.List(ctx, Query{})
+				assertNoError(t, err)
+				if len(files) != 0 {
+					t.Errorf("got %d files want none", len(files))
+				}
+			})
+			t.Run("list filters and sorts newest first", func(t *testing.T) {
+				store := open(t)
+				store.Put(ctx, "a.png", Metadata{ClientID: "cam-1"}, strings.NewReader("1"))
+				store.Put(ctx, "b.png", Metadata{ClientID: "cam-2"}, strings.NewReader("2"))
+				newest, _ := store.Put(ctx, "a.png", Metadata{ClientID: "cam-1"}, strings.NewReader("3"))
+
+				files, err := store.List(ctx, Query{Name: "a.png"})
+				assertNoError(t, err)
+				if len(files) != 2 || files[0].ID != newest.ID {
+					t.Errorf("got %+v, want two revisions with %s first", files, newest.ID)
+				}
+
+				files, err = store.List(ctx, Query{ClientIDs: []string{"cam-2"}})
+				assertNoError(t, err)
+				if len(files) != 1 || files[0].Name != "b.png" {
+					t.Errorf("got %+v want only b.png", files)
+				}
+
+				files, err = store.List(ctx, Query{ClientIDs: []string{}})
+				assertNoError(t, err)
+				if len(files) != 0 {
+					t.Errorf("empty client list matched %d files", len(files))
+				}
+			})
+			t.Run("rename and annotate update the file", func(t *testing.T) {
+				store := open(t)
+				put, _ := store.Put(ctx, "a.png", Metadata{ClientID: "cam-1"}, strings.NewReader("1"))
+
+				assertNoError(t, store.Rename(ctx, put.ID, "b.png"))
+				assertNoError(t, store.Annotate(ctx, put.ID, []string{"night", "gate"}, "north gate"))
+
+				info, err := store.Stat(ctx, put.ID)
+				assertNoError(t, err)
+				want := Metadata{ClientID: "cam-1", SHA256: put.Metadata.SHA256, Tags: []string{"night", "gate"}, Description: "north gate"}
+				if info.Name != "b.png" || !reflect.DeepEqual(info.Metadata, want) {
+					t.Errorf("got %+v", info)
+				}
+				if files, _ := store.List(ctx, Query{Name: "a.png"}); len(files) != 0 {
+					t.Errorf("old name still lists %d files", len(files))
+				}
+				if err := store.Rename(ctx, "ffffffffffffffffffffffff", "c.png"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("got %v want %v", err, ErrNotFound)
+				}
+			})
+			t.Run("properties are merged", func(t *testing.T) {
+				store := open(t)
+				put, _ := store.Put(ctx, "a.png", Metadata{ClientID: "cam-1"}, strings.NewReader("1"))
+
+				assertNoError(t, store.SetProperties(ctx, put.ID, map[string]string{"width": "640", "height": "480"}))
+				assertNoError(t, store.SetProperties(ctx, put.ID, map[string]string{"height": "360", "md5": "c4ca"}))
+
+				info, err := store.Stat(ctx, put.ID)
+				assertNoError(t, err)
+				want := map[string]string{"width": "640", "height": "360", "md5": "c4ca"}
+				if !reflect.DeepEqual(info.Metadata.Properties, want) {
+					t.Errorf("got %v want %v", info.Metadata.Properties, want)
+				}
+				if err := store.SetProperties(ctx, "ffffffffffffffffffffffff", want); !errors.Is(err, ErrNotFound) {
+					t.Errorf("got %v want %v", err, ErrNotFound)
+				}
+			})
+			t.Run("queries filter, sort and page", func(t *testing.T) {
+				store := open(t)
+				put := func(name, contentType, content string) FileInfo {
+					t.Helper()
+					info, err := store.Put(ctx, name, Metadata{ClientID: "cam-1", ContentType: contentType}, strings.NewReader(content))
+					assertNoError(t, err)
+					time.Sleep(2 * time.Millisecond)
+					return info
+				}
+				frame1 := put("Frame1.png", "image/png", "12345")
+				report := put("report.pdf", "application/pdf", "123")
+				frame2 := put("frame2.jpg", "image/jpeg", "1234567")
+				notes := put("notes.txt", "text/plain; charset=utf-8", "1")
+
+				for _, tt := range []struct {
+					name  string
+					query Query
+					want  []FileInfo
+				}{
+					{"newest first by default", Query{}, []FileInfo{notes, frame2, report, frame1}},
+					{"name contains, any case", Query{NameContains: "FRAME"}, []FileInfo{frame2, frame1}},
+					{"glob", Query{NameGlob: "frame?.*g"}, []FileInfo{frame2, frame1}},
+					{"glob class", Query{NameGlob: "*[!g]"}, []FileInfo{notes, report}},
+					{"contains and glob", Query{NameContains: "2", NameGlob: "*.jpg"}, []FileInfo{frame2}},
+					{"content type", Query{ContentType: "text/plain"}, []FileInfo{notes}},
+					{"content type family", Query{ContentType: "image/"}, []FileInfo{frame2, frame1}},
+					{"size range", Query{MinSize: 3, MaxSize: 5}, []FileInfo{report, frame1}},
+					{"uploaded from", Query{UploadedAfter: frame2.UploadDate}, []FileInfo{notes, frame2}},
+					{"uploaded before", Query{UploadedBefore: report.UploadDate}, []FileInfo{frame1}},
+					{"by name", Query{Sort: SortName, Ascending: true}, []FileInfo{frame1, frame2, notes, report}},
+					{"by size", Query{Sort: SortSize}, []FileInfo{frame2, frame1, report, notes}},
+					{"oldest first, paged", Query{Ascending: true, Offset: 1, Limit: 2}, []FileInfo{report, frame2}},
+					{"offset past the end", Query{Offset: 10}, nil},
+				} {
+					t.Run(tt.name, func(t *testing.T) {
+						files, err := store.List(ctx, tt.query)
+						assertNoError(t, err)
+						if !sameIDs(files, tt.want) {
+							t.Errorf("got %v want %v", names(files), names(tt.want))
+						}
+					})
+				}
+
+				n, err := store.Count(ctx, Query{ContentType: "image/", Limit: 1})
+				assertNoError(t, err)
+				if n != 2 {
+					t.Errorf("got count %d want 2", n)
+				}
+				usage, err := store.Usage(ctx, Query{ContentType: "image/", Offset: 1})
+				assertNoError(t, err)
+				if usage != (Usage{Files: 2, Bytes: 12, StoredBytes: 12}) {
+					t.Errorf("got usage %+v want 2 files of 12 bytes", usage)
+				}
+				for _, q := range []Query{{NameGlob: "[abc"}, {Sort: "colour"}} {
+					if _, err := store.List(ctx, q); !errors.Is(err, ErrInvalidQuery) {
+						t.Errorf("List(%+v): got %v want %v", q, err, ErrInvalidQuery)
+					}
+				}
+			})
+			t.Run("folders", func(t *testing.T) {
+				store := open(t)
+				put := func(name, clientID string) FileInfo {
+					t.Helper()
+					info, err := store.Put(ctx, name, Metadata{ClientID: clientID}, strings.NewReader(name))
+					assertNoError(t, err)
+					time.Sleep(2 * time.Millisecond)
+					return info
+				}
+				top := put("top.txt", "cam-1")
+				day := put("cam/2024-03-01/frame.png", "cam-1")
+				log := put("cam/log.txt", "cam-1")
+				other := put("cam/2024-03-02/frame.png", "cam-2")
+				put("camera.txt", "cam-1")
+
+				for _, tt := range []struct {
+					name  string
+					query Query
+					want  []FileInfo
+				}{
+					{"under a folder", Query{Folder: "cam"}, []FileInfo{other, log, day}},
+					{"directly in a folder", Query{Folder: "cam", Flat: true}, []FileInfo{log}},
+					{"top level", Query{Flat: true, NameContains: "top"}, []FileInfo{top}},
+					{"folder names are exact", Query{Folder: "CAM"}, nil},
+				} {
+					t.Run(tt.name, func(t *testing.T) {
+						files, err := store.List(ctx, tt.query)
+						assertNoError(t, err)
+						if !sameIDs(files, tt.want) {
+							t.Errorf("got %v want %v", names(files), names(tt.want))
+						}
+					})
+				}
+
+				for _, tt := range []struct {
+					query Query
+					want  string
+				}{
+					{Query{}, "cam"},
+					{Query{Folder: "cam", Flat: true}, "cam/2024-03-01,cam/2024-03-02"},
+					{Query{Folder: "cam", ClientIDs: []string{"cam-1"}}, "cam/2024-03-01"},
+					{Query{Folder: "cam/log.txt"}, ""},
+				} {
+					folders, err := store.Folders(ctx, tt.query)
+					assertNoError(t, err)
+					if got := strings.Join(folders, ","); got != tt.want {
+						t.Errorf("Folders(%+v): got %q want %q", tt.query, got, tt.want)
+					}
+				}
+			})
+			t.Run("delete removes the file", func(t *testing.T) {
+				store := open(t)
+				put, _ := store.Put(ctx, "a.png", Metadata{}, strings.NewReader("1"))
+
+				assertNoError(t, store.Delete(ctx, put.ID))
+
+				if _, err := store.Stat(ctx, put.ID); !errors.Is(err, ErrNotFound) {
+					t.Errorf("got %v want %v", err, ErrNotFound)
+				}
+				if err := store.Delete(ctx, put.ID); !errors.Is(err, ErrNotFound) {
+					t.Errorf("got %v want %v", err, ErrNotFound)
+				}
+			})
+			t.Run("unknown IDs are not found", func(t *testing.T) {
+				store := open(t)
+				for _, id := range []string{"", "../etc/passwd", "ffffffffffffffffffffffff"} {
+					if _, _, err := store.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+						t.Errorf("Get(%q): got %v want %v", id, err, ErrNotFound)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range testBackends(t) {
+		if !strings.HasSuffix(name, "-dedup") {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Run("identical content is stored once", func(t *testing.T) {
+				store := open(t)
+				first, err := store.Put(ctx, "a.png", Metadata{ClientID: "cam-1"}, strings.NewReader("frame"))
+				assertNoError(t, err)
+				second, err := store.Put(ctx, "b.png", Metadata{ClientID: "cam-2", SHA256: first.Metadata.SHA256}, strings.NewReader("frame"))
+				assertNoError(t, err)
+
+				usage, err := store.Usage(ctx, Query{})
+				assertNoError(t, err)
+				if usage != (Usage{Files: 2, Bytes: 10, StoredBytes: 5}) {
+					t.Errorf("got usage %+v want 2 files of 10 bytes stored in 5", usage)
+				}
+				if n := storedBlobs(t, store); n != 1 {
+					t.Errorf("got %d blobs want 1", n)
+				}
+				assertContent(t, store, second.ID, "frame")
+			})
+			t.Run("content is kept until its last file is deleted", func(t *testing.T) {
+				store := open(t)
+				first, _ := store.Put(ctx, "a.png", Metadata{}, strings.NewReader("frame"))
+				second, _ := store.Put(ctx, "b.png", Metadata{}, strings.NewReader("frame"))
+
+				assertNoError(t, store.Delete(ctx, first.ID))
+				assertContent(t, store, second.ID, "frame")
+				assertNoError(t, store.Delete(ctx, second.ID))
+
+				if n := storedBlobs(t, store); n != 0 {
+					t.Errorf("got %d blobs want 0", n)
+				}
+				third, err := store.Put(ctx, "c.png", Metadata{}, strings.NewReader("frame"))
+				assertNoError(t, err)
+				assertContent(t, store, third.ID, "frame")
+			})
+			t.Run("content not matching its digest is refused", func(t *testing.T) {
+				store := open(t)
+				stored, _ := store.Put(ctx, "a.png", Metadata{}, strings.NewReader("frame"))
+
+				for _, content := range []string{"other", "frame and more"} {
+					_, err := store.Put(ctx, "b.png", Metadata{SHA256: stored.Metadata.SHA256}, strings.NewReader(content))
+					if !errors.Is(err, ErrDigestMismatch) {
+						t.Errorf("got %v want %v", err, ErrDigestMismatch)
+					}
+				}
+
+				if n, _ := store.Count(ctx, Query{}); n != 1 {
+					t.Errorf("got %d files want 1", n)
+				}
+				if n := storedBlobs(t, store); n != 1 {
+					t.Errorf("got %d blobs want 1", n)
+				}
+				assertNoError(t, store.Delete(ctx, stored.ID))
+				if n := storedBlobs(t, store); n != 0 {
+					t.Errorf("got %d blobs after delete want 0", n)
+				}
+			})
+		})
+	}
+
+	t.Run("dir counts references again after a restart", func(t *testing.T) {
+		root := t.TempDir()
+		d, _ := NewDir(root)
+		d.Dedup = true
+		first, _ := d.Put(ctx, "a.png", Metadata{}, strings.NewReader("frame"))
+		second, _ := d.Put(ctx, "b.png", Metadata{}, strings.NewReader("frame"))
+
+		restarted, _ := NewDir(root)
+		assertNoError(t, restarted.Delete(ctx, first.ID))
+
+		assertContent(t, restarted, second.ID, "frame")
+	})
+}
+
+// storedBlobs counts the content a deduplicating store holds.
+func storedBlobs(t *testing.T, store BlobStore) int {
+	t.Helper()
+	switch s := store.(type) {
+	case *Memory:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return len(s.blobs)
+	case *Dir:
+		entries, err := os.ReadDir(filepath.Join(s.root, "blobs"))
+		assertNoError(t, err)
+		return len(entries)
+	case *GridFS:
+		n, err := s.blobs.GetFilesCollection().CountDocuments(context.Background(), bson.M{})
+		assertNoError(t, err)
+		return int(n)
+	}
+	t.Fatalf("no blobs in a %T", store)
+	return 0
+}
+
+func assertContent(t *testing.T, store BlobStore, id, want string) {
+	t.Helper()
+	r, _, err := store.Get(context.Background(), id)
+	assertNoError(t, err)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	assertNoError(t, err)
+	if string(got) != want {
+		t.Errorf("got content %q want %q", got, want)
+	}
+}
+
+func sameIDs(got, want []FileInfo) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i].ID != want[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+func names(files []FileInfo) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func assertNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("got an error but didn't want one: %v", err)
+	}
+}
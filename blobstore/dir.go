@@ -0,0 +1,369 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dir keeps files in a local directory. Every file is stored as <id>.blob
+// with its FileInfo in <id>.json; names never become paths, so a stored name
+// cannot escape the directory. A deduplicating Dir stores content in
+// blobs/<sha256> instead, and the .json says which.
+type Dir struct {
+	// Dedup makes the store deduplicating. Set it before the first Put.
+	// Only one process may change a Dir that holds deduplicated files.
+	Dedup bool
+
+	root string
+
+	mu   sync.Mutex
+	refs map[string]int // files per blob, counted on first use
+}
+
+// dirRecord is what <id>.json holds.
+type dirRecord struct {
+	FileInfo
+	Blob string `json:"blob,omitempty"`
+}
+
+func NewDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &Dir{root: root}, nil
+}
+
+func (d *Dir) path(id, ext string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return "", ErrNotFound
+	}
+	return filepath.Join(d.root, id+ext), nil
+}
+
+func (d *Dir) blobPath(digest string) string {
+	return filepath.Join(d.root, "blobs", digest)
+}
+
+// contentPath returns where the content of rec is.
+func (d *Dir) contentPath(rec dirRecord) string {
+	if rec.Blob != "" {
+		return d.blobPath(rec.Blob)
+	}
+	blobPath, _ := d.path(rec.ID, ".blob")
+	return blobPath
+}
+
+func (d *Dir) Put(ctx context.Context, name string, meta Metadata, r io.Reader) (FileInfo, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return FileInfo{}, err
+	}
+	id := hex.EncodeToString(raw)
+	blobPath, _ := d.path(id, ".blob")
+
+	// Write under a temporary name so a failed upload never shows up.
+	tmp, err := os.CreateTemp(d.root, id+".*.tmp")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), contextReader{ctx, r})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if d.Dedup && meta.SHA256 != "" && meta.SHA256 != digest {
+		return FileInfo{}, ErrDigestMismatch
+	}
+	if meta.SHA256 == "" {
+		meta.SHA256 = digest
+	}
+
+	rec := dirRecord{FileInfo: FileInfo{ID: id, Name: name, Size: size, UploadDate: time.Now().UTC(), Metadata: meta}}
+	if d.Dedup {
+		rec.Blob = digest
+		if err := d.putBlob(rec, tmp.Name()); err != nil {
+			return FileInfo{}, err
+		}
+		return rec.FileInfo, nil
+	}
+	if err := d.writeRecord(rec); err != nil {
+		return FileInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		d.Delete(ctx, id)
+		return FileInfo{}, err
+	}
+	return rec.FileInfo, nil
+}
+
+// putBlob records rec, whose content is in the file tmp. The content
+// becomes rec's blob unless the blob is stored already.
+func (d *Dir) putBlob(rec dirRecord, tmp string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.countRefs(); err != nil {
+		return err
+	}
+	if d.refs[rec.Blob] == 0 {
+		if err := os.Rename(tmp, d.blobPath(rec.Blob)); err != nil {
+			return err
+		}
+	}
+	d.refs[rec.Blob]++
+	if err := d.writeRecord(rec); err != nil {
+		d.release(rec.Blob)
+		return err
+	}
+	return nil
+}
+
+// countRefs counts the files of every blob the first time it is called,
+// and removes blobs without files, which a crash can leave behind. d.mu
+// must be held.
+func (d *Dir) countRefs() error {
+	if d.refs != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(d.root, "blobs"), 0o755); err != nil {
+		return err
+	}
+	records, err := d.records()
+	if err != nil {
+		return err
+	}
+	refs := map[string]int{}
+	for _, rec := range records {
+		if rec.Blob != "" {
+			refs[rec.Blob]++
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(d.root, "blobs"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if refs[entry.Name()] == 0 {
+			os.Remove(d.blobPath(entry.Name()))
+		}
+	}
+	d.refs = refs
+	return nil
+}
+
+// release drops a file's reference to blob and removes the blob with its
+// last one. d.mu must be held.
+func (d *Dir) release(blob string) error {
+	d.refs[blob]--
+	if d.refs[blob] > 0 {
+		return nil
+	}
+	delete(d.refs, blob)
+	if err := os.Remove(d.blobPath(blob)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *Dir) writeRecord(rec dirRecord) error {
+	infoPath, _ := d.path(rec.ID, ".json")
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp := infoPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, infoPath)
+}
+
+func (d *Dir) readRecord(id string) (dirRecord, error) {
+	infoPath, err := d.path(id, ".json")
+	if err != nil {
+		return dirRecord{}, err
+	}
+	data, err := os.ReadFile(infoPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return dirRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return dirRecord{}, err
+	}
+	var rec dirRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return dirRecord{}, err
+	}
+	return rec, nil
+}
+
+// records returns every file whose content is in place.
+func (d *Dir) records() ([]dirRecord, error) {
+	entries, err := os.ReadDir(d.root)
+	if err != nil {
+		return nil, err
+	}
+	var records []dirRecord
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		rec, err := d.readRecord(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Skip files whose content is not in place yet.
+		if !fileExists(d.contentPath(rec)) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (d *Dir) Get(ctx context.Context, id string) (io.ReadSeekCloser, FileInfo, error) {
+	rec, err := d.readRecord(id)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	f, err := os.Open(d.contentPath(rec))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, FileInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return f, rec.FileInfo, nil
+}
+
+func (d *Dir) Stat(ctx context.Context, id string) (FileInfo, error) {
+	rec, err := d.readRecord(id)
+	return rec.FileInfo, err
+}
+
+func (d *Dir) List(ctx context.Context, q Query) ([]FileInfo, error) {
+	records, err := d.records()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileInfo, 0, len(records))
+	for _, rec := range records {
+		files = append(files, rec.FileInfo)
+	}
+	return selectFiles(files, q)
+}
+
+func (d *Dir) Count(ctx context.Context, q Query) (int, error) {
+	q.Offset, q.Limit = 0, 0
+	files, err := d.List(ctx, q)
+	return len(files), err
+}
+
+func (d *Dir) Usage(ctx context.Context, q Query) (Usage, error) {
+	q.Offset, q.Limit = 0, 0
+	records, err := d.records()
+	if err != nil {
+		return Usage{}, err
+	}
+	files := make([]FileInfo, 0, len(records))
+	content := map[string]string{}
+	for _, rec := range records {
+		files = append(files, rec.FileInfo)
+		content[rec.ID] = d.contentPath(rec)
+	}
+	selected, err := selectFiles(files, q)
+	return totalUsage(selected, func(info FileInfo) string { return content[info.ID] }), err
+}
+
+func (d *Dir) Folders(ctx context.Context, q Query) ([]string, error) {
+	q.Flat, q.Offset, q.Limit = false, 0, 0
+	files, err := d.List(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return folderNames(files, q)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (d *Dir) Rename(ctx context.Context, id, name string) error {
+	return d.update(ctx, id, func(info *FileInfo) { info.Name = name })
+}
+
+func (d *Dir) Annotate(ctx context.Context, id string, tags []string, description string) error {
+	return d.update(ctx, id, func(info *FileInfo) {
+		info.Metadata.Tags = tags
+		info.Metadata.Description = description
+	})
+}
+
+func (d *Dir) SetProperties(ctx context.Context, id string, props map[string]string) error {
+	return d.update(ctx, id, func(info *FileInfo) {
+		info.Metadata.Properties = withProperties(info.Metadata.Properties, props)
+	})
+}
+
+// update rewrites the FileInfo of a file. Concurrent updates of one file
+// may lose all but one change.
+func (d *Dir) update(ctx context.Context, id string, change func(*FileInfo)) error {
+	rec, err := d.readRecord(id)
+	if err != nil {
+		return err
+	}
+	change(&rec.FileInfo)
+	return d.writeRecord(rec)
+}
+
+func (d *Dir) Delete(ctx context.Context, id string) error {
+	rec, err := d.readRecord(id)
+	if err != nil {
+		return err
+	}
+	if rec.Blob != "" {
+		// Count before the file goes, or it would be missed
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err := d.countRefs(); err != nil {
+			return err
+		}
+	}
+	infoPath, _ := d.path(id, ".json")
+	if err := os.Remove(infoPath); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if rec.Blob != "" {
+		return d.release(rec.Blob)
+	}
+	if err := os.Remove(d.contentPath(rec)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *Dir) Close() error {
+	return nil
+}
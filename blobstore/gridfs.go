@@ -0,0 +1,674 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GridFS keeps files in a MongoDB GridFS bucket.
+//
+// A deduplicating GridFS keeps content in the blobs bucket, once per
+// SHA-256, with the number of files that share it in the blob's metadata.
+// The files of the default bucket then have no chunks of their own; they
+// name their blob instead. A failure between changing a file and its blob
+// can only leave a count too high, so content may be kept too long but
+// is never freed while a file uses it.
+type GridFS struct {
+	// Dedup makes the store deduplicating. Set it before the first Put.
+	Dedup bool
+
+	bucket *gridfs.Bucket
+	blobs  *gridfs.Bucket
+	// client is set when the store owns its connection.
+	client *mongo.Client
+}
+
+// NewGridFS uses the default bucket of db. The caller keeps ownership of
+// the database's client.
+func NewGridFS(db *mongo.Database) (*GridFS, error) {
+	bucket, err := gridfs.NewBucket(db)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := gridfs.NewBucket(db, options.GridFSBucket().SetName("blobs"))
+	if err != nil {
+		return nil, err
+	}
+	return &GridFS{bucket: bucket, blobs: blobs}, nil
+}
+
+// gridFSRecord is a document of the files collection. Blob is set on the
+// files of a deduplicating store.
+type gridFSRecord struct {
+	gridfs.File
+	Blob primitive.ObjectID
+}
+
+// DialGridFS connects to MongoDB at uri and uses the default bucket of
+// database. Close disconnects.
+func DialGridFS(ctx context.Context, uri, database string) (*GridFS, error) {
+	opts := options.Client().ApplyURI(uri).SetServerSelectionTimeout(5 * time.Second)
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	g, err := NewGridFS(client.Database(database))
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	g.client = client
+	return g, nil
+}
+
+// MongoError marks errors caused by an unreachable MongoDB as
+// ErrUnavailable.
+func MongoError(err error) error {
+	if mongo.IsTimeout(err) || mongo.IsNetworkError(err) || errors.Is(err, mongo.ErrClientDisconnected) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
+
+func objectID(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, ErrNotFound
+	}
+	return oid, nil
+}
+
+func (g *GridFS) Put(ctx context.Context, name string, meta Metadata, r io.Reader) (FileInfo, error) {
+	if g.Dedup {
+		return g.putDeduplicated(ctx, name, meta, r)
+	}
+	opts := options.GridFSUpload().SetMetadata(meta)
+	stream, err := g.bucket.OpenUploadStream(name, opts)
+	if err != nil {
+		return FileInfo{}, MongoError(err)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(stream, hash), contextReader{ctx, r})
+	if err != nil {
+		stream.Abort()
+		return FileInfo{}, MongoError(err)
+	}
+	if err := stream.Close(); err != nil {
+		return FileInfo{}, MongoError(err)
+	}
+
+	oid, _ := stream.FileID.(primitive.ObjectID)
+	// The digest is only known once the content is in, so it is added to
+	// the file document afterwards.
+	if meta.SHA256 == "" {
+		meta.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		update := bson.M{"$set": bson.M{"metadata.sha256": meta.SHA256}}
+		if _, err := g.bucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": oid}, update); err != nil {
+			g.bucket.DeleteContext(ctx, oid)
+			return FileInfo{}, MongoError(err)
+		}
+	}
+	// The driver sets uploadDate itself; read it back so callers see the
+	// date List filters and sorts on.
+	if info, err := g.Stat(ctx, oid.Hex()); err == nil {
+		return info, nil
+	}
+	return FileInfo{
+		ID:         oid.Hex(),
+		Name:       name,
+		Size:       size,
+		UploadDate: oid.Timestamp(),
+		Metadata:   meta,
+	}, nil
+}
+
+func (g *GridFS) Get(ctx context.Context, id string) (io.ReadSeekCloser, FileInfo, error) {
+	rec, err := g.record(ctx, id)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	bucket, contentID := g.bucket, rec.ID
+	if !rec.Blob.IsZero() {
+		bucket, contentID = g.blobs, rec.Blob
+	}
+	stream, err := bucket.OpenDownloadStream(contentID)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, FileInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, FileInfo{}, MongoError(err)
+	}
+	info := toFileInfo(&rec.File)
+	return &gridFSReader{bucket: bucket, id: contentID, size: info.Size, stream: stream}, info, nil
+}
+
+// record reads the files document of id.
+func (g *GridFS) record(ctx context.Context, id string) (gridFSRecord, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return gridFSRecord{}, err
+	}
+	doc, err := g.bucket.GetFilesCollection().FindOne(ctx, bson.M{"_id": oid}).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return gridFSRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return gridFSRecord{}, MongoError(err)
+	}
+	// gridfs.File decodes itself, so it cannot be inlined with the blob
+	var rec gridFSRecord
+	if err := bson.Unmarshal(doc, &rec.File); err != nil {
+		return gridFSRecord{}, err
+	}
+	if blob, ok := doc.Lookup("blob").ObjectIDOK(); ok {
+		rec.Blob = blob
+	}
+	return rec, nil
+}
+
+// gridFSReader makes a GridFS download seekable. A seek drops the current
+// stream; the next read reopens it and skips to the offset, which GridFS
+// does without fetching the skipped chunks.
+type gridFSReader struct {
+	bucket *gridfs.Bucket
+	id     interface{}
+	size   int64
+	offset int64
+	stream *gridfs.DownloadStream
+}
+
+func (r *gridFSReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.stream == nil {
+		stream, err := r.bucket.OpenDownloadStream(r.id)
+		if err != nil {
+			return 0, MongoError(err)
+		}
+		if _, err := stream.Skip(r.offset); err != nil {
+			stream.Close()
+			return 0, MongoError(err)
+		}
+		r.stream = stream
+	}
+	n, err := r.stream.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *gridFSReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("blobstore: negative seek offset")
+	}
+	if offset != r.offset && r.stream != nil {
+		r.stream.Close()
+		r.stream = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *gridFSReader) Close() error {
+	if r.stream == nil {
+		return nil
+	}
+	return r.stream.Close()
+}
+
+func (g *GridFS) Stat(ctx context.Context, id string) (FileInfo, error) {
+	oid, err := objectID(id)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	files, err := g.find(ctx, bson.M{"_id": oid}, options.GridFSFind())
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if len(files) == 0 {
+		return FileInfo{}, ErrNotFound
+	}
+	return files[0], nil
+}
+
+func (g *GridFS) List(ctx context.Context, q Query) ([]FileInfo, error) {
+	filter, err := gridFSFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.GridFSFind().SetSort(gridFSSort(q))
+	if q.Offset > 0 {
+		opts.SetSkip(int32(min(q.Offset, math.MaxInt32)))
+	}
+	if q.Limit > 0 {
+		opts.SetLimit(int32(min(q.Limit, math.MaxInt32)))
+	}
+	return g.find(ctx, filter, opts)
+}
+
+func (g *GridFS) Count(ctx context.Context, q Query) (int, error) {
+	filter, err := gridFSFilter(q)
+	if err != nil {
+		return 0, err
+	}
+	n, err := g.bucket.GetFilesCollection().CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, MongoError(err)
+	}
+	return int(n), nil
+}
+
+func (g *GridFS) Usage(ctx context.Context, q Query) (Usage, error) {
+	filter, err := gridFSFilter(q)
+	if err != nil {
+		return Usage{}, err
+	}
+	// Files are grouped by their content first, so shared content is
+	// stored once.
+	cursor, err := g.bucket.GetFilesCollection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"$ifNull": bson.A{"$blob", "$_id"}},
+			"files":  bson.M{"$sum": 1},
+			"bytes":  bson.M{"$sum": "$length"},
+			"stored": bson.M{"$first": "$length"},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    nil,
+			"files":  bson.M{"$sum": "$files"},
+			"bytes":  bson.M{"$sum": "$bytes"},
+			"stored": bson.M{"$sum": "$stored"},
+		}}},
+	})
+	if err != nil {
+		return Usage{}, MongoError(err)
+	}
+	defer cursor.Close(ctx)
+	var totals []struct {
+		Files  int   `bson:"files"`
+		Bytes  int64 `bson:"bytes"`
+		Stored int64 `bson:"stored"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return Usage{}, MongoError(err)
+	}
+	if len(totals) == 0 {
+		return Usage{}, nil
+	}
+	return Usage{Files: totals[0].Files, Bytes: totals[0].Bytes, StoredBytes: totals[0].Stored}, nil
+}
+
+func (g *GridFS) Folders(ctx context.Context, q Query) ([]string, error) {
+	q.Flat = false
+	filter, err := gridFSFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	values, err := g.bucket.GetFilesCollection().Distinct(ctx, "filename", filter)
+	if err != nil {
+		return nil, MongoError(err)
+	}
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		if name, ok := v.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return subfolders(q.Folder, names), nil
+}
+
+// gridFSFilter translates q into a filter on the files collection.
+func gridFSFilter(q Query) (bson.M, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	filter := bson.M{}
+	if q.Name != "" {
+		filter["filename"] = q.Name
+	}
+	var and bson.A
+	if expr := q.folderRegexp(); expr != "" {
+		and = append(and, bson.M{"filename": primitive.Regex{Pattern: expr}})
+	}
+	exprs, _ := q.nameRegexps()
+	for _, expr := range exprs {
+		and = append(and, bson.M{"filename": primitive.Regex{Pattern: expr, Options: "i"}})
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	if q.ClientIDs != nil {
+		filter["metadata.clientID"] = bson.M{"$in": q.ClientIDs}
+	}
+	if q.ContentType != "" {
+		filter["metadata.contentType"] = primitive.Regex{Pattern: contentTypeRegexp(q.ContentType)}
+	}
+	uploadDate := bson.M{}
+	if !q.UploadedAfter.IsZero() {
+		uploadDate["$gte"] = q.UploadedAfter
+	}
+	if !q.UploadedBefore.IsZero() {
+		uploadDate["$lt"] = q.UploadedBefore
+	}
+	if len(uploadDate) > 0 {
+		filter["uploadDate"] = uploadDate
+	}
+	length := bson.M{}
+	if q.MinSize > 0 {
+		length["$gte"] = q.MinSize
+	}
+	if q.MaxSize > 0 {
+		length["$lte"] = q.MaxSize
+	}
+	if len(length) > 0 {
+		filter["length"] = length
+	}
+	return filter, nil
+}
+
+// gridFSSort translates the order of q. uploadDate has millisecond
+// precision; _id orders uploads within the same millisecond.
+func gridFSSort(q Query) bson.D {
+	direction := -1
+	if q.Ascending {
+		direction = 1
+	}
+	newestFirst := bson.D{{Key: "uploadDate", Value: -1}, {Key: "_id", Value: -1}}
+	switch q.Sort {
+	case SortName:
+		return append(bson.D{{Key: "filename", Value: direction}}, newestFirst...)
+	case SortSize:
+		return append(bson.D{{Key: "length", Value: direction}}, newestFirst...)
+	}
+	return bson.D{{Key: "uploadDate", Value: direction}, {Key: "_id", Value: direction}}
+}
+
+// EnsureIndexes creates the indexes List relies on. It is safe to call on
+// every start.
+func (g *GridFS) EnsureIndexes(ctx context.Context) error {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "uploadDate", Value: -1}}},
+		{Keys: bson.D{{Key: "filename", Value: 1}, {Key: "uploadDate", Value: -1}}},
+		{Keys: bson.D{{Key: "metadata.clientID", Value: 1}, {Key: "uploadDate", Value: -1}}},
+		{Keys: bson.D{{Key: "metadata.contentType", Value: 1}}},
+		{Keys: bson.D{{Key: "length", Value: 1}}},
+	}
+	_, err := g.bucket.GetFilesCollection().Indexes().CreateMany(ctx, models)
+	return MongoError(err)
+}
+
+func (g *GridFS) find(ctx context.Context, filter bson.M, opts *options.GridFSFindOptions) ([]FileInfo, error) {
+	cursor, err := g.bucket.FindContext(ctx, filter, opts)
+	if err != nil {
+		return nil, MongoError(err)
+	}
+	var files []gridfs.File
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, MongoError(err)
+	}
+	infos := make([]FileInfo, 0, len(files))
+	for i := range files {
+		infos = append(infos, toFileInfo(&files[i]))
+	}
+	return infos, nil
+}
+
+func (g *GridFS) Rename(ctx context.Context, id, name string) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	err = g.bucket.RenameContext(ctx, oid, name)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return ErrNotFound
+	}
+	return MongoError(err)
+}
+
+func (g *GridFS) Annotate(ctx context.Context, id string, tags []string, description string) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	update := bson.M{"$set": bson.M{"metadata.tags": tags, "metadata.description": description}}
+	if len(tags) == 0 {
+		update = bson.M{
+			"$set":   bson.M{"metadata.description": description},
+			"$unset": bson.M{"metadata.tags": ""},
+		}
+	}
+	result, err := g.bucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": oid}, update)
+	if err != nil {
+		return MongoError(err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (g *GridFS) SetProperties(ctx context.Context, id string, props map[string]string) error {
+	oid, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	set := bson.M{}
+	for key, value := range props {
+		set["metadata.properties."+key] = value
+	}
+	if len(set) == 0 {
+		_, err := g.Stat(ctx, id)
+		return err
+	}
+	result, err := g.bucket.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": set})
+	if err != nil {
+		return MongoError(err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (g *GridFS) Delete(ctx context.Context, id string) error {
+	rec, err := g.record(ctx, id)
+	if err != nil {
+		return err
+	}
+	if rec.Blob.IsZero() {
+		err = g.bucket.DeleteContext(ctx, rec.ID)
+		if errors.Is(err, gridfs.ErrFileNotFound) {
+			return ErrNotFound
+		}
+		return MongoError(err)
+	}
+	result, err := g.bucket.GetFilesCollection().DeleteOne(ctx, bson.M{"_id": rec.ID})
+	if err != nil {
+		return MongoError(err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return g.releaseBlob(ctx, rec.Blob)
+}
+
+// putDeduplicated stores a file whose content goes in the blobs bucket.
+// When the digest is given and its blob is stored already, the content is
+// only read to check it.
+func (g *GridFS) putDeduplicated(ctx context.Context, name string, meta Metadata, r io.Reader) (FileInfo, error) {
+	hash := sha256.New()
+	src := io.TeeReader(contextReader{ctx, r}, hash)
+	var blob primitive.ObjectID
+	var size int64
+	var err error
+	claimed := false
+	if meta.SHA256 != "" {
+		blob, claimed, err = g.claimBlob(ctx, meta.SHA256)
+		if err != nil {
+			return FileInfo{}, err
+		}
+	}
+	if claimed {
+		size, err = io.Copy(io.Discard, src)
+	} else {
+		blob, size, err = g.uploadBlob(ctx, src)
+	}
+	if err == nil && meta.SHA256 != "" && meta.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+		err = ErrDigestMismatch
+	}
+	if err == nil && !claimed {
+		// The same content may have been stored meanwhile
+		blob, err = g.keepBlob(ctx, blob, hex.EncodeToString(hash.Sum(nil)))
+	}
+	if err != nil {
+		if claimed || !blob.IsZero() {
+			g.releaseBlob(context.WithoutCancel(ctx), blob)
+		}
+		return FileInfo{}, MongoError(err)
+	}
+
+	meta.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	oid := primitive.NewObjectID()
+	uploadDate := time.Now().UTC().Truncate(time.Millisecond)
+	rec := bson.M{
+		"_id":        oid,
+		"length":     size,
+		"chunkSize":  gridfs.DefaultChunkSize,
+		"uploadDate": uploadDate,
+		"filename":   name,
+		"metadata":   meta,
+		"blob":       blob,
+	}
+	if _, err := g.bucket.GetFilesCollection().InsertOne(ctx, rec); err != nil {
+		g.releaseBlob(context.WithoutCancel(ctx), blob)
+		return FileInfo{}, MongoError(err)
+	}
+	return FileInfo{ID: oid.Hex(), Name: name, Size: size, UploadDate: uploadDate, Metadata: meta}, nil
+}
+
+// blobRefs is the metadata of a blob.
+type blobRefs struct {
+	Refs int `bson:"refs"`
+}
+
+// claimBlob adds a reference to the blob with the digest, if there is one.
+// Blobs without references are being deleted and cannot be claimed.
+func (g *GridFS) claimBlob(ctx context.Context, digest string) (primitive.ObjectID, bool, error) {
+	var blob struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err := g.blobs.GetFilesCollection().FindOneAndUpdate(ctx,
+		bson.M{"filename": digest, "metadata.refs": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"metadata.refs": 1}},
+	).Decode(&blob)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.NilObjectID, false, nil
+	}
+	if err != nil {
+		return primitive.NilObjectID, false, MongoError(err)
+	}
+	return blob.ID, true, nil
+}
+
+// uploadBlob stores r as a new blob with one reference. It gets its name
+// from keepBlob, so it cannot be claimed before then.
+func (g *GridFS) uploadBlob(ctx context.Context, r io.Reader) (primitive.ObjectID, int64, error) {
+	stream, err := g.blobs.OpenUploadStream("", options.GridFSUpload().SetMetadata(blobRefs{Refs: 1}))
+	if err != nil {
+		return primitive.NilObjectID, 0, MongoError(err)
+	}
+	size, err := io.Copy(stream, r)
+	if err != nil {
+		stream.Abort()
+		return primitive.NilObjectID, 0, err
+	}
+	if err := stream.Close(); err != nil {
+		return primitive.NilObjectID, 0, MongoError(err)
+	}
+	blob, _ := stream.FileID.(primitive.ObjectID)
+	return blob, size, nil
+}
+
+// keepBlob names the new blob after its digest, unless a blob with that
+// digest is stored already: then it is claimed and the new one released.
+// Two uploads of the same new content at the same moment may both keep
+// theirs.
+func (g *GridFS) keepBlob(ctx context.Context, blob primitive.ObjectID, digest string) (primitive.ObjectID, error) {
+	existing, ok, err := g.claimBlob(ctx, digest)
+	if err != nil {
+		return blob, err
+	}
+	if ok {
+		g.releaseBlob(ctx, blob)
+		return existing, nil
+	}
+	_, err = g.blobs.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": blob}, bson.M{"$set": bson.M{"filename": digest}})
+	return blob, MongoError(err)
+}
+
+// releaseBlob drops a reference to blob and deletes it with its last one.
+func (g *GridFS) releaseBlob(ctx context.Context, blob primitive.ObjectID) error {
+	var refs struct {
+		Metadata blobRefs `bson:"metadata"`
+	}
+	err := g.blobs.GetFilesCollection().FindOneAndUpdate(ctx,
+		bson.M{"_id": blob},
+		bson.M{"$inc": bson.M{"metadata.refs": -1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&refs)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return MongoError(err)
+	}
+	if refs.Metadata.Refs > 0 {
+		return nil
+	}
+	err = g.blobs.DeleteContext(ctx, blob)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil
+	}
+	return MongoError(err)
+}
+
+func (g *GridFS) Close() error {
+	if g.client == nil {
+		return nil
+	}
+	return g.client.Disconnect(context.Background())
+}
+
+func toFileInfo(f *gridfs.File) FileInfo {
+	info := FileInfo{
+		ID:         fmt.Sprint(f.ID),
+		Name:       f.Name,
+		Size:       f.Length,
+		UploadDate: f.UploadDate,
+	}
+	if oid, ok := f.ID.(primitive.ObjectID); ok {
+		info.ID = oid.Hex()
+	}
+	if len(f.Metadata) > 0 {
+		bson.Unmarshal(f.Metadata, &info.Metadata)
+	}
+	return info
+}
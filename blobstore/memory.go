@@ -0,0 +1,194 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory keeps files in memory. It is meant for tests and hermetic runs.
+type Memory struct {
+	// Dedup makes the store deduplicating. Set it before the first Put.
+	Dedup bool
+
+	mu     sync.RWMutex
+	nextID int
+	files  map[string]memoryFile
+	blobs  map[string]*memoryBlob
+}
+
+// memoryFile is a stored file. Its content is the blob of that key: the
+// SHA-256 of the content in a deduplicating store, the file's ID otherwise.
+type memoryFile struct {
+	info FileInfo
+	blob string
+}
+
+type memoryBlob struct {
+	data []byte
+	refs int
+}
+
+func NewMemory() *Memory {
+	return &Memory{files: map[string]memoryFile{}, blobs: map[string]*memoryBlob{}}
+}
+
+func (m *Memory) Put(ctx context.Context, name string, meta Metadata, r io.Reader) (FileInfo, error) {
+	data, err := io.ReadAll(contextReader{ctx, r})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if m.Dedup && meta.SHA256 != "" && meta.SHA256 != digest {
+		return FileInfo{}, ErrDigestMismatch
+	}
+	if meta.SHA256 == "" {
+		meta.SHA256 = digest
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	info := FileInfo{
+		ID:         strconv.Itoa(m.nextID),
+		Name:       name,
+		Size:       int64(len(data)),
+		UploadDate: time.Now(),
+		Metadata:   meta,
+	}
+	key := info.ID
+	if m.Dedup {
+		key = digest
+	}
+	blob, ok := m.blobs[key]
+	if !ok {
+		blob = &memoryBlob{data: data}
+		m.blobs[key] = blob
+	}
+	blob.refs++
+	m.files[info.ID] = memoryFile{info: info, blob: key}
+	return info, nil
+}
+
+// memoryReader adds a no-op Close to a bytes.Reader.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, id string) (io.ReadSeekCloser, FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[id]
+	if !ok {
+		return nil, FileInfo{}, ErrNotFound
+	}
+	return memoryReader{bytes.NewReader(m.blobs[f.blob].data)}, f.info, nil
+}
+
+func (m *Memory) Stat(ctx context.Context, id string) (FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[id]
+	if !ok {
+		return FileInfo{}, ErrNotFound
+	}
+	return f.info, nil
+}
+
+func (m *Memory) List(ctx context.Context, q Query) ([]FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	files := make([]FileInfo, 0, len(m.files))
+	for _, f := range m.files {
+		files = append(files, f.info)
+	}
+	return selectFiles(files, q)
+}
+
+func (m *Memory) Count(ctx context.Context, q Query) (int, error) {
+	q.Offset, q.Limit = 0, 0
+	files, err := m.List(ctx, q)
+	return len(files), err
+}
+
+func (m *Memory) Usage(ctx context.Context, q Query) (Usage, error) {
+	q.Offset, q.Limit = 0, 0
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	files := make([]FileInfo, 0, len(m.files))
+	for _, f := range m.files {
+		files = append(files, f.info)
+	}
+	selected, err := selectFiles(files, q)
+	return totalUsage(selected, func(info FileInfo) string { return m.files[info.ID].blob }), err
+}
+
+func (m *Memory) Folders(ctx context.Context, q Query) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	files := make([]FileInfo, 0, len(m.files))
+	for _, f := range m.files {
+		files = append(files, f.info)
+	}
+	return folderNames(files, q)
+}
+
+func (m *Memory) Rename(ctx context.Context, id, name string) error {
+	return m.update(id, func(info *FileInfo) { info.Name = name })
+}
+
+func (m *Memory) Annotate(ctx context.Context, id string, tags []string, description string) error {
+	return m.update(id, func(info *FileInfo) {
+		info.Metadata.Tags = slices.Clone(tags)
+		info.Metadata.Description = description
+	})
+}
+
+func (m *Memory) SetProperties(ctx context.Context, id string, props map[string]string) error {
+	return m.update(id, func(info *FileInfo) {
+		info.Metadata.Properties = withProperties(info.Metadata.Properties, props)
+	})
+}
+
+func (m *Memory) update(id string, change func(*FileInfo)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[id]
+	if !ok {
+		return ErrNotFound
+	}
+	change(&f.info)
+	m.files[id] = f
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.files, id)
+	if blob := m.blobs[f.blob]; blob.refs > 1 {
+		blob.refs--
+	} else {
+		delete(m.blobs, f.blob)
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
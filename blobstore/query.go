@@ -0,0 +1,295 @@
+package blobstore
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"mime"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrInvalidQuery is returned for a Query with a malformed pattern or
+// unknown sort order.
+var ErrInvalidQuery = errors.New("blobstore: invalid query")
+
+// Sort orders for Query.Sort.
+const (
+	SortDate = "date"
+	SortName = "name"
+	SortSize = "size"
+)
+
+// Query selects files for List and Count. The zero Query matches every file,
+// newest first.
+type Query struct {
+	// Name, if set, matches files with exactly this name.
+	Name string
+	// NameContains, if set, matches names containing it, ignoring case.
+	NameContains string
+	// NameGlob, if set, matches names against a pattern ignoring case: *
+	// matches any run of characters, ? any one, and [...] a class.
+	NameGlob string
+	// Folder, if set, matches files anywhere under this folder, that is
+	// names starting with Folder and a slash. Flat narrows the match to
+	// files directly in Folder, or at the top level if Folder is empty.
+	Folder string
+	Flat   bool
+	// ClientIDs, if non-nil, matches files uploaded by one of these clients.
+	// An empty non-nil slice matches nothing.
+	ClientIDs []string
+	// ContentType, if set, matches files of this media type, or of any
+	// subtype when it ends in a slash, like "image/".
+	ContentType string
+	// UploadedAfter and UploadedBefore, if set, bound the upload date: from
+	// UploadedAfter on, up to but excluding UploadedBefore.
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+	// MinSize and MaxSize bound the size in bytes. A zero MaxSize means no
+	// upper bound.
+	MinSize int64
+	MaxSize int64
+
+	// Sort is SortDate (the default), SortName or SortSize. Files are in
+	// descending order, newest or largest first, unless Ascending is set.
+	// Ties are broken by upload date, newest first.
+	Sort      string
+	Ascending bool
+	// Offset skips that many files; Limit, if positive, caps the result.
+	Offset int
+	Limit  int
+}
+
+// validate checks the parts of q that can be malformed.
+func (q Query) validate() error {
+	switch q.Sort {
+	case "", SortDate, SortName, SortSize:
+	default:
+		return fmt.Errorf("%w: unknown sort order %q", ErrInvalidQuery, q.Sort)
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return fmt.Errorf("%w: negative offset or limit", ErrInvalidQuery)
+	}
+	_, err := q.nameRegexps()
+	return err
+}
+
+// nameRegexps returns the regular expressions, in syntax both Go and
+// MongoDB understand, that a name must all match, ignoring case, for
+// NameContains and NameGlob.
+func (q Query) nameRegexps() ([]string, error) {
+	var exprs []string
+	if q.NameContains != "" {
+		exprs = append(exprs, regexp.QuoteMeta(q.NameContains))
+	}
+	if q.NameGlob != "" {
+		glob, err := globRegexp(q.NameGlob)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, glob)
+	}
+	return exprs, nil
+}
+
+// folderRegexp returns the case-sensitive regular expression for Folder
+// and Flat, or "" if they match every name.
+func (q Query) folderRegexp() string {
+	var expr string
+	if q.Folder != "" {
+		expr = "^" + regexp.QuoteMeta(q.Folder+"/")
+	}
+	if q.Flat {
+		if expr == "" {
+			expr = "^"
+		}
+		expr += "[^/]*$"
+	}
+	return expr
+}
+
+// subfolders returns the sorted, distinct names of the folders directly in
+// folder that hold one of names.
+func subfolders(folder string, names []string) []string {
+	prefix := ""
+	if folder != "" {
+		prefix = folder + "/"
+	}
+	var folders []string
+	for _, name := range names {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		if sub, _, ok := strings.Cut(rest, "/"); ok {
+			folders = append(folders, prefix+sub)
+		}
+	}
+	slices.Sort(folders)
+	return slices.Compact(folders)
+}
+
+// globRegexp translates a glob into an anchored regular expression.
+func globRegexp(glob string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 1 {
+				return "", fmt.Errorf("%w: unterminated [ in %q", ErrInvalidQuery, glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// matcher returns a function reporting whether a file is selected by q.
+func (q Query) matcher() (func(FileInfo) bool, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	exprs, _ := q.nameRegexps()
+	var names []*regexp.Regexp
+	for _, expr := range exprs {
+		names = append(names, regexp.MustCompile("(?i)"+expr))
+	}
+
+	var folder *regexp.Regexp
+	if expr := q.folderRegexp(); expr != "" {
+		folder = regexp.MustCompile(expr)
+	}
+
+	return func(info FileInfo) bool {
+		if q.Name != "" && info.Name != q.Name {
+			return false
+		}
+		if folder != nil && !folder.MatchString(info.Name) {
+			return false
+		}
+		for _, name := range names {
+			if !name.MatchString(info.Name) {
+				return false
+			}
+		}
+		if q.ClientIDs != nil && !slices.Contains(q.ClientIDs, info.Metadata.ClientID) {
+			return false
+		}
+		if q.ContentType != "" && !matchContentType(q.ContentType, info.Metadata.ContentType) {
+			return false
+		}
+		if !q.UploadedAfter.IsZero() && info.UploadDate.Before(q.UploadedAfter) {
+			return false
+		}
+		if !q.UploadedBefore.IsZero() && !info.UploadDate.Before(q.UploadedBefore) {
+			return false
+		}
+		if info.Size < q.MinSize || (q.MaxSize > 0 && info.Size > q.MaxSize) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+func matchContentType(want, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(want, "/") {
+		return strings.HasPrefix(mediaType, want)
+	}
+	return mediaType == want
+}
+
+// contentTypeRegexp is the regular expression form of ContentType, used by
+// backends that match in the database.
+func contentTypeRegexp(want string) string {
+	if strings.HasSuffix(want, "/") {
+		return "^" + regexp.QuoteMeta(want)
+	}
+	return "^" + regexp.QuoteMeta(want) + "(;|$)"
+}
+
+// selectFiles filters, sorts and pages files for in-process backends.
+func selectFiles(files []FileInfo, q Query) ([]FileInfo, error) {
+	match, err := q.matcher()
+	if err != nil {
+		return nil, err
+	}
+	selected := slices.DeleteFunc(files, func(info FileInfo) bool { return !match(info) })
+	sortFiles(selected, q)
+	start := min(q.Offset, len(selected))
+	end := len(selected)
+	if q.Limit > 0 {
+		end = min(start+q.Limit, end)
+	}
+	return selected[start:end], nil
+}
+
+// totalUsage totals files for in-process backends. content names what a
+// file's content is stored as.
+func totalUsage(files []FileInfo, content func(FileInfo) string) Usage {
+	usage := Usage{Files: len(files)}
+	counted := map[string]bool{}
+	for _, info := range files {
+		usage.Bytes += info.Size
+		if key := content(info); !counted[key] {
+			counted[key] = true
+			usage.StoredBytes += info.Size
+		}
+	}
+	return usage
+}
+
+// folderNames lists the subfolders of q.Folder for in-process backends.
+func folderNames(files []FileInfo, q Query) ([]string, error) {
+	q.Flat, q.Offset, q.Limit = false, 0, 0
+	selected, err := selectFiles(files, q)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(selected))
+	for _, info := range selected {
+		names = append(names, info.Name)
+	}
+	return subfolders(q.Folder, names), nil
+}
+
+// sortFiles orders files as q asks.
+func sortFiles(files []FileInfo, q Query) {
+	slices.SortStableFunc(files, func(a, b FileInfo) int {
+		var c int
+		switch q.Sort {
+		case SortName:
+			c = strings.Compare(a.Name, b.Name)
+		case SortSize:
+			c = cmp.Compare(a.Size, b.Size)
+		default:
+			c = a.UploadDate.Compare(b.UploadDate)
+		}
+		if !q.Ascending {
+			c = -c
+		}
+		if c == 0 {
+			c = b.UploadDate.Compare(a.UploadDate)
+		}
+		return c
+	})
+}
@@ -0,0 +1,197 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrDuplicate is returned by Put when the version policy rejects a name
+// that is already stored.
+var ErrDuplicate = errors.New("blobstore: file already exists")
+
+// VersionPolicy decides what happens when a name is stored again. Each
+// client has its own revisions: a name stored by another client is a
+// different file. The zero policy keeps every revision.
+type VersionPolicy struct {
+	// KeepLast, if positive, is how many revisions of a name are kept.
+	KeepLast int
+	// RejectDuplicates refuses to store a name that already exists.
+	RejectDuplicates bool
+}
+
+// String returns the policy in the form accepted by Set: "all", "last:N"
+// or "reject".
+func (p VersionPolicy) String() string {
+	switch {
+	case p.RejectDuplicates:
+		return "reject"
+	case p.KeepLast > 0:
+		return "last:" + strconv.Itoa(p.KeepLast)
+	}
+	return "all"
+}
+
+// Set parses s as returned by String, so a policy can be a command line
+// flag.
+func (p *VersionPolicy) Set(s string) error {
+	switch {
+	case s == "all":
+		*p = VersionPolicy{}
+	case s == "reject":
+		*p = VersionPolicy{RejectDuplicates: true}
+	case strings.HasPrefix(s, "last:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "last:"))
+		if err != nil || n < 1 {
+			return fmt.Errorf("blobstore: invalid revision count in %q", s)
+		}
+		*p = VersionPolicy{KeepLast: n}
+	default:
+		return fmt.Errorf(`blobstore: unknown version policy %q, want "all", "last:N" or "reject"`, s)
+	}
+	return nil
+}
+
+// WithVersionPolicy returns store with policy applied to every Put. Puts of
+// the same name by the same client are serialised so concurrent uploads
+// cannot both slip past the policy.
+func WithVersionPolicy(store BlobStore, policy VersionPolicy) BlobStore {
+	if policy == (VersionPolicy{}) {
+		return store
+	}
+	return &versioned{BlobStore: store, policy: policy, locks: map[string]*nameLock{}}
+}
+
+// OnPrune makes store call pruned with every revision its version policy
+// deletes, once it is gone. A store without a policy deletes none. Call it
+// before the store is used.
+func OnPrune(store BlobStore, pruned func(ctx context.Context, file FileInfo)) {
+	if v, ok := store.(*versioned); ok {
+		v.pruned = pruned
+	}
+}
+
+type versioned struct {
+	BlobStore
+	policy VersionPolicy
+	pruned func(ctx context.Context, file FileInfo)
+
+	mu    sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks the name of one client and returns the function that
+// unlocks it.
+func (v *versioned) lock(clientID, name string) func() {
+	name = clientID + "\x00" + name
+	v.mu.Lock()
+	l, ok := v.locks[name]
+	if !ok {
+		l = &nameLock{}
+		v.locks[name] = l
+	}
+	l.waiters++
+	v.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		v.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(v.locks, name)
+		}
+		v.mu.Unlock()
+	}
+}
+
+func (v *versioned) Put(ctx context.Context, name string, meta Metadata, r io.Reader) (FileInfo, error) {
+	defer v.lock(meta.ClientID, name)()
+
+	if v.policy.RejectDuplicates {
+		existing, err := v.BlobStore.List(ctx, revisionsOf(meta.ClientID, name))
+		if err != nil {
+			return FileInfo{}, err
+		}
+		if len(existing) > 0 {
+			return FileInfo{}, ErrDuplicate
+		}
+	}
+
+	info, err := v.BlobStore.Put(ctx, name, meta, r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	v.prune(ctx, meta.ClientID, name, info.ID)
+	return info, nil
+}
+
+// Rename applies the policy to the new name as if the file had just been
+// stored under it.
+func (v *versioned) Rename(ctx context.Context, id, name string) error {
+	file, err := v.BlobStore.Stat(ctx, id)
+	if err != nil {
+		return err
+	}
+	clientID := file.Metadata.ClientID
+	defer v.lock(clientID, name)()
+
+	if v.policy.RejectDuplicates {
+		existing, err := v.BlobStore.List(ctx, revisionsOf(clientID, name))
+		if err != nil {
+			return err
+		}
+		for _, file := range existing {
+			if file.ID != id {
+				return ErrDuplicate
+			}
+		}
+	}
+	if err := v.BlobStore.Rename(ctx, id, name); err != nil {
+		return err
+	}
+	v.prune(ctx, clientID, name, id)
+	return nil
+}
+
+// prune deletes the revisions of name by clientID beyond KeepLast, never
+// keep. Pruning is best effort: revisions left behind by a failure go with
+// the next change to the name.
+func (v *versioned) prune(ctx context.Context, clientID, name, keep string) {
+	if v.policy.KeepLast <= 0 {
+		return
+	}
+	revisions, err := v.BlobStore.List(ctx, revisionsOf(clientID, name))
+	if err != nil {
+		slog.Warn("listing revisions to prune", "file", name, "clientID", clientID, "err", err)
+		return
+	}
+	for _, old := range revisions[min(v.policy.KeepLast, len(revisions)):] {
+		if old.ID == keep {
+			continue
+		}
+		err := v.BlobStore.Delete(ctx, old.ID)
+		switch {
+		case err == nil && v.pruned != nil:
+			v.pruned(ctx, old)
+		case err != nil && !errors.Is(err, ErrNotFound):
+			slog.Warn("pruning revision", "file", name, "id", old.ID, "err", err)
+		}
+	}
+}
+
+// revisionsOf selects the revisions of name stored by clientID, newest
+// first.
+func revisionsOf(clientID, name string) Query {
+	return Query{Name: name, ClientIDs: []string{clientID}}
+}
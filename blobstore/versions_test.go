@@ -0,0 +1,91 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVersionPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("keep last N deletes older revisions", func(t *testing.T) {
+		store := WithVersionPolicy(NewMemory(), VersionPolicy{KeepLast: 2})
+		store.Put(ctx, "a.png", Metadata{}, strings.NewReader("1"))
+		second, _ := store.Put(ctx, "a.png", Metadata{}, strings.NewReader("2"))
+		third, _ := store.Put(ctx, "a.png", Metadata{}, strings.NewReader("3"))
+		store.Put(ctx, "b.png", Metadata{}, strings.NewReader("other"))
+
+		files, err := store.List(ctx, Query{Name: "a.png"})
+		assertNoError(t, err)
+		if len(files) != 2 || files[0].ID != third.ID || files[1].ID != second.ID {
+			t.Errorf("got %+v want revisions %s and %s", files, third.ID, second.ID)
+		}
+	})
+	t.Run("pruned revisions are reported", func(t *testing.T) {
+		store := WithVersionPolicy(NewMemory(), VersionPolicy{KeepLast: 1})
+		var pruned []FileInfo
+		OnPrune(store, func(ctx context.Context, file FileInfo) { pruned = append(pruned, file) })
+		first, _ := store.Put(ctx, "a.png", Metadata{}, strings.NewReader("1"))
+		store.Put(ctx, "a.png", Metadata{}, strings.NewReader("2"))
+
+		if len(pruned) != 1 || pruned[0].ID != first.ID {
+			t.Errorf("got pruned %+v want %s", pruned, first.ID)
+		}
+	})
+	t.Run("each client keeps its own revisions", func(t *testing.T) {
+		store := WithVersionPolicy(NewMemory(), VersionPolicy{KeepLast: 1})
+		first, _ := store.Put(ctx, "a.png", Metadata{ClientID: "cam-1"}, strings.NewReader("1"))
+		store.Put(ctx, "a.png", Metadata{ClientID: "cam-2"}, strings.NewReader("2"))
+		b, _ := store.Put(ctx, "b.png", Metadata{ClientID: "cam-2"}, strings.NewReader("3"))
+		assertNoError(t, store.Rename(ctx, b.ID, "a.png"))
+
+		files, err := store.List(ctx, Query{Name: "a.png"})
+		assertNoError(t, err)
+		if len(files) != 2 || files[0].ID != b.ID || files[1].ID != first.ID {
+			t.Errorf("got %+v want revisions %s and %s", files, b.ID, first.ID)
+		}
+	})
+	t.Run("reject refuses a stored name", func(t *testing.T) {
+		store := WithVersionPolicy(NewMemory(), VersionPolicy{RejectDuplicates: true})
+		_, err := store.Put(ctx, "a.png", Metadata{}, strings.NewReader("1"))
+		assertNoError(t, err)
+
+		_, err = store.Put(ctx, "a.png", Metadata{}, strings.NewReader("2"))
+		if !errors.Is(err, ErrDuplicate) {
+			t.Errorf("got %v want %v", err, ErrDuplicate)
+		}
+		files, _ := store.List(ctx, Query{})
+		if len(files) != 1 {
+			t.Errorf("got %d files want 1", len(files))
+		}
+		_, err = store.Put(ctx, "a.png", Metadata{ClientID: "cam-2"}, strings.NewReader("3"))
+		assertNoError(t, err)
+	})
+	t.Run("reject refuses a rename onto a stored name", func(t *testing.T) {
+		store := WithVersionPolicy(NewMemory(), VersionPolicy{RejectDuplicates: true})
+		store.Put(ctx, "a.png", Metadata{}, strings.NewReader("1"))
+		b, _ := store.Put(ctx, "b.png", Metadata{}, strings.NewReader("2"))
+
+		if err := store.Rename(ctx, b.ID, "a.png"); !errors.Is(err, ErrDuplicate) {
+			t.Errorf("got %v want %v", err, ErrDuplicate)
+		}
+		assertNoError(t, store.Rename(ctx, b.ID, "c.png"))
+	})
+	t.Run("flag values round trip", func(t *testing.T) {
+		for _, s := range []string{"all", "last:3", "reject"} {
+			var p VersionPolicy
+			assertNoError(t, p.Set(s))
+			if p.String() != s {
+				t.Errorf("Set(%q).String() = %q", s, p.String())
+			}
+		}
+		for _, s := range []string{"", "last:0", "last:x", "some"} {
+			var p VersionPolicy
+			if p.Set(s) == nil {
+				t.Errorf("Set(%q) succeeded", s)
+			}
+		}
+	})
+}
@@ -1,50 +1,87 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"net"
 	"os"
+	"path/filepath"
+
+	"example.com/hello/config"
+	"example.com/hello/lucky2/protocol"
 )
 
 func main() {
+	useTLS := flag.Bool("tls", false, "connect to the server over TLS")
+	caFile := flag.String("ca", "", "CA bundle used to verify the server (PEM)")
+	certFile := flag.String("cert", "", "client certificate for mutual TLS (PEM)")
+	keyFile := flag.String("key", "", "client private key for mutual TLS (PEM)")
+	serverAddress := flag.String("server", "10.10.13.19:55000", "address of the ingest server")
+	fileName := flag.String("file", "frame9.png", "file to send")
+	clientID := flag.String("client-id", "", "client ID sent with the file; defaults to the hostname")
+	settings := config.New(flag.CommandLine, "CLIENT")
+	settings.Check(func() error {
+		if (*certFile == "") != (*keyFile == "") {
+			return errors.New("-cert and -key must be given together")
+		}
+		return nil
+	})
+	settings.MustParse(os.Args[1:])
+
+	var tlsConfig *tls.Config
+	if *useTLS {
+		var err error
+		tlsConfig, err = protocol.ClientTLSConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fmt.Println("Error loading TLS configuration:", err)
+			return
+		}
+	}
+
 	// Connect to the server
-	serverAddress := "10.10.13.19:55000"
-	conn, err := net.Dial("tcp", serverAddress)
+	conn, err := protocol.Dial(*serverAddress, tlsConfig)
 	if err != nil {
 		fmt.Println("Error connecting to server:", err)
 		return
 	}
+	defer conn.Close()
 
-	// Provide the file to send
-
-	filePath, err := os.Getwd()
+	// Step 1: Open the file
+	file, err := os.Open(*fileName)
 	if err != nil {
-		fmt.Println(err) //print the error if obtained
+		fmt.Println("Error opening file:", err)
+		return
 	}
+	defer file.Close()
 
-	// Step 1: Send filename first
-	fileName := "frame9.png" // Change to the file's name you want to send
-	_, err = conn.Write([]byte(fileName))
+	info, err := file.Stat()
 	if err != nil {
-		fmt.Println("Error sending filename:", err)
+		fmt.Println("Error reading file size:", err)
 		return
 	}
 
-	// Step 2: Open the file
-	file, err := os.Open(filePath + "/" + fileName)
+	checksum, err := protocol.Digest(file)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
+		fmt.Println("Error hashing file:", err)
 		return
 	}
-	defer file.Close()
 
-	// Step 3: Send the file data
-	_, err = io.Copy(conn, file)
+	if *clientID == "" {
+		*clientID, err = os.Hostname()
+		if err != nil {
+			fmt.Println("Error getting hostname:", err)
+			return
+		}
+	}
+
+	// Step 2: Send the header and the file data, then wait for the ack
+	header := protocol.Header{Filename: filepath.Base(*fileName), ClientID: *clientID, Checksum: checksum}
+	ack, err := protocol.Upload(conn, header, file, info.Size())
 	if err != nil {
-		fmt.Println("Error sending file data:", err)
+		fmt.Println("Error sending file:", err)
 		return
 	}
 
-	fmt.Println("File sent successfully!")
+	fmt.Println("File sent successfully! ID:", ack.FileID)
 }
@@ -0,0 +1,160 @@
+// Package config loads the settings of the binaries in this module.
+//
+// Every setting is a command line flag. A YAML or TOML file and
+// environment variables can set the same flags, so a deployment can be
+// configured without recompiling. A flag given on the command line wins
+// over the environment, the environment over the file, and the file over
+// the flag's default.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Loader fills the flags of a FlagSet from the command line, the
+// environment and a config file.
+type Loader struct {
+	fs      *flag.FlagSet
+	prefix  string
+	file    string
+	print   bool
+	checks  []func() error
+	secrets map[string]bool
+}
+
+// New registers the -config and -print-config flags on fs. Environment
+// variables are named after the flags with prefix: with prefix "LUCKY2",
+// -mongo-uri is read from LUCKY2_MONGO_URI, and the config file from
+// LUCKY2_CONFIG.
+func New(fs *flag.FlagSet, prefix string) *Loader {
+	l := &Loader{fs: fs, prefix: prefix}
+	fs.StringVar(&l.file, "config", "", "YAML (.yaml, .yml) or TOML (.toml) file with flag values, keyed by flag name; env "+l.EnvName("config"))
+	fs.BoolVar(&l.print, "print-config", false, "print the effective configuration and exit")
+	return l
+}
+
+// EnvName returns the environment variable that sets the flag name.
+func (l *Loader) EnvName(name string) string {
+	return l.prefix + "_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Check adds a validation run once all values are set.
+func (l *Loader) Check(check func() error) {
+	l.checks = append(l.checks, check)
+}
+
+// Secret marks the flag name as holding a secret, which Write masks.
+func (l *Loader) Secret(name string) {
+	if l.secrets == nil {
+		l.secrets = map[string]bool{}
+	}
+	l.secrets[name] = true
+}
+
+// Parse parses args, then sets every flag not given there from the
+// environment or the config file, and runs the checks.
+func (l *Loader) Parse(args []string) error {
+	if err := l.fs.Parse(args); err != nil {
+		return err
+	}
+	given := map[string]bool{}
+	l.fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	file := l.file
+	if !given["config"] {
+		file = os.Getenv(l.EnvName("config"))
+		l.file = file
+	}
+	values := map[string]string{}
+	if file != "" {
+		var err error
+		if values, err = ReadFile(file); err != nil {
+			return err
+		}
+	}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if name == "config" || name == "print-config" || l.fs.Lookup(name) == nil {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", file, name))
+		}
+	}
+
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		source := "$" + l.EnvName(f.Name)
+		value, ok := os.LookupEnv(l.EnvName(f.Name))
+		if !ok {
+			source = file
+			value, ok = values[f.Name]
+		}
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q for %s: %v", source, value, f.Name, err))
+		}
+	})
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, check := range l.checks {
+		if err := check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MustParse is Parse for main: on an error it prints it and exits with
+// status 2, and with -print-config it prints the configuration and exits.
+func (l *Loader) MustParse(args []string) {
+	if err := l.Parse(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(l.fs.Output(), err)
+		}
+		os.Exit(2)
+	}
+	if l.print {
+		l.Write(os.Stdout)
+		os.Exit(0)
+	}
+}
+
+// Write prints the value of every flag as YAML, which -config reads back.
+// Passwords in URLs and the values of secret flags are masked.
+func (l *Loader) Write(w io.Writer) {
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		value := redact(f.Value.String())
+		if l.secrets[f.Name] && value != "" {
+			value = "xxxxx"
+		}
+		fmt.Fprintf(w, "%s: %s\n", f.Name, strconv.Quote(value))
+	})
+}
+
+// redact masks the password of a URL with credentials.
+func redact(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+	return u.Redacted()
+}
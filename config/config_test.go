@@ -0,0 +1,180 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type settings struct {
+	addr    string
+	timeout time.Duration
+	quota   int64
+	clients string
+	tlsCert string
+	mongo   string
+}
+
+func newLoader(t *testing.T) (*Loader, *settings) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	s := &settings{}
+	fs.StringVar(&s.addr, "http-addr", ":5000", "")
+	fs.DurationVar(&s.timeout, "shutdown-timeout", 30*time.Second, "")
+	fs.Int64Var(&s.quota, "quota-bytes", 0, "")
+	fs.StringVar(&s.clients, "clients", "", "")
+	fs.StringVar(&s.tlsCert, "tls-cert", "", "")
+	fs.StringVar(&s.mongo, "mongo-uri", "mongodb://localhost:27017", "")
+	return New(fs, "TEST"), s
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	yamlFile := `
+http-addr: ":8080"
+shutdown-timeout: 1m
+quota-bytes: 1000000
+clients: [cam-1, cam-2]
+tls:
+  cert: server.pem
+`
+	tomlFile := `
+http-addr = ":8080"
+shutdown-timeout = "1m"
+quota-bytes = 1000000
+clients = ["cam-1", "cam-2"]
+
+[tls]
+cert = "server.pem"
+`
+	for _, tt := range []struct{ name, content string }{
+		{"settings.yaml", yamlFile},
+		{"settings.toml", tomlFile},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, s := newLoader(t)
+
+			err := l.Parse([]string{"-config", writeFile(t, tt.name, tt.content)})
+
+			assertNoError(t, err)
+			want := settings{":8080", time.Minute, 1000000, "cam-1,cam-2", "server.pem", "mongodb://localhost:27017"}
+			if *s != want {
+				t.Errorf("got %+v want %+v", *s, want)
+			}
+		})
+	}
+
+	t.Run("flags win over the environment, which wins over the file", func(t *testing.T) {
+		l, s := newLoader(t)
+		t.Setenv("TEST_CONFIG", writeFile(t, "settings.yml", "http-addr: ':8080'\nquota-bytes: 5\nclients: cam-1\n"))
+		t.Setenv("TEST_HTTP_ADDR", ":9090")
+		t.Setenv("TEST_QUOTA_BYTES", "7")
+
+		err := l.Parse([]string{"-quota-bytes", "9"})
+
+		assertNoError(t, err)
+		if s.addr != ":9090" || s.quota != 9 || s.clients != "cam-1" {
+			t.Errorf("got %+v", *s)
+		}
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		l, _ := newLoader(t)
+		t.Setenv("TEST_SHUTDOWN_TIMEOUT", "soon")
+
+		err := l.Parse([]string{"-config", writeFile(t, "settings.yaml", "quota-bytes: lots\nhttp-port: 80\n")})
+
+		for _, want := range []string{`unknown setting "http-port"`, "$TEST_SHUTDOWN_TIMEOUT", `invalid value "lots" for quota-bytes`} {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %v, want it to mention %s", err, want)
+			}
+		}
+	})
+
+	t.Run("checks", func(t *testing.T) {
+		l, s := newLoader(t)
+		l.Check(func() error {
+			if s.quota < 0 {
+				return errors.New("quota must not be negative")
+			}
+			return nil
+		})
+
+		err := l.Parse([]string{"-quota-bytes", "-1"})
+
+		if err == nil || err.Error() != "quota must not be negative" {
+			t.Errorf("got error %v", err)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		l, _ := newLoader(t)
+
+		err := l.Parse([]string{"-config", writeFile(t, "settings.ini", "quota-bytes = 1\n")})
+
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestWrite(t *testing.T) {
+	l, _ := newLoader(t)
+	assertNoError(t, l.Parse([]string{"-mongo-uri", "mongodb://lucky:hunter2@db:27017", "-clients", "cam-1"}))
+	var out strings.Builder
+
+	l.Write(&out)
+
+	want := `clients: "cam-1"
+http-addr: ":5000"
+mongo-uri: "mongodb://lucky:xxxxx@db:27017"
+quota-bytes: "0"
+shutdown-timeout: "30s"
+tls-cert: ""
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		l, s := newLoader(t)
+		assertNoError(t, l.Parse([]string{"-config", writeFile(t, "effective.yaml", strings.Replace(want, "xxxxx", "hunter2", 1))}))
+		if s.clients != "cam-1" || s.timeout != 30*time.Second || s.mongo != "mongodb://lucky:hunter2@db:27017" {
+			t.Errorf("got %+v", *s)
+		}
+	})
+	t.Run("secrets are masked", func(t *testing.T) {
+		l, _ := newLoader(t)
+		l.fs.String("webhook-secret", "", "")
+		l.Secret("webhook-secret")
+		assertNoError(t, l.Parse([]string{"-webhook-secret", "hunter2"}))
+		var out strings.Builder
+
+		l.Write(&out)
+
+		if !strings.Contains(out.String(), `webhook-secret: "xxxxx"`) || strings.Contains(out.String(), "hunter2") {
+			t.Errorf("secret not masked in\n%s", out.String())
+		}
+	})
+}
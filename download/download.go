@@ -2,45 +2,45 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/gridfs"
-
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"example.com/hello/blobstore"
+	"example.com/hello/config"
 )
 
-const mongoURI = "mongodb://localhost:27017"
-const databaseName = "fileStore"
-
 func main() {
-	// Connect to MongoDB
-	clientOptions := options.Client().ApplyURI(mongoURI)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	name := flag.String("name", "2025-03-05_09:11:513.pdf", "name of the file to download")
+	output := flag.String("output", "downloaded_image.pdf", "where to save the file")
+	var storeConfig blobstore.Config
+	storeConfig.RegisterFlags(flag.CommandLine)
+	settings := config.New(flag.CommandLine, "DOWNLOAD")
+	settings.Check(func() error { return storeConfig.Validate() })
+	settings.MustParse(os.Args[1:])
+
+	// Open the file store
+	store, err := blobstore.Open(context.TODO(), storeConfig)
 	if err != nil {
-		fmt.Println("Error connecting to MongoDB:", err)
+		fmt.Println("Error opening file store:", err)
 		return
 	}
+	defer store.Close()
 
-	// Check connection
-	err = client.Ping(context.TODO(), nil)
+	// Find the newest revision of the file
+	files, err := store.List(context.TODO(), blobstore.Query{Name: *name})
 	if err != nil {
-		fmt.Println("Could not ping MongoDB:", err)
+		fmt.Println("Error finding file:", err)
 		return
 	}
-	fmt.Println("Connected to MongoDB!")
-
-	// Initialize GridFS
-	gridFSBucket, err := gridfs.NewBucket(client.Database(databaseName))
-	if err != nil {
-		fmt.Println("Error creating GridFS bucket:", err)
+	if len(files) == 0 {
+		fmt.Println("File not found")
 		return
 	}
 
 	// Open the download stream
-	downloadStream, err := gridFSBucket.OpenDownloadStreamByName("2025-03-05_09:11:513.pdf")
+	downloadStream, _, err := store.Get(context.TODO(), files[0].ID)
 	if err != nil {
 		fmt.Println("Error opening download stream:", err)
 		return
@@ -48,7 +48,7 @@ func main() {
 	defer downloadStream.Close()
 
 	// Create a file to save the downloaded data
-	outputFile, err := os.Create("downloaded_image.pdf")
+	outputFile, err := os.Create(*output)
 	if err != nil {
 		fmt.Println("Error creating output file:", err)
 		return
@@ -62,5 +62,5 @@ func main() {
 		return
 	}
 
-	fmt.Println("Image downloaded successfully as downloaded_image.png")
+	fmt.Println("Image downloaded successfully as", *output)
 }
@@ -2,15 +2,14 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"strings"
 
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/gridfs"
-
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"example.com/hello/blobstore"
+	"example.com/hello/config"
 )
 
 // getLocalIP retrieves the local IP address of the machine.
@@ -31,50 +30,42 @@ func getLocalIP() (string, error) {
 	return "", fmt.Errorf("no IPv4 address found")
 }
 
-// DB connection settings
-const mongoURI = "mongodb://localhost:27017"
-const databaseName = "fileStore"
-
 func main() {
-	port := ":55000"
-
-	localIP, err := getLocalIP()
-	if err != nil {
-		fmt.Println("Error getting local IP:", err)
-		return
+	// File store settings
+	addr := flag.String("addr", ":55000", "address to listen on; without a host it listens on the machine's first IPv4 address")
+	filename := flag.String("name", "received_frame1.png", "name every received file is stored under")
+	var storeConfig blobstore.Config
+	storeConfig.RegisterFlags(flag.CommandLine)
+	settings := config.New(flag.CommandLine, "LUCKY")
+	settings.Check(func() error { return storeConfig.Validate() })
+	settings.MustParse(os.Args[1:])
+
+	listenAddr := *addr
+	if strings.HasPrefix(listenAddr, ":") {
+		localIP, err := getLocalIP()
+		if err != nil {
+			fmt.Println("Error getting local IP:", err)
+			return
+		}
+		listenAddr = localIP + listenAddr
 	}
 
-	listener, err := net.Listen("tcp", localIP+port)
+	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		fmt.Println("Error starting server:", err)
 		return
 	}
 	defer listener.Close()
 
-	fmt.Println("Server listening on port", port)
+	fmt.Println("Server listening on", listener.Addr())
 
-	// Connect to MongoDB
-	clientOptions := options.Client().ApplyURI(mongoURI)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	// Open the file store
+	store, err := blobstore.Open(context.TODO(), storeConfig)
 	if err != nil {
-		fmt.Println("Error connecting to MongoDB:", err)
-		return
-	}
-
-	// Check ping
-	err = client.Ping(context.TODO(), nil)
-	if err != nil {
-		fmt.Println("Could not ping MongoDB:", err)
-		return
-	}
-	fmt.Println("Connected to MongoDB!")
-
-	// Initialize GridFS
-	gridFSBucket, err := gridfs.NewBucket(client.Database(databaseName))
-	if err != nil {
-		fmt.Println("Error creating GridFS bucket:", err)
+		fmt.Println("Error opening file store:", err)
 		return
 	}
+	defer store.Close()
 
 	for {
 		conn, err := listener.Accept()
@@ -85,23 +76,15 @@ func main() {
 
 		fmt.Println("Got connection from", conn.RemoteAddr())
 
-		// Upload file to MongoDB using GridFS
+		// Upload file to the store
 		fmt.Println("Receiving data...")
-		uploadStream, err := gridFSBucket.OpenUploadStream("received_frame1.png")
-		if err != nil {
-			fmt.Println("Error opening upload stream:", err)
-			conn.Close()
-			continue
-		}
-
-		_, err = io.Copy(uploadStream, conn)
+		_, err = store.Put(context.TODO(), *filename, blobstore.Metadata{}, conn)
 		if err != nil {
 			fmt.Println("Error uploading data:", err)
 		} else {
 			fmt.Println("Data received and uploaded successfully")
 		}
 
-		uploadStream.Close()
 		conn.Close()
 	}
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"example.com/hello/blobstore"
+)
+
+// apiFile is how the API describes a stored file.
+type apiFile struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	UploadDate  time.Time `json:"uploadDate"`
+	ClientID    string    `json:"clientID"`
+	ContentType string    `json:"contentType,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Uploader    string    `json:"uploader,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Description string    `json:"description,omitempty"`
+}
+
+func newAPIFile(info blobstore.FileInfo) apiFile {
+	return apiFile{
+		ID:          info.ID,
+		Name:        info.Name,
+		Size:        info.Size,
+		UploadDate:  info.UploadDate,
+		ClientID:    info.Metadata.ClientID,
+		ContentType: info.Metadata.ContentType,
+		SHA256:      info.Metadata.SHA256,
+		Uploader:    info.Metadata.Uploader,
+		Tags:        info.Metadata.Tags,
+		Description: info.Metadata.Description,
+	}
+}
+
+func newAPIFiles(files []blobstore.FileInfo) []apiFile {
+	out := make([]apiFile, 0, len(files))
+	for _, file := range files {
+		out = append(out, newAPIFile(file))
+	}
+	return out
+}
+
+// apiRoutes registers /api/v1 on mux. Tokens are issued with the portal
+// password over HTTP basic auth; everything else takes a bearer token.
+func (a *app) apiRoutes(mux *http.ServeMux) {
+	bearer := func(h http.HandlerFunc) http.Handler { return a.auth.tokenMiddleware(h) }
+	mux.HandleFunc("POST /api/v1/tokens", a.auth.createTokenHandler)
+	mux.Handle("DELETE /api/v1/tokens/current", bearer(a.auth.revokeTokenHandler))
+	mux.Handle("GET /api/v1/files", bearer(a.apiListHandler))
+	mux.Handle("POST /api/v1/files", bearer(a.apiUploadHandler))
+	mux.Handle("GET /api/v1/files/{id}", bearer(a.apiFileHandler))
+	mux.Handle("DELETE /api/v1/files/{id}", bearer(a.apiDeleteHandler))
+	mux.Handle("GET /api/v1/files/{id}/content", bearer(a.apiDownloadHandler))
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, "Not found", http.StatusNotFound)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiError is the httpErrorFunc of the API.
+func apiError(w http.ResponseWriter, message string, code int) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// createTokenHandler issues an API token to the user named in the basic
+// auth credentials. The token is only ever shown in this response.
+func (a *authService) createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="lucky2"`)
+		apiError(w, "Basic auth required", http.StatusUnauthorized)
+		return
+	}
+	u, err := authenticate(r.Context(), a.users, username, password)
+	if errors.Is(err, errInvalidCredentials) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="lucky2"`)
+		apiError(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		reportStoreError(w, err, apiError)
+		return
+	}
+
+	var request struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+			apiError(w, "Malformed JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+	token, record, err := newAPIToken(u.Username, request.Name)
+	if err != nil {
+		apiError(w, "Error creating token", http.StatusInternalServerError)
+		return
+	}
+	if err := a.tokens.PutToken(r.Context(), record); err != nil {
+		reportStoreError(w, err, apiError)
+		return
+	}
+	slog.Info("API token issued", "name", record.Name, "user", u.Username)
+	writeJSON(w, http.StatusCreated, map[string]any{"token": token, "name": record.Name, "created": record.Created})
+}
+
+// revokeTokenHandler revokes the token the request was made with.
+func (a *authService) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, _ := bearerToken(r.Header.Get("Authorization"))
+	if err := a.tokens.DeleteToken(r.Context(), hashToken(token)); err != nil && !errors.Is(err, errTokenNotFound) {
+		reportStoreError(w, err, apiError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tokenMiddleware authenticates API requests by bearer token.
+func (a *authService) tokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unauthorized := func() {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lucky2"`)
+			apiError(w, "Valid bearer token required", http.StatusUnauthorized)
+		}
+		token, ok := bearerToken(r.Header.Get("Authorization"))
+		if !ok {
+			unauthorized()
+			return
+		}
+		record, err := a.tokens.GetToken(r.Context(), hashToken(token))
+		if errors.Is(err, errTokenNotFound) {
+			unauthorized()
+			return
+		}
+		if err != nil {
+			reportStoreError(w, err, apiError)
+			return
+		}
+		// As with sessions, the account is loaded on every request so
+		// permission changes apply at once.
+		u, err := a.users.GetUser(r.Context(), record.Username)
+		if errors.Is(err, errUserNotFound) {
+			unauthorized()
+			return
+		}
+		if err != nil {
+			reportStoreError(w, err, apiError)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey{}, u)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiListHandler lists the files the user may see a page at a time,
+// filtered and sorted as parseListing describes, along with the subfolders
+// of the folder listed.
+func (a *app) apiListHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := parseListing(r.URL.Query())
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u := currentUser(r.Context())
+	files, usage, err := a.list(r.Context(), u, l)
+	if err != nil {
+		reportStoreError(w, err, apiError)
+		return
+	}
+	folders, err := a.folders(r.Context(), u, l)
+	if err != nil {
+		reportStoreError(w, err, apiError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"files":       newAPIFiles(files),
+		"folders":     folders,
+		"page":        l.Page,
+		"perPage":     l.PerPage,
+		"total":       usage.Files,
+		"bytes":       usage.Bytes,
+		"storedBytes": usage.StoredBytes,
+	})
+}
+
+func (a *app) apiFileHandler(w http.ResponseWriter, r *http.Request) {
+	file, err := a.visibleFile(r.Context(), currentUser(r.Context()), r.PathValue("id"))
+	if err != nil {
+		reportStoreError(w, err, apiError)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIFile(file))
+}
+
+func (a *app) apiDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	stream, file, err := a.openVisibleFile(r.Context(), currentUser(r.Context()), r.PathValue("id"))
+	if err != nil {
+		reportStoreError(w, err, apiError)
+		return
+	}
+	defer stream.Close()
+	serveStream(w, r, stream, file, false)
+}
+
+// apiUploadHandler takes the same multipart form as /upload, without the
+// CSRF token.
+func (a *app) apiUploadHandler(w http.ResponseWriter, r *http.Request) {
+	stored, ok := a.receiveUpload(w, r, false, apiError)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"files": newAPIFiles(stored)})
+}
+
+func (a *app) apiDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	file, err := a.visibleFile(r.Context(), currentUser(r.Context()), r.PathValue("id"))
+	if err != nil {
+		reportStoreError(w, err, apiError)
+		return
+	}
+	if err := a.files.Delete(r.Context(), file.ID); err != nil {
+		reportStoreError(w, err, apiError)
+		return
+	}
+	a.audit(r.Context(), "delete", file, "via API")
+	a.events.publish(event{Type: eventFileDeleted, File: file})
+	w.WriteHeader(http.StatusNoContent)
+}
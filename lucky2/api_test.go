@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/hello/blobstore"
+)
+
+// newAPITestApp returns an app with alice (password "secret", client
+// cam-1) and an API token for her.
+func newAPITestApp(t testing.TB, files blobstore.BlobStore) (*app, string) {
+	t.Helper()
+	alice, err := newUser("alice", "secret")
+	assertNoError(t, err)
+	alice.ClientIDs = []string{"cam-1"}
+	users := newInMemoryUserStore()
+	users.PutUser(context.Background(), alice)
+	a := newApp(nil, files, users, newInMemoryTokenStore(), newInMemoryAuditLog())
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/tokens", strings.NewReader(`{"name": "backup script"}`))
+	request.SetBasicAuth("alice", "secret")
+	response := httptest.NewRecorder()
+	a.routes().ServeHTTP(response, request)
+	assertStatus(t, response.Code, http.StatusCreated)
+	var created struct {
+		Token string `json:"token"`
+	}
+	assertNoError(t, json.NewDecoder(response.Body).Decode(&created))
+	return a, created.Token
+}
+
+func apiRequest(a *app, token, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, body)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response := httptest.NewRecorder()
+	a.routes().ServeHTTP(response, request)
+	return response
+}
+
+func TestAPITokens(t *testing.T) {
+	a, token := newAPITestApp(t, blobstore.NewMemory())
+
+	t.Run("issued tokens carry the prefix", func(t *testing.T) {
+		if !strings.HasPrefix(token, apiTokenPrefix) {
+			t.Errorf("got token %q", token)
+		}
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/tokens", nil)
+		request.SetBasicAuth("alice", "guess")
+		response := httptest.NewRecorder()
+		a.routes().ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+	})
+	t.Run("missing or unknown token", func(t *testing.T) {
+		for _, token := range []string{"", "lk2_unknown"} {
+			response := apiRequest(a, token, http.MethodGet, "/api/v1/files", nil)
+			assertStatus(t, response.Code, http.StatusUnauthorized)
+		}
+	})
+	t.Run("session cookies are not accepted", func(t *testing.T) {
+		id, _, _ := a.auth.sessions.create("alice")
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/files", nil)
+		request.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+		response := httptest.NewRecorder()
+		a.routes().ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+	})
+	t.Run("revoked token stops working", func(t *testing.T) {
+		response := apiRequest(a, token, http.MethodDelete, "/api/v1/tokens/current", nil)
+		assertStatus(t, response.Code, http.StatusNoContent)
+
+		response = apiRequest(a, token, http.MethodGet, "/api/v1/files", nil)
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+	})
+}
+
+func TestAPIFiles(t *testing.T) {
+	store := blobstore.NewMemory()
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		putFile(t, store, name, "cam-1", name+" bytes")
+	}
+	secret := putFile(t, store, "secret.pdf", "cam-2", "pdf bytes")
+	a, token := newAPITestApp(t, store)
+
+	t.Run("list is paged and filtered", func(t *testing.T) {
+		response := apiRequest(a, token, http.MethodGet, "/api/v1/files?page=2&per_page=2", nil)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		var page struct {
+			Files   []apiFile `json:"files"`
+			Page    int       `json:"page"`
+			PerPage int       `json:"perPage"`
+			Total   int       `json:"total"`
+		}
+		assertNoError(t, json.NewDecoder(response.Body).Decode(&page))
+		if page.Total != 3 || page.Page != 2 || page.PerPage != 2 || len(page.Files) != 1 {
+			t.Fatalf("got page %+v", page)
+		}
+		if f := page.Files[0]; f.Name != "a.png" || f.ClientID != "cam-1" || f.SHA256 == "" || f.Size != 11 {
+			t.Errorf("got file %+v", f)
+		}
+	})
+	t.Run("bad paging", func(t *testing.T) {
+		response := apiRequest(a, token, http.MethodGet, "/api/v1/files?page=0", nil)
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+	t.Run("metadata and content by ID", func(t *testing.T) {
+		files, _ := store.List(context.Background(), blobstore.Query{Name: "b.png"})
+		id := files[0].ID
+
+		response := apiRequest(a, token, http.MethodGet, "/api/v1/files/"+id, nil)
+		assertStatus(t, response.Code, http.StatusOK)
+		var file apiFile
+		assertNoError(t, json.NewDecoder(response.Body).Decode(&file))
+		if file.ID != id || file.Name != "b.png" {
+			t.Errorf("got %+v", file)
+		}
+
+		response = apiRequest(a, token, http.MethodGet, "/api/v1/files/"+id+"/content", nil)
+		assertStatus(t, response.Code, http.StatusOK)
+		if response.Body.String() != "b.png bytes" {
+			t.Errorf("got body %q", response.Body.String())
+		}
+	})
+	t.Run("another client's file is not found", func(t *testing.T) {
+		for _, target := range []string{"/api/v1/files/" + secret.ID, "/api/v1/files/" + secret.ID + "/content"} {
+			response := apiRequest(a, token, http.MethodGet, target, nil)
+			assertStatus(t, response.Code, http.StatusNotFound)
+			if !strings.Contains(response.Body.String(), `"error"`) {
+				t.Errorf("got body %q want a JSON error", response.Body.String())
+			}
+		}
+		response := apiRequest(a, token, http.MethodDelete, "/api/v1/files/"+secret.ID, nil)
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+	t.Run("upload then delete", func(t *testing.T) {
+		body, contentType := uploadForm(t, nil, map[string]string{"d.txt": "d bytes"})
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/files", body)
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set("Content-Type", contentType)
+		response := httptest.NewRecorder()
+		a.routes().ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+		var created struct {
+			Files []apiFile `json:"files"`
+		}
+		assertNoError(t, json.NewDecoder(response.Body).Decode(&created))
+		if len(created.Files) != 1 || created.Files[0].Uploader != "alice" {
+			t.Fatalf("got %+v", created)
+		}
+
+		response = apiRequest(a, token, http.MethodDelete, "/api/v1/files/"+created.Files[0].ID, nil)
+		assertStatus(t, response.Code, http.StatusNoContent)
+		if _, err := store.Stat(context.Background(), created.Files[0].ID); err == nil {
+			t.Error("file still stored after delete")
+		}
+	})
+	t.Run("unknown endpoint", func(t *testing.T) {
+		response := apiRequest(a, token, http.MethodGet, "/api/v2/files", nil)
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+}
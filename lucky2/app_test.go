@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+)
+
+// unavailableStore fails every call the way an unreachable MongoDB does.
+type unavailableStore struct {
+	blobstore.BlobStore
+}
+
+func (unavailableStore) List(ctx context.Context, q blobstore.Query) ([]blobstore.FileInfo, error) {
+	return nil, blobstore.ErrUnavailable
+}
+
+func (unavailableStore) Count(ctx context.Context, q blobstore.Query) (int, error) {
+	return 0, blobstore.ErrUnavailable
+}
+
+func (unavailableStore) Usage(ctx context.Context, q blobstore.Query) (blobstore.Usage, error) {
+	return blobstore.Usage{}, blobstore.ErrUnavailable
+}
+
+// newTestApp returns an app backed by files and a logged-in session cookie
+// for u.
+func newTestApp(t testing.TB, files blobstore.BlobStore, u user) (*app, *http.Cookie) {
+	t.Helper()
+	users := newInMemoryUserStore()
+	users.PutUser(context.Background(), u)
+	a := newApp(nil, files, users, newInMemoryTokenStore(), newInMemoryAuditLog())
+	id, _, err := a.auth.sessions.create(u.Username)
+	assertNoError(t, err)
+	return a, &http.Cookie{Name: sessionCookie, Value: id}
+}
+
+func serve(a *app, cookie *http.Cookie, method, target string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, nil)
+	request.AddCookie(cookie)
+	response := httptest.NewRecorder()
+	a.routes().ServeHTTP(response, request)
+	return response
+}
+
+func putFile(t testing.TB, store blobstore.BlobStore, name, clientID, content string) blobstore.FileInfo {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	meta := blobstore.Metadata{ClientID: clientID, SHA256: hexString(sum[:])}
+	info, err := store.Put(context.Background(), name, meta, strings.NewReader(content))
+	assertNoError(t, err)
+	return info
+}
+
+func TestFilesAndDownload(t *testing.T) {
+	store := blobstore.NewMemory()
+	own := putFile(t, store, "frame9.png", "cam-1", "png bytes")
+	putFile(t, store, "secret.pdf", "cam-2", "pdf bytes")
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+
+	t.Run("lists only the user's files", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files")
+
+		assertStatus(t, response.Code, http.StatusOK)
+		if !strings.Contains(response.Body.String(), "frame9.png") {
+			t.Error("own file missing from listing")
+		}
+		if strings.Contains(response.Body.String(), "secret.pdf") {
+			t.Error("another client's file is listed")
+		}
+	})
+	t.Run("downloads an own file with its digest", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/download?filename=frame9.png")
+
+		assertStatus(t, response.Code, http.StatusOK)
+		if response.Body.String() != "png bytes" {
+			t.Errorf("got body %q want %q", response.Body.String(), "png bytes")
+		}
+		if etag := response.Header().Get("ETag"); etag != `"`+own.Metadata.SHA256+`"` {
+			t.Errorf("got ETag %s", etag)
+		}
+	})
+	t.Run("non-ASCII names survive the download", func(t *testing.T) {
+		putFile(t, store, "отчёт.pdf", "cam-1", "pdf bytes")
+
+		response := serve(a, cookie, http.MethodGet, "/download?filename="+url.QueryEscape("отчёт.pdf"))
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "Content-Disposition", `attachment; filename="_____.pdf"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.pdf`)
+	})
+	t.Run("another client's file is not found", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/download?filename=secret.pdf")
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+	t.Run("unknown file is not found", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/download?filename=nope.png")
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	a, cookie := newTestApp(t, unavailableStore{}, user{Username: "alice", Admin: true})
+
+	for _, target := range []string{"/files", "/download?filename=frame9.png"} {
+		t.Run(target, func(t *testing.T) {
+			response := serve(a, cookie, http.MethodGet, target)
+			assertStatus(t, response.Code, http.StatusServiceUnavailable)
+		})
+	}
+}
+
+func TestIngestThenDownload(t *testing.T) {
+	store := blobstore.NewMemory()
+	ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+
+	uploadOverTCP(t, ingest, "frame9.png", "cam-1", "fresh frame")
+
+	response := serve(a, cookie, http.MethodGet, "/download?filename=frame9.png")
+	assertStatus(t, response.Code, http.StatusOK)
+	if response.Body.String() != "fresh frame" {
+		t.Errorf("got body %q want %q", response.Body.String(), "fresh frame")
+	}
+}
+
+func TestDownloadRanges(t *testing.T) {
+	store := blobstore.NewMemory()
+	info := putFile(t, store, "frame9.png", "cam-1", "0123456789")
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+	etag := `"` + info.Metadata.SHA256 + `"`
+
+	download := func(method string, header http.Header) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/download?filename=frame9.png", nil)
+		request.AddCookie(cookie)
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		response := httptest.NewRecorder()
+		a.routes().ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("single range", func(t *testing.T) {
+		response := download(http.MethodGet, http.Header{"Range": {"bytes=2-5"}})
+
+		assertStatus(t, response.Code, http.StatusPartialContent)
+		if response.Body.String() != "2345" {
+			t.Errorf("got body %q want %q", response.Body.String(), "2345")
+		}
+		if got := response.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+			t.Errorf("got Content-Range %q", got)
+		}
+	})
+	t.Run("multiple ranges", func(t *testing.T) {
+		response := download(http.MethodGet, http.Header{"Range": {"bytes=0-1,8-9"}})
+
+		assertStatus(t, response.Code, http.StatusPartialContent)
+		if !strings.HasPrefix(response.Header().Get("Content-Type"), "multipart/byteranges") {
+			t.Errorf("got Content-Type %q", response.Header().Get("Content-Type"))
+		}
+	})
+	t.Run("unsatisfiable range", func(t *testing.T) {
+		response := download(http.MethodGet, http.Header{"Range": {"bytes=20-30"}})
+
+		assertStatus(t, response.Code, http.StatusRequestedRangeNotSatisfiable)
+	})
+	t.Run("matching If-None-Match", func(t *testing.T) {
+		response := download(http.MethodGet, http.Header{"If-None-Match": {etag}})
+
+		assertStatus(t, response.Code, http.StatusNotModified)
+	})
+	t.Run("stale If-Range sends the whole file", func(t *testing.T) {
+		response := download(http.MethodGet, http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"other"`}})
+
+		assertStatus(t, response.Code, http.StatusOK)
+		if response.Body.String() != "0123456789" {
+			t.Errorf("got body %q", response.Body.String())
+		}
+	})
+	t.Run("If-Modified-Since after upload", func(t *testing.T) {
+		since := info.UploadDate.Add(time.Second).UTC().Format(http.TimeFormat)
+		response := download(http.MethodGet, http.Header{"If-Modified-Since": {since}})
+
+		assertStatus(t, response.Code, http.StatusNotModified)
+	})
+	t.Run("HEAD sends headers only", func(t *testing.T) {
+		response := download(http.MethodHead, nil)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		if response.Body.Len() != 0 {
+			t.Errorf("got body %q", response.Body.String())
+		}
+		if got := response.Header().Get("Content-Length"); got != "10" {
+			t.Errorf("got Content-Length %q want 10", got)
+		}
+	})
+	t.Run("other methods are refused", func(t *testing.T) {
+		response := download(http.MethodPost, nil)
+
+		assertStatus(t, response.Code, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestRevisions(t *testing.T) {
+	store := blobstore.NewMemory()
+	putFile(t, store, "frame9.png", "cam-1", "first")
+	putFile(t, store, "frame9.png", "cam-2", "hidden")
+	putFile(t, store, "frame9.png", "cam-1", "second")
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+
+	for _, tt := range []struct {
+		revision string
+		want     string
+	}{
+		{revision: "", want: "second"},
+		{revision: "-1", want: "second"},
+		{revision: "-2", want: "first"},
+		{revision: "0", want: "first"},
+		{revision: "1", want: "second"},
+	} {
+		t.Run("revision "+tt.revision, func(t *testing.T) {
+			response := serve(a, cookie, http.MethodGet, "/download?filename=frame9.png&revision="+tt.revision)
+
+			assertStatus(t, response.Code, http.StatusOK)
+			if response.Body.String() != tt.want {
+				t.Errorf("got body %q want %q", response.Body.String(), tt.want)
+			}
+		})
+	}
+	t.Run("revisions of other clients are not counted", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/download?filename=frame9.png&revision=2")
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+	t.Run("malformed revision", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/download?filename=frame9.png&revision=last")
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+	t.Run("listing shows every revision once", func(t *testing.T) {
+		body := serve(a, cookie, http.MethodGet, "/files").Body.String()
+
+		if !strings.Contains(body, "Ревизий: 2") {
+			t.Error("revision count missing from listing")
+		}
+		for _, link := range []string{"revision=0", "revision=1"} {
+			if !strings.Contains(body, link) {
+				t.Errorf("link with %s missing from listing", link)
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"example.com/hello/blobstore"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// auditRecord says who changed which file, and how.
+type auditRecord struct {
+	Time     time.Time `bson:"time"`
+	Username string    `bson:"username"`
+	Action   string    `bson:"action"`
+	FileID   string    `bson:"fileID"`
+	Filename string    `bson:"filename"`
+	Details  string    `bson:"details,omitempty"`
+}
+
+func (r auditRecord) String() string {
+	s := fmt.Sprintf("%s %s %s (%s)", r.Username, r.Action, r.Filename, r.FileID)
+	if r.Details != "" {
+		s += ": " + r.Details
+	}
+	return s
+}
+
+// auditLog keeps audit records.
+type auditLog interface {
+	Record(ctx context.Context, r auditRecord) error
+}
+
+// audit records a change made by the current user in stdout and the app's
+// audit log, if it has one. The change has already happened, so a failure
+// to record it is only logged.
+func (a *app) audit(ctx context.Context, action string, file blobstore.FileInfo, details string) {
+	record := auditRecord{
+		Time:     time.Now().UTC(),
+		Username: currentUser(ctx).Username,
+		Action:   action,
+		FileID:   file.ID,
+		Filename: file.Name,
+		Details:  details,
+	}
+	slog.Info("audit", "user", record.Username, "action", record.Action, "file", record.Filename, "id", record.FileID, "details", record.Details)
+	if a.auditLog == nil {
+		return
+	}
+	if err := a.auditLog.Record(ctx, record); err != nil {
+		slog.Error("writing audit record", "err", err)
+	}
+}
+
+type inMemoryAuditLog struct {
+	mu      sync.Mutex
+	records []auditRecord
+}
+
+func newInMemoryAuditLog() *inMemoryAuditLog {
+	return &inMemoryAuditLog{}
+}
+
+func (l *inMemoryAuditLog) Record(ctx context.Context, r auditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+	return nil
+}
+
+// all returns a copy of the records in the order they were written.
+func (l *inMemoryAuditLog) all() []auditRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]auditRecord(nil), l.records...)
+}
+
+// mongoAuditLog appends records to the audit collection of the file store
+// database.
+type mongoAuditLog struct {
+	records *mongo.Collection
+}
+
+func newMongoAuditLog(db *mongo.Database) *mongoAuditLog {
+	return &mongoAuditLog{records: db.Collection("audit")}
+}
+
+func (l *mongoAuditLog) Record(ctx context.Context, r auditRecord) error {
+	_, err := l.records.InsertOne(ctx, r)
+	return blobstore.MongoError(err)
+}
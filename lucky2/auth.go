@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const sessionCookie = "session"
+
+// webSession is a logged-in portal user, kept server side so it can be
+// revoked.
+type webSession struct {
+	Username string
+	Expires  time.Time
+	// CSRFToken must accompany every form the session submits.
+	CSRFToken string
+}
+
+// webSessions maps random session IDs to logged-in users.
+type webSessions struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]webSession
+}
+
+func newWebSessions(ttl time.Duration) *webSessions {
+	return &webSessions{ttl: ttl, sessions: map[string]webSession{}}
+}
+
+// create starts a session for username and returns its ID.
+func (s *webSessions) create(username string) (string, webSession, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", webSession{}, err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return "", webSession{}, err
+	}
+	session := webSession{Username: username, Expires: time.Now().Add(s.ttl), CSRFToken: csrfToken}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = session
+	return id, session, nil
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// lookup returns the live session with the given ID, dropping it if it has
+// expired.
+func (s *webSessions) lookup(id string) (webSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return webSession{}, false
+	}
+	if time.Now().After(session.Expires) {
+		delete(s.sessions, id)
+		return webSession{}, false
+	}
+	return session, true
+}
+
+func (s *webSessions) revoke(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// expire drops the sessions that are over by now and returns how many it
+// dropped.
+func (s *webSessions) expire(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+// expireEvery drops expired sessions every interval until ctx is done, so
+// sessions abandoned without logging out do not pile up.
+func (s *webSessions) expireEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n := s.expire(time.Now()); n > 0 {
+			slog.Debug("expired web sessions", "count", n)
+		}
+	}
+}
+
+// authService guards the portal with accounts from users and server-side
+// sessions, and the API with tokens.
+type authService struct {
+	users    userStore
+	sessions *webSessions
+	tokens   tokenStore
+}
+
+type (
+	userContextKey    struct{}
+	sessionContextKey struct{}
+)
+
+// currentUser returns the account authMiddleware attached to ctx.
+func currentUser(ctx context.Context) user {
+	u, _ := ctx.Value(userContextKey{}).(user)
+	return u
+}
+
+// currentSession returns the session authMiddleware attached to ctx.
+func currentSession(ctx context.Context) webSession {
+	session, _ := ctx.Value(sessionContextKey{}).(webSession)
+	return session
+}
+
+// csrfField is the form field that carries the session's CSRF token.
+// Scripts may send it in the csrfHeader instead.
+const (
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// validCSRF reports whether token is the CSRF token of the current session.
+func validCSRF(r *http.Request, token string) bool {
+	want := currentSession(r.Context()).CSRFToken
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// csrfProtect accepts only POST requests that carry the CSRF token of the
+// current session. It must run inside authMiddleware.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			token = r.PostFormValue(csrfField)
+		}
+		if !validCSRF(r, token) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
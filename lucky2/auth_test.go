@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuth(t testing.TB) *authService {
+	t.Helper()
+	users := newInMemoryUserStore()
+	u, err := newUser("alice", "s3cret")
+	assertNoError(t, err)
+	users.PutUser(context.Background(), u)
+	return &authService{users: users, sessions: newWebSessions(time.Hour)}
+}
+
+func login(auth *authService, username, password string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {username}, "password": {password}}
+	request := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := httptest.NewRecorder()
+	auth.loginHandler(response, request)
+	return response
+}
+
+func sessionCookieFrom(t testing.TB, response *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	t.Fatal("no session cookie was set")
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	auth := newTestAuth(t)
+	protected := auth.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(currentUser(r.Context()).Username))
+	}))
+	get := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/files", nil)
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		response := httptest.NewRecorder()
+		protected.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("wrong password is refused", func(t *testing.T) {
+		response := login(auth, "alice", "root")
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+	t.Run("unknown user is refused", func(t *testing.T) {
+		response := login(auth, "root", "root")
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+	t.Run("forged cookie is refused", func(t *testing.T) {
+		response := get(&http.Cookie{Name: sessionCookie, Value: "trueWithSimpleDefence"})
+		assertStatus(t, response.Code, http.StatusSeeOther)
+	})
+	t.Run("session grants access until logout", func(t *testing.T) {
+		cookie := sessionCookieFrom(t, login(auth, "alice", "s3cret"))
+
+		response := get(cookie)
+		assertStatus(t, response.Code, http.StatusOK)
+		if response.Body.String() != "alice" {
+			t.Errorf("got user %q want %q", response.Body.String(), "alice")
+		}
+
+		session, _ := auth.sessions.lookup(cookie.Value)
+		logout := func(method string, form url.Values) *httptest.ResponseRecorder {
+			request := httptest.NewRequest(method, "/logout", strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			request.AddCookie(cookie)
+			response := httptest.NewRecorder()
+			auth.authMiddleware(csrfProtect(http.HandlerFunc(auth.logoutHandler))).ServeHTTP(response, request)
+			return response
+		}
+
+		assertStatus(t, logout(http.MethodGet, nil).Code, http.StatusMethodNotAllowed)
+		assertStatus(t, logout(http.MethodPost, url.Values{csrfField: {"forged"}}).Code, http.StatusForbidden)
+		assertStatus(t, get(cookie).Code, http.StatusOK)
+
+		assertStatus(t, logout(http.MethodPost, url.Values{csrfField: {session.CSRFToken}}).Code, http.StatusSeeOther)
+		response = get(cookie)
+		assertStatus(t, response.Code, http.StatusSeeOther)
+	})
+}
+
+func TestWebSessionsExpire(t *testing.T) {
+	sessions := newWebSessions(-time.Second)
+	id, _, err := sessions.create("alice")
+	assertNoError(t, err)
+
+	if _, ok := sessions.lookup(id); ok {
+		t.Error("expired session was still valid")
+	}
+}
+
+func TestWebSessionsSweep(t *testing.T) {
+	sessions := newWebSessions(time.Hour)
+	id, _, err := sessions.create("alice")
+	assertNoError(t, err)
+
+	if n := sessions.expire(time.Now()); n != 0 {
+		t.Errorf("expired %d live sessions", n)
+	}
+	if n := sessions.expire(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Errorf("expired %d sessions want 1", n)
+	}
+	if _, ok := sessions.lookup(id); ok || len(sessions.sessions) != 0 {
+		t.Error("expired session was kept")
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	users := newInMemoryUserStore()
+	ctx := context.Background()
+
+	assertNoError(t, bootstrapAdmin(ctx, users, "first"))
+	assertNoError(t, bootstrapAdmin(ctx, users, "second"))
+
+	admin, err := authenticate(ctx, users, adminUsername, "first")
+	if err != nil {
+		t.Errorf("admin password was overwritten: %v", err)
+	}
+	if !admin.Admin {
+		t.Error("bootstrapped account is not an admin")
+	}
+}
+
+func TestUserCanSee(t *testing.T) {
+	cases := []struct {
+		name     string
+		u        user
+		clientID string
+		want     bool
+	}{
+		{"own client", user{ClientIDs: []string{"cam-1", "cam-2"}}, "cam-2", true},
+		{"other client", user{ClientIDs: []string{"cam-1"}}, "cam-3", false},
+		{"no clients", user{}, "cam-1", false},
+		{"admin", user{Admin: true}, "cam-3", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.u.canSee(c.clientID); got != c.want {
+				t.Errorf("got %v want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func assertStatus(t testing.TB, got, want int) {
+	t.Helper()
+	if got != want {
+		t.Errorf("did not get correct status, got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/filenames"
+)
+
+const (
+	maxTags           = 20
+	maxTagLength      = 64
+	maxDescriptionLen = 1000
+)
+
+// formFiles returns the revisions a mutation applies to: the one named by
+// the revision form field, or every visible revision of filename if it is
+// empty. On failure it writes the error response and returns nil.
+func (a *app) formFiles(w http.ResponseWriter, r *http.Request, allByDefault bool) []blobstore.FileInfo {
+	filename := r.PostFormValue("filename")
+	if filename == "" {
+		http.Error(w, "Filename is required", http.StatusBadRequest)
+		return nil
+	}
+	files, err := a.visibleRevisions(r.Context(), currentUser(r.Context()), filename)
+	if err == nil && len(files) == 0 {
+		err = blobstore.ErrNotFound
+	}
+	if err != nil {
+		storeHTTPError(w, r, err)
+		return nil
+	}
+
+	revisionField := r.PostFormValue("revision")
+	if revisionField == "" && allByDefault {
+		return files
+	}
+	revision, err := parseRevision(revisionField)
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return nil
+	}
+	file, err := selectRevision(files, revision)
+	if err != nil {
+		storeHTTPError(w, r, err)
+		return nil
+	}
+	return []blobstore.FileInfo{file}
+}
+
+// deleteHandler deletes one revision of a file, or all of them when no
+// revision is given.
+func (a *app) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	files := a.formFiles(w, r, true)
+	if files == nil {
+		return
+	}
+	for _, file := range files {
+		if err := a.files.Delete(r.Context(), file.ID); err != nil && !errors.Is(err, blobstore.ErrNotFound) {
+			storeHTTPError(w, r, err)
+			return
+		}
+		a.audit(r.Context(), "delete", file, "")
+		a.events.publish(event{Type: eventFileDeleted, File: file})
+	}
+	http.Redirect(w, r, "/files", http.StatusSeeOther)
+}
+
+// renameHandler gives every visible revision of a file a new name.
+func (a *app) renameHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := filenames.CleanFilePath(r.PostFormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files := a.formFiles(w, r, true)
+	if files == nil {
+		return
+	}
+	for i, file := range files {
+		err := a.files.Rename(r.Context(), file.ID, name)
+		if err != nil {
+			// Ревизии одного файла не должны разойтись по двум именам
+			a.undoRenames(r.Context(), files[:i])
+		}
+		if errors.Is(err, blobstore.ErrDuplicate) {
+			http.Error(w, name+" already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			storeHTTPError(w, r, err)
+			return
+		}
+	}
+	for _, file := range files {
+		a.audit(r.Context(), "rename", file, "new name "+name)
+	}
+	http.Redirect(w, r, "/files", http.StatusSeeOther)
+}
+
+// undoRenames gives files their old names back after renaming the rest of
+// their revisions failed.
+func (a *app) undoRenames(ctx context.Context, files []blobstore.FileInfo) {
+	ctx = context.WithoutCancel(ctx)
+	for _, file := range files {
+		if err := a.files.Rename(ctx, file.ID, file.Name); err != nil {
+			slog.Error("undoing rename", "file", file.Name, "id", file.ID, "err", err)
+		}
+	}
+}
+
+// annotateHandler sets the tags and description of one revision, the
+// newest unless the form names another.
+func (a *app) annotateHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := parseTags(r.PostFormValue("tags"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	description := strings.TrimSpace(r.PostFormValue("description"))
+	if utf8.RuneCountInString(description) > maxDescriptionLen || !utf8.ValidString(description) {
+		http.Error(w, "Description is too long", http.StatusBadRequest)
+		return
+	}
+	files := a.formFiles(w, r, false)
+	if files == nil {
+		return
+	}
+	file := files[0]
+	if err := a.files.Annotate(r.Context(), file.ID, tags, description); err != nil {
+		storeHTTPError(w, r, err)
+		return
+	}
+	a.audit(r.Context(), "annotate", file, annotationChange(file.Metadata, tags, description))
+	http.Redirect(w, r, "/files", http.StatusSeeOther)
+}
+
+// parseTags splits a comma-separated tag list, dropping blanks and
+// repeats.
+func parseTags(s string) ([]string, error) {
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength || !utf8.ValidString(tag) {
+			return nil, fmt.Errorf("tags may be at most %d characters", maxTagLength)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return tags, nil
+}
+
+// annotationChange describes an annotation edit for the audit log.
+func annotationChange(old blobstore.Metadata, tags []string, description string) string {
+	return fmt.Sprintf("tags %q -> %q, description %q -> %q",
+		strings.Join(old.Tags, ","), strings.Join(tags, ","), old.Description, description)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+)
+
+// postForm submits form to target as the session in cookie, adding the
+// session's CSRF token unless the form already has one.
+func postForm(a *app, cookie *http.Cookie, target string, form url.Values) *httptest.ResponseRecorder {
+	if !form.Has(csrfField) {
+		session, _ := a.auth.sessions.lookup(cookie.Value)
+		form.Set(csrfField, session.CSRFToken)
+	}
+	request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(cookie)
+	response := httptest.NewRecorder()
+	a.routes().ServeHTTP(response, request)
+	return response
+}
+
+func newEditApp(t testing.TB) (*app, *http.Cookie, blobstore.BlobStore, *inMemoryAuditLog) {
+	t.Helper()
+	store := blobstore.NewMemory()
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+	audit := newInMemoryAuditLog()
+	a.auditLog = audit
+	return a, cookie, store, audit
+}
+
+func TestEditRequiresCSRFToken(t *testing.T) {
+	a, cookie, store, audit := newEditApp(t)
+	putFile(t, store, "frame9.png", "cam-1", "png bytes")
+
+	t.Run("missing token", func(t *testing.T) {
+		response := postForm(a, cookie, "/files/delete", url.Values{"filename": {"frame9.png"}, csrfField: {""}})
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+	t.Run("wrong token", func(t *testing.T) {
+		response := postForm(a, cookie, "/files/delete", url.Values{"filename": {"frame9.png"}, csrfField: {"guess"}})
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+	t.Run("GET is refused", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files/delete?filename=frame9.png")
+		assertStatus(t, response.Code, http.StatusMethodNotAllowed)
+	})
+
+	assertFileCount(t, store, 1)
+	if len(audit.all()) != 0 {
+		t.Errorf("got audit records %v", audit.all())
+	}
+}
+
+func TestDelete(t *testing.T) {
+	t.Run("one revision", func(t *testing.T) {
+		a, cookie, store, audit := newEditApp(t)
+		first := putFile(t, store, "frame9.png", "cam-1", "first")
+		putFile(t, store, "frame9.png", "cam-1", "second")
+
+		response := postForm(a, cookie, "/files/delete", url.Values{"filename": {"frame9.png"}, "revision": {"-1"}})
+
+		assertStatus(t, response.Code, http.StatusSeeOther)
+		files, _ := store.List(context.Background(), blobstore.Query{})
+		if len(files) != 1 || files[0].ID != first.ID {
+			t.Errorf("got %+v want only the first revision", files)
+		}
+		assertAudit(t, audit, "delete")
+	})
+	t.Run("all revisions the user can see", func(t *testing.T) {
+		a, cookie, store, audit := newEditApp(t)
+		putFile(t, store, "frame9.png", "cam-1", "first")
+		putFile(t, store, "frame9.png", "cam-1", "second")
+		other := putFile(t, store, "frame9.png", "cam-2", "not alice's")
+
+		response := postForm(a, cookie, "/files/delete", url.Values{"filename": {"frame9.png"}})
+
+		assertStatus(t, response.Code, http.StatusSeeOther)
+		files, _ := store.List(context.Background(), blobstore.Query{})
+		if len(files) != 1 || files[0].ID != other.ID {
+			t.Errorf("got %+v want only the other client's file", files)
+		}
+		assertAudit(t, audit, "delete", "delete")
+	})
+	t.Run("another client's file is not found", func(t *testing.T) {
+		a, cookie, store, _ := newEditApp(t)
+		putFile(t, store, "secret.pdf", "cam-2", "pdf bytes")
+
+		response := postForm(a, cookie, "/files/delete", url.Values{"filename": {"secret.pdf"}})
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+		assertFileCount(t, store, 1)
+	})
+}
+
+func TestRename(t *testing.T) {
+	a, cookie, store, audit := newEditApp(t)
+	putFile(t, store, "frame9.png", "cam-1", "first")
+	putFile(t, store, "frame9.png", "cam-1", "second")
+
+	response := postForm(a, cookie, "/files/rename", url.Values{"filename": {"frame9.png"}, "name": {"gate.png"}})
+
+	assertStatus(t, response.Code, http.StatusSeeOther)
+	files, _ := store.List(context.Background(), blobstore.Query{Name: "gate.png"})
+	if len(files) != 2 {
+		t.Errorf("got %d renamed revisions want 2", len(files))
+	}
+	assertAudit(t, audit, "rename", "rename")
+
+	t.Run("onto an existing name under reject policy", func(t *testing.T) {
+		a.files = blobstore.WithVersionPolicy(store, blobstore.VersionPolicy{RejectDuplicates: true})
+		putFile(t, store, "other.png", "cam-1", "other")
+
+		response := postForm(a, cookie, "/files/rename", url.Values{"filename": {"other.png"}, "name": {"gate.png"}})
+
+		assertStatus(t, response.Code, http.StatusConflict)
+	})
+	t.Run("empty name", func(t *testing.T) {
+		response := postForm(a, cookie, "/files/rename", url.Values{"filename": {"gate.png"}, "name": {" "}})
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+// failingRename fails to rename the file with the ID failID.
+type failingRename struct {
+	blobstore.BlobStore
+	failID string
+}
+
+func (s failingRename) Rename(ctx context.Context, id, name string) error {
+	if id == s.failID {
+		return blobstore.ErrUnavailable
+	}
+	return s.BlobStore.Rename(ctx, id, name)
+}
+
+func TestRenameFailurePartway(t *testing.T) {
+	a, cookie, store, audit := newEditApp(t)
+	older := putFile(t, store, "frame9.png", "cam-1", "first")
+	time.Sleep(2 * time.Millisecond)
+	putFile(t, store, "frame9.png", "cam-1", "second")
+	// The newest revision is renamed first, so the failure comes after it.
+	a.files = failingRename{BlobStore: store, failID: older.ID}
+
+	response := postForm(a, cookie, "/files/rename", url.Values{"filename": {"frame9.png"}, "name": {"gate.png"}})
+
+	assertStatus(t, response.Code, http.StatusServiceUnavailable)
+	files, _ := store.List(context.Background(), blobstore.Query{Name: "frame9.png"})
+	if len(files) != 2 {
+		t.Errorf("got %d revisions under the old name want 2", len(files))
+	}
+	assertAudit(t, audit)
+}
+
+func TestAnnotate(t *testing.T) {
+	a, cookie, store, audit := newEditApp(t)
+	info := putFile(t, store, "frame9.png", "cam-1", "png bytes")
+
+	response := postForm(a, cookie, "/files/annotate", url.Values{
+		"filename":    {"frame9.png"},
+		"tags":        {"gate, night, ,gate"},
+		"description": {"north gate camera"},
+	})
+
+	assertStatus(t, response.Code, http.StatusSeeOther)
+	got, _ := store.Stat(context.Background(), info.ID)
+	if !reflect.DeepEqual(got.Metadata.Tags, []string{"gate", "night"}) || got.Metadata.Description != "north gate camera" {
+		t.Errorf("got metadata %+v", got.Metadata)
+	}
+	assertAudit(t, audit, "annotate")
+
+	body := serve(a, cookie, http.MethodGet, "/files").Body.String()
+	if !strings.Contains(body, "north gate camera") || !strings.Contains(body, `<span class="tag">night</span>`) {
+		t.Error("annotations missing from listing")
+	}
+
+	t.Run("too many tags", func(t *testing.T) {
+		var tags string
+		for i := 0; i <= maxTags; i++ {
+			tags += fmt.Sprintf("tag%d,", i)
+		}
+		response := postForm(a, cookie, "/files/annotate", url.Values{"filename": {"frame9.png"}, "tags": {tags}})
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func TestVersionPruning(t *testing.T) {
+	store := blobstore.WithVersionPolicy(blobstore.NewMemory(), blobstore.VersionPolicy{KeepLast: 1})
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+	audit := newInMemoryAuditLog()
+	a.auditLog = audit
+	first := putFile(t, store, "frame9.png", "cam-1", "png bytes")
+	sub := a.events.subscribe("test", 10)
+	body, contentType := uploadForm(t, [][2]string{{csrfField, csrfOf(a, cookie)}}, map[string]string{"frame9.png": "new png bytes"})
+
+	response := postUpload(a, cookie, body, contentType, nil)
+
+	assertStatus(t, response.Code, http.StatusSeeOther)
+	assertAudit(t, audit, "delete", "upload")
+	if records := audit.all(); records[0].FileID != first.ID {
+		t.Errorf("got audit record %+v for the pruned revision", records[0])
+	}
+	assertEventType(t, nextEvent(t, sub), eventUploadStarted)
+	deleted := nextEvent(t, sub)
+	assertEventType(t, deleted, eventFileDeleted)
+	if deleted.File.ID != first.ID {
+		t.Errorf("got deleted event %+v", deleted)
+	}
+}
+
+func TestIngestVersionPruning(t *testing.T) {
+	store := blobstore.WithVersionPolicy(blobstore.NewMemory(), blobstore.VersionPolicy{KeepLast: 1})
+	a, _ := newTestApp(t, store, user{Username: "alice"})
+	audit := newInMemoryAuditLog()
+	a.auditLog = audit
+	ingest := &ingestServer{store: a.files, sessions: newInMemorySessionStore()}
+	first := uploadOverTCP(t, ingest, "frame9.png", "cam-1", "png bytes")
+
+	uploadOverTCP(t, ingest, "frame9.png", "cam-1", "new png bytes")
+
+	records := audit.all()
+	if len(records) != 1 || records[0].Username != "ingest:cam-1" || records[0].Action != "delete" || records[0].FileID != first.FileID {
+		t.Errorf("got audit records %v", records)
+	}
+}
+
+func assertAudit(t testing.TB, audit *inMemoryAuditLog, actions ...string) {
+	t.Helper()
+	records := audit.all()
+	var got []string
+	for _, record := range records {
+		if record.Username != "alice" {
+			t.Errorf("got audit record by %q want alice", record.Username)
+		}
+		got = append(got, record.Action)
+	}
+	if !reflect.DeepEqual(got, actions) {
+		t.Errorf("got audit actions %v want %v", got, actions)
+	}
+}
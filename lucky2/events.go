@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/hello/blobstore"
+)
+
+// The kinds of event the bus publishes.
+const (
+	eventUploadStarted   = "upload.started"
+	eventUploadCompleted = "upload.completed"
+	eventUploadFailed    = "upload.failed"
+	eventFileDeleted     = "file.deleted"
+)
+
+// event tells subscribers that something happened to a file. Until an
+// upload completes its file has no ID and Size is what the client
+// announced, if anything.
+type event struct {
+	ID   string             `json:"id"`
+	Type string             `json:"type"`
+	Time time.Time          `json:"time"`
+	File blobstore.FileInfo `json:"file"`
+	// Error says why an upload failed.
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	// sseBuffer is how many events a live page may fall behind by before
+	// it misses some.
+	sseBuffer = 64
+	// sseHeartbeat keeps proxies from closing an event stream that has
+	// been quiet for a while.
+	sseHeartbeat = 30 * time.Second
+)
+
+// eventBus passes events to every subscriber. Publishing never waits: a
+// subscriber whose buffer is full misses the event.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[*subscription]bool
+	closed bool
+}
+
+// subscription receives events until it is unsubscribed or the bus is
+// closed, which closes its channel.
+type subscription struct {
+	name   string // for the dropped events metric
+	events chan event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[*subscription]bool{}}
+}
+
+// publish sends e to every subscriber, filling in its ID and time. A nil
+// bus drops it.
+func (b *eventBus) publish(e event) {
+	if b == nil {
+		return
+	}
+	id, err := newRandomID()
+	if err != nil {
+		slog.Error("publishing event", "type", e.Type, "err", err)
+		return
+	}
+	e.ID = id
+	e.Time = time.Now().UTC()
+	eventsPublished.inc(e.Type)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub.events <- e:
+		default:
+			eventsDropped.inc(sub.name)
+		}
+	}
+}
+
+// subscribe returns a subscription that buffers up to size events.
+func (b *eventBus) subscribe(name string, size int) *subscription {
+	sub := &subscription{name: name, events: make(chan event, size)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.events)
+		return sub
+	}
+	b.subs[sub] = true
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[sub] {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
+
+// close ends every subscription, so event streams let the HTTP server
+// shut down.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
+
+// eventsHandler streams the events of the files the user can see as
+// server-sent events, which the file manager listens to for live updates.
+func (a *app) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r.Context())
+	sub := a.events.subscribe("sse", sseBuffer)
+	defer a.events.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			io.WriteString(w, ": ping\n\n")
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if !u.canSee(e.File.Metadata.ClientID) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				slog.Error("encoding event", "type", e.Type, "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// webhookSender POSTs every event as JSON to url, one at a time and in the
+// order they were published. Each request is signed: the
+// X-Lucky2-Signature header is "sha256=" and the hex HMAC-SHA256, keyed
+// with secret, of the X-Lucky2-Timestamp header, a dot and the body.
+// Events published while earlier ones are still being retried wait in a
+// buffer of hookQueueSize and are dropped when it is full.
+type webhookSender struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	retries int
+	backoff time.Duration
+}
+
+// newWebhookSender checks rawURL and returns a sender to it.
+func newWebhookSender(rawURL, secret string, retries int) (*webhookSender, error) {
+	if err := checkWebhookURL(rawURL); err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, errors.New("webhooks need a secret to sign them with")
+	}
+	return &webhookSender{
+		url:     rawURL,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: hookTimeout},
+		retries: retries,
+		backoff: hookBackoff,
+	}, nil
+}
+
+// run delivers the events of sub until ctx is done or sub is closed.
+func (s *webhookSender) run(ctx context.Context, sub *subscription) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			s.deliver(ctx, e)
+		}
+	}
+}
+
+// deliver sends e, retrying up to s.retries times.
+func (s *webhookSender) deliver(ctx context.Context, e event) {
+	log := slog.With("event", e.Type, "eventID", e.ID, "webhook", s.url)
+	attempts, err := retry(ctx, log, s.retries, s.backoff, func() error {
+		return s.send(ctx, e)
+	})
+	switch {
+	case err == nil:
+		webhookDeliveries.inc("ok")
+	case ctx.Err() == nil:
+		log.Error("delivering webhook", "attempts", attempts, "err", err)
+		webhookDeliveries.inc("failed")
+	}
+}
+
+// send makes one attempt at delivering e.
+func (s *webhookSender) send(ctx context.Context, e event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return permanentError{err}
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header := http.Header{}
+	header.Set("X-Lucky2-Event", e.Type)
+	header.Set("X-Lucky2-Delivery", e.ID)
+	header.Set("X-Lucky2-Timestamp", timestamp)
+	header.Set("X-Lucky2-Signature", "sha256="+signWebhook(s.secret, timestamp, body))
+	return postWebhook(ctx, s.client, s.url, body, header)
+}
+
+// signWebhook returns the hex HMAC-SHA256 a webhook request is signed with.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/protocol"
+)
+
+// nextEvent returns the next event of sub, failing the test if none comes.
+func nextEvent(t testing.TB, sub *subscription) event {
+	t.Helper()
+	select {
+	case e, ok := <-sub.events:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event published")
+		return event{}
+	}
+}
+
+func assertEventType(t testing.TB, e event, want string) {
+	t.Helper()
+	if e.Type != want {
+		t.Fatalf("got event %s want %s", e.Type, want)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	t.Run("subscribers get every event", func(t *testing.T) {
+		bus := newEventBus()
+		first, second := bus.subscribe("test", 1), bus.subscribe("test", 1)
+
+		bus.publish(event{Type: eventFileDeleted, File: blobstore.FileInfo{ID: "1"}})
+
+		for _, sub := range []*subscription{first, second} {
+			e := nextEvent(t, sub)
+			if e.Type != eventFileDeleted || e.File.ID != "1" || e.ID == "" || e.Time.IsZero() {
+				t.Errorf("got event %+v", e)
+			}
+		}
+	})
+	t.Run("a subscriber that falls behind misses events", func(t *testing.T) {
+		bus := newEventBus()
+		bus.subscribe("slow", 1)
+		dropped := eventsDropped.value("slow")
+
+		bus.publish(event{Type: eventFileDeleted})
+		bus.publish(event{Type: eventFileDeleted})
+
+		if got := eventsDropped.value("slow") - dropped; got != 1 {
+			t.Errorf("got %v dropped events want 1", got)
+		}
+	})
+	t.Run("close ends every subscription", func(t *testing.T) {
+		bus := newEventBus()
+		sub := bus.subscribe("test", 1)
+
+		bus.close()
+
+		if _, ok := <-sub.events; ok {
+			t.Error("subscription still open")
+		}
+		if _, ok := <-bus.subscribe("test", 1).events; ok {
+			t.Error("subscribed to a closed bus")
+		}
+		bus.unsubscribe(sub)
+	})
+	t.Run("a nil bus drops events", func(t *testing.T) {
+		var bus *eventBus
+		bus.publish(event{Type: eventFileDeleted})
+	})
+}
+
+func TestEventStream(t *testing.T) {
+	a, cookie := newTestApp(t, blobstore.NewMemory(), user{Username: "alice", ClientIDs: []string{"cam-1"}})
+	server := httptest.NewServer(a.routes())
+	defer server.Close()
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/files/events", nil)
+	assertNoError(t, err)
+	request.AddCookie(cookie)
+	response, err := server.Client().Do(request)
+	assertNoError(t, err)
+	defer response.Body.Close()
+	assertStatus(t, response.StatusCode, http.StatusOK)
+	assertHeader(t, response.Header, "Content-Type", "text/event-stream")
+
+	a.events.publish(event{Type: eventUploadStarted, File: blobstore.FileInfo{Name: "secret.pdf", Metadata: blobstore.Metadata{ClientID: "cam-2"}}})
+	a.events.publish(event{Type: eventUploadStarted, File: blobstore.FileInfo{Name: "frame9.png", Metadata: blobstore.Metadata{ClientID: "cam-1"}}})
+	a.events.close()
+
+	body, err := io.ReadAll(response.Body)
+	assertNoError(t, err)
+	if strings.Contains(string(body), "secret.pdf") {
+		t.Error("another client's upload was streamed")
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "id: ") || lines[1] != "event: upload.started" || lines[3] != "" {
+		t.Fatalf("got stream %q", body)
+	}
+	var e event
+	assertNoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e))
+	if e.File.Name != "frame9.png" || "id: "+e.ID != lines[0] {
+		t.Errorf("got event %+v", e)
+	}
+}
+
+func TestFileEvents(t *testing.T) {
+	t.Run("ingest uploads", func(t *testing.T) {
+		bus := newEventBus()
+		sub := bus.subscribe("test", 10)
+		ingest := &ingestServer{store: blobstore.NewMemory(), sessions: newInMemorySessionStore(), events: bus}
+
+		ack := uploadOverTCP(t, ingest, "frame9.png", "cam-1", "png bytes")
+
+		started := nextEvent(t, sub)
+		assertEventType(t, started, eventUploadStarted)
+		if started.File.Name != "frame9.png" || started.File.Size != 9 || started.File.Metadata.ClientID != "cam-1" {
+			t.Errorf("got started event %+v", started)
+		}
+		completed := nextEvent(t, sub)
+		assertEventType(t, completed, eventUploadCompleted)
+		if completed.File.ID != ack.FileID {
+			t.Errorf("got completed event %+v", completed)
+		}
+	})
+	t.Run("failed ingest uploads", func(t *testing.T) {
+		bus := newEventBus()
+		sub := bus.subscribe("test", 10)
+		ingest := &ingestServer{store: blobstore.NewMemory(), sessions: newInMemorySessionStore(), events: bus}
+		sum := sha256.Sum256([]byte("something else"))
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+
+		_, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader("png bytes"), 9)
+
+		assertAckStatus(t, err, protocol.StatusChecksumMismatch)
+		assertEventType(t, nextEvent(t, sub), eventUploadStarted)
+		failed := nextEvent(t, sub)
+		assertEventType(t, failed, eventUploadFailed)
+		if failed.File.Name != "frame9.png" || !strings.Contains(failed.Error, "SHA-256") {
+			t.Errorf("got failed event %+v", failed)
+		}
+	})
+	t.Run("portal uploads", func(t *testing.T) {
+		a, cookie := newTestApp(t, blobstore.NewMemory(), user{Username: "alice", ClientIDs: []string{"cam-1"}})
+		sub := a.events.subscribe("test", 10)
+		body, contentType := uploadForm(t, [][2]string{{csrfField, csrfOf(a, cookie)}}, map[string]string{"frame9.png": "png bytes"})
+
+		response := postUpload(a, cookie, body, contentType, nil)
+
+		assertStatus(t, response.Code, http.StatusSeeOther)
+		assertEventType(t, nextEvent(t, sub), eventUploadStarted)
+		completed := nextEvent(t, sub)
+		assertEventType(t, completed, eventUploadCompleted)
+		if completed.File.Metadata.Uploader != "alice" {
+			t.Errorf("got completed event %+v", completed)
+		}
+	})
+	t.Run("deletes", func(t *testing.T) {
+		a, cookie, store, _ := newEditApp(t)
+		file := putFile(t, store, "frame9.png", "cam-1", "png bytes")
+		sub := a.events.subscribe("test", 10)
+
+		response := postForm(a, cookie, "/files/delete", url.Values{"filename": {"frame9.png"}})
+
+		assertStatus(t, response.Code, http.StatusSeeOther)
+		deleted := nextEvent(t, sub)
+		assertEventType(t, deleted, eventFileDeleted)
+		if deleted.File.ID != file.ID {
+			t.Errorf("got deleted event %+v", deleted)
+		}
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Run("deliveries are signed", func(t *testing.T) {
+		events := make(chan event, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mac := hmac.New(sha256.New, []byte("hunter2"))
+			mac.Write([]byte(r.Header.Get("X-Lucky2-Timestamp") + "." + string(body)))
+			want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			if r.Header.Get("X-Lucky2-Signature") != want {
+				t.Errorf("got signature %q want %q", r.Header.Get("X-Lucky2-Signature"), want)
+			}
+			var e event
+			json.Unmarshal(body, &e)
+			if r.Header.Get("X-Lucky2-Event") != e.Type || r.Header.Get("X-Lucky2-Delivery") != e.ID {
+				t.Errorf("got headers %v for event %+v", r.Header, e)
+			}
+			events <- e
+		}))
+		defer server.Close()
+		sender, err := newWebhookSender(server.URL, "hunter2", 0)
+		assertNoError(t, err)
+		bus := newEventBus()
+		sub := bus.subscribe("webhook", 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go sender.run(ctx, sub)
+
+		bus.publish(event{Type: eventUploadCompleted, File: blobstore.FileInfo{ID: "1", Name: "frame9.png"}})
+
+		select {
+		case e := <-events:
+			if e.Type != eventUploadCompleted || e.File.Name != "frame9.png" {
+				t.Errorf("got event %+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook was not called")
+		}
+	})
+	t.Run("failures are retried", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+		sender, err := newWebhookSender(server.URL, "hunter2", 3)
+		assertNoError(t, err)
+		sender.backoff = time.Millisecond
+		ok := webhookDeliveries.value("ok")
+
+		sender.deliver(context.Background(), event{Type: eventFileDeleted})
+
+		if calls.Load() != 3 || webhookDeliveries.value("ok")-ok != 1 {
+			t.Errorf("webhook called %d times", calls.Load())
+		}
+	})
+	t.Run("permanent failures are not retried", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+		sender, err := newWebhookSender(server.URL, "hunter2", 3)
+		assertNoError(t, err)
+		failed := webhookDeliveries.value("failed")
+
+		sender.deliver(context.Background(), event{Type: eventFileDeleted})
+
+		if calls.Load() != 1 || webhookDeliveries.value("failed")-failed != 1 {
+			t.Errorf("webhook called %d times", calls.Load())
+		}
+	})
+	t.Run("bad settings are refused", func(t *testing.T) {
+		if _, err := newWebhookSender("ftp://example.com/hook", "hunter2", 0); err == nil {
+			t.Error("non-HTTP webhook accepted")
+		}
+		if _, err := newWebhookSender("https://example.com/hook", "", 0); err == nil {
+			t.Error("webhook without a secret accepted")
+		}
+	})
+}
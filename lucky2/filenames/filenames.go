@@ -0,0 +1,129 @@
+// Package filenames is the policy for the names files are stored under.
+// The ingest port and the portal both normalize client-supplied names with
+// it, and downloads quote names with it.
+//
+// A stored name is a path: folder names and the file's own name joined
+// with "/". Every part is NFC-normalized UTF-8 without control or
+// bidirectional formatting characters, so the same name typed on two
+// systems is stored once and cannot be made to render differently from
+// what it is.
+package filenames
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxLength bounds a stored name in bytes, folders included.
+const MaxLength = 255
+
+// ErrInvalid is returned, wrapped with the reason, for names the policy
+// refuses.
+var ErrInvalid = errors.New("invalid filename")
+
+func invalid(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, reason)
+}
+
+// Clean validates and normalizes the name of one file or folder: it may
+// not contain a path separator or be "." or "..". Surrounding spaces are
+// dropped.
+func Clean(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", invalid("not valid UTF-8")
+	}
+	name = strings.TrimSpace(norm.NFC.String(name))
+	switch {
+	case name == "":
+		return "", invalid("empty name")
+	case name == "." || name == "..":
+		return "", invalid(`"." and ".." are not names`)
+	case strings.ContainsAny(name, `/\`):
+		return "", invalid("contains a path separator")
+	case strings.ContainsFunc(name, forbidden):
+		return "", invalid("contains a control character")
+	case len(name) > MaxLength:
+		return "", invalid(fmt.Sprintf("longer than %d bytes", MaxLength))
+	}
+	return name, nil
+}
+
+// forbidden reports characters no name may contain: control characters,
+// and the bidirectional marks that can make "gnp.exe" show as "exe.png".
+func forbidden(r rune) bool {
+	return unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r)
+}
+
+// CleanPath normalizes a slash-separated path relative to the root of the
+// store. Backslashes count as slashes and empty and "." segments are
+// dropped; every other segment must pass Clean, so ".." is refused and no
+// path can point outside its folder. The root is "".
+func CleanPath(p string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(strings.ReplaceAll(p, `\`, "/"), "/") {
+		if s := strings.TrimSpace(segment); s == "" || s == "." {
+			continue
+		}
+		segment, err := Clean(segment)
+		if err != nil {
+			return "", err
+		}
+		segments = append(segments, segment)
+	}
+	cleaned := strings.Join(segments, "/")
+	if len(cleaned) > MaxLength {
+		return "", invalid(fmt.Sprintf("longer than %d bytes", MaxLength))
+	}
+	return cleaned, nil
+}
+
+// CleanFilePath is CleanPath for the name of a file, which may not be the
+// root.
+func CleanFilePath(p string) (string, error) {
+	cleaned, err := CleanPath(p)
+	if err == nil && cleaned == "" {
+		err = invalid("empty name")
+	}
+	return cleaned, err
+}
+
+// ContentDisposition formats a Content-Disposition header value offering
+// name to save as, following RFC 6266: a quoted ASCII filename for old
+// clients, and an RFC 5987 filename* with the exact name when that differs.
+func ContentDisposition(disposition, name string) string {
+	var fallback strings.Builder
+	for _, r := range name {
+		if r < ' ' || r > '~' || r == '"' || r == '\\' || r == '%' {
+			r = '_'
+		}
+		fallback.WriteRune(r)
+	}
+	value := disposition + `; filename="` + fallback.String() + `"`
+	if fallback.String() != name {
+		value += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return value
+}
+
+// encodeExtValue percent-encodes everything in s but the attr-chars of
+// RFC 5987.
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package filenames
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"frame9.png", "frame9.png"},
+		{"  frame9.png ", "frame9.png"},
+		{"отчёт за март.pdf", "отчёт за март.pdf"},
+		// "й" typed as "и" and a combining breve is stored composed.
+		{"\u0438\u0306.txt", "\u0439.txt"},
+	} {
+		got, err := Clean(tt.name)
+		assertNoError(t, err)
+		if got != tt.want {
+			t.Errorf("Clean(%q): got %q want %q", tt.name, got, tt.want)
+		}
+	}
+	for _, name := range []string{
+		"", " ", ".", "..", "cam/frame9.png", `cam\frame9.png`,
+		"bad\x00name", "line\nbreak", "gnp.\u202eexe", "\xff", strings.Repeat("a", MaxLength+1),
+	} {
+		if _, err := Clean(name); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Clean(%q): got %v want ErrInvalid", name, err)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"frame9.png", "frame9.png"},
+		{"/cam/2024/frame9.png", "cam/2024/frame9.png"},
+		{`cam\2024\frame9.png`, "cam/2024/frame9.png"},
+		{"cam//./frame9.png/", "cam/frame9.png"},
+		{" камера 1 / март /кадр.png", "камера 1/март/кадр.png"},
+		{"", ""},
+	} {
+		got, err := CleanPath(tt.name)
+		assertNoError(t, err)
+		if got != tt.want {
+			t.Errorf("CleanPath(%q): got %q want %q", tt.name, got, tt.want)
+		}
+	}
+	for _, name := range []string{"..", "cam/../../etc", `..\secret`, "cam/ .. /x", "bad\x00name", "\xff", strings.Repeat("a/", 200)} {
+		if _, err := CleanPath(name); !errors.Is(err, ErrInvalid) {
+			t.Errorf("CleanPath(%q): got %v want ErrInvalid", name, err)
+		}
+	}
+	if _, err := CleanFilePath("/./"); !errors.Is(err, ErrInvalid) {
+		t.Error("CleanFilePath accepted an empty name")
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"frame9.png", `attachment; filename="frame9.png"`},
+		{"my frame.png", `attachment; filename="my frame.png"`},
+		{`say "cheese".png`, `attachment; filename="say _cheese_.png"; filename*=UTF-8''say%20%22cheese%22.png`},
+		{"отчёт.pdf", `attachment; filename="_____.pdf"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.pdf`},
+		{"a.png\r\nSet-Cookie: x=1", `attachment; filename="a.png__Set-Cookie: x=1"; filename*=UTF-8''a.png%0D%0ASet-Cookie%3A%20x%3D1`},
+		{"100%.txt", `attachment; filename="100_.txt"; filename*=UTF-8''100%25.txt`},
+	} {
+		if got := ContentDisposition("attachment", tt.name); got != tt.want {
+			t.Errorf("ContentDisposition(%q):\ngot  %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func assertNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("got an error but didn't want one: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/filenames"
+)
+
+// joinPath puts name into folder. Both must already be clean.
+func joinPath(folder, name string) string {
+	if folder == "" {
+		return name
+	}
+	return folder + "/" + name
+}
+
+// folderLink is a folder of the file manager and where it leads.
+type folderLink struct {
+	Name string
+	URL  string
+}
+
+// breadcrumbs links the root and each folder on the way to folder.
+func breadcrumbs(folder string) []folderLink {
+	crumbs := []folderLink{{Name: "Все файлы", URL: "/files"}}
+	if folder == "" {
+		return crumbs
+	}
+	segments := strings.Split(folder, "/")
+	for i, segment := range segments {
+		crumbs = append(crumbs, folderLink{Name: segment, URL: folderURL(strings.Join(segments[:i+1], "/"))})
+	}
+	return crumbs
+}
+
+func folderURL(folder string) string {
+	return "/files?dir=" + queryEscape(folder)
+}
+
+// queryEscape escapes a query parameter value, leaving slashes readable.
+func queryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "%2F", "/")
+}
+
+// archiveWriter writes the entries of a folder archive.
+type archiveWriter interface {
+	add(file blobstore.FileInfo, name string, content io.Reader) error
+	Close() error
+}
+
+type zipArchive struct{ w *zip.Writer }
+
+func (z zipArchive) add(file blobstore.FileInfo, name string, content io.Reader) error {
+	entry, err := z.w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: file.UploadDate})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, content)
+	return err
+}
+
+func (z zipArchive) Close() error { return z.w.Close() }
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (t tarGzArchive) add(file blobstore.FileInfo, name string, content io.Reader) error {
+	header := &tar.Header{Name: name, Mode: 0o644, Size: file.Size, ModTime: file.UploadDate, Typeflag: tar.TypeReg}
+	if err := t.w.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.w, content)
+	return err
+}
+
+func (t tarGzArchive) Close() error {
+	if err := t.w.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// archiveHandler streams the newest revision of every file under the dir
+// folder that the user may see, as a ZIP or, with format=tar.gz, a gzipped
+// tarball. Entries are named relative to the folder.
+func (a *app) archiveHandler(w http.ResponseWriter, r *http.Request) {
+	folder, err := filenames.CleanPath(r.URL.Query().Get("dir"))
+	if err != nil {
+		http.Error(w, "Invalid folder", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "zip"
+	case "zip", "tar.gz":
+	default:
+		http.Error(w, "Format must be zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r.Context())
+	files, err := a.latestRevisions(r.Context(), u, folder)
+	if err != nil {
+		storeHTTPError(w, r, err)
+		return
+	}
+	if len(files) == 0 {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	archiveName := path.Base(folder)
+	if folder == "" {
+		archiveName = "files"
+	}
+	var archive archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		archive = zipArchive{zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		archive = tarGzArchive{gz: gz, w: tar.NewWriter(gz)}
+	}
+	w.Header().Set("Content-Disposition", filenames.ContentDisposition("attachment", archiveName+"."+format))
+
+	// Заголовки уже отправлены: при ошибке остаётся только оборвать архив
+	for _, file := range files {
+		if err := a.addToArchive(r.Context(), archive, file, strings.TrimPrefix(file.Name, folder+"/")); err != nil {
+			slog.Error("archiving file", "file", file.Name, "err", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		slog.Error("finishing archive", "err", err)
+	}
+}
+
+func (a *app) addToArchive(ctx context.Context, archive archiveWriter, file blobstore.FileInfo, name string) error {
+	content, _, err := a.files.Get(ctx, file.ID)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return archive.add(file, name, content)
+}
+
+// latestRevisions returns the newest visible revision of every file under
+// folder, by name.
+func (a *app) latestRevisions(ctx context.Context, u user, folder string) ([]blobstore.FileInfo, error) {
+	files, err := a.files.List(ctx, visibleQuery(u, blobstore.Query{Folder: folder, Sort: blobstore.SortName, Ascending: true}))
+	if err != nil {
+		return nil, err
+	}
+	// Revisions of a name are adjacent and newest first.
+	var latest []blobstore.FileInfo
+	for _, file := range files {
+		if len(latest) == 0 || latest[len(latest)-1].Name != file.Name {
+			latest = append(latest, file)
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"example.com/hello/blobstore"
+)
+
+func TestFolders(t *testing.T) {
+	store := blobstore.NewMemory()
+	putFile(t, store, "top.txt", "cam-1", "top")
+	putFile(t, store, "cam/2024-03-01/frame1.png", "cam-1", "one")
+	putFile(t, store, "cam/2024-03-01/frame1.png", "cam-1", "one, again")
+	putFile(t, store, "cam/2024-03-01/deep/frame2.png", "cam-1", "two")
+	putFile(t, store, "cam/log.txt", "cam-1", "log")
+	putFile(t, store, "cam/2024-03-02/secret.png", "cam-2", "hidden")
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+
+	t.Run("root lists top-level files and folders", func(t *testing.T) {
+		body := serve(a, cookie, http.MethodGet, "/files").Body.String()
+
+		if !strings.Contains(body, "top.txt") || !strings.Contains(body, `href="/files?dir=cam"`) {
+			t.Error("top-level file or folder missing")
+		}
+		if strings.Contains(body, "log.txt") {
+			t.Error("file of a subfolder listed at the root")
+		}
+	})
+	t.Run("folder shows breadcrumbs and only visible subfolders", func(t *testing.T) {
+		body := serve(a, cookie, http.MethodGet, "/files?dir=cam").Body.String()
+
+		for _, want := range []string{">log.txt<", `href="/files?dir=cam/2024-03-01"`, `href="/files?dir=cam">cam</a>`, `href="/files">Все файлы</a>`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s missing from listing", want)
+			}
+		}
+		if strings.Contains(body, "2024-03-02") {
+			t.Error("folder of another client listed")
+		}
+	})
+	t.Run("recursive listing names files relative to the folder", func(t *testing.T) {
+		body := serve(a, cookie, http.MethodGet, "/files?dir=cam&recursive=1").Body.String()
+
+		if !strings.Contains(body, ">2024-03-01/deep/frame2.png<") {
+			t.Error("nested file missing")
+		}
+	})
+	t.Run("folders escaping the root are rejected", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files?dir=../cam")
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+	t.Run("zip holds the newest revision of every file", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files/archive?dir=cam/2024-03-01")
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "Content-Disposition", `attachment; filename="2024-03-01.zip"`)
+		archive, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+		assertNoError(t, err)
+		got := map[string]string{}
+		for _, f := range archive.File {
+			r, err := f.Open()
+			assertNoError(t, err)
+			content, _ := io.ReadAll(r)
+			got[f.Name] = string(content)
+		}
+		want := map[string]string{"frame1.png": "one, again", "deep/frame2.png": "two"}
+		if len(got) != len(want) || got["frame1.png"] != want["frame1.png"] || got["deep/frame2.png"] != want["deep/frame2.png"] {
+			t.Errorf("got %v want %v", got, want)
+		}
+	})
+	t.Run("tar.gz leaves out other clients' files", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files/archive?dir=cam&format=tar.gz")
+
+		assertStatus(t, response.Code, http.StatusOK)
+		gz, err := gzip.NewReader(response.Body)
+		assertNoError(t, err)
+		archive := tar.NewReader(gz)
+		var got []string
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			assertNoError(t, err)
+			got = append(got, header.Name)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != "2024-03-01/deep/frame2.png,2024-03-01/frame1.png,log.txt" {
+			t.Errorf("got entries %v", got)
+		}
+	})
+	t.Run("archive of an unknown folder", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files/archive?dir=cam/2024-03-02")
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+	t.Run("unknown archive format", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files/archive?dir=cam&format=rar")
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func TestUploadIntoFolder(t *testing.T) {
+	a, cookie, store, _ := newEditApp(t)
+	body, contentType := uploadForm(t, [][2]string{{"folder", "/cam/2024-03-01/"}}, map[string]string{"frame9.png": "png bytes"})
+
+	response := postUpload(a, cookie, body, contentType, http.Header{csrfHeader: {csrfOf(a, cookie)}})
+
+	assertStatus(t, response.Code, http.StatusSeeOther)
+	files, _ := store.List(context.Background(), blobstore.Query{Name: "cam/2024-03-01/frame9.png"})
+	if len(files) != 1 {
+		t.Errorf("got %d files in the folder", len(files))
+	}
+
+	body, contentType = uploadForm(t, [][2]string{{"folder", "../up"}}, map[string]string{"frame9.png": "png bytes"})
+	response = postUpload(a, cookie, body, contentType, http.Header{csrfHeader: {csrfOf(a, cookie)}})
+	assertStatus(t, response.Code, http.StatusBadRequest)
+}
+
+func TestRenameIntoFolder(t *testing.T) {
+	a, cookie, store, _ := newEditApp(t)
+	putFile(t, store, "frame9.png", "cam-1", "png bytes")
+
+	response := postForm(a, cookie, "/files/rename", url.Values{"filename": {"frame9.png"}, "name": {"../frame9.png"}})
+	assertStatus(t, response.Code, http.StatusBadRequest)
+
+	response = postForm(a, cookie, "/files/rename", url.Values{"filename": {"frame9.png"}, "name": {"archive//frame9.png"}})
+	assertStatus(t, response.Code, http.StatusSeeOther)
+	files, _ := store.List(context.Background(), blobstore.Query{Folder: "archive"})
+	if len(files) != 1 || files[0].Name != "archive/frame9.png" {
+		t.Errorf("got %v", files)
+	}
+}
+
+func TestAPIFolders(t *testing.T) {
+	store := blobstore.NewMemory()
+	putFile(t, store, "cam/2024-03-01/frame1.png", "cam-1", "one")
+	putFile(t, store, "cam/log.txt", "cam-1", "log")
+	a, token := newAPITestApp(t, store)
+
+	response := apiRequest(a, token, http.MethodGet, "/api/v1/files?dir=cam", nil)
+
+	assertStatus(t, response.Code, http.StatusOK)
+	var page struct {
+		Files   []apiFile `json:"files"`
+		Folders []string  `json:"folders"`
+	}
+	assertNoError(t, json.NewDecoder(response.Body).Decode(&page))
+	if len(page.Files) != 1 || page.Files[0].Name != "cam/log.txt" || strings.Join(page.Folders, ",") != "cam/2024-03-01" {
+		t.Errorf("got %+v", page)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/hello/blobstore"
+)
+
+// processor does one kind of work on a file once it is stored. The
+// properties it returns are recorded on the file.
+type processor interface {
+	Name() string
+	Process(ctx context.Context, file blobstore.FileInfo, content io.ReadSeeker) (map[string]string, error)
+}
+
+// permanentError marks a processor failure that trying again cannot fix,
+// such as an image that does not decode.
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+const (
+	// hookTimeout bounds one attempt of one processor.
+	hookTimeout = time.Minute
+	// hookBackoff is how long the first retry waits; every further retry
+	// waits twice as long as the one before.
+	hookBackoff   = time.Second
+	hookQueueSize = 1000
+)
+
+// pipeline runs its processors on every file submitted to it, in the
+// background, so uploads are acknowledged without waiting for them. Each
+// processor is retried on its own. Files still queued when the server
+// stops are not processed.
+type pipeline struct {
+	store      blobstore.BlobStore
+	processors []processor
+	retries    int
+	backoff    time.Duration
+	queue      chan blobstore.FileInfo
+}
+
+func newPipeline(store blobstore.BlobStore, processors []processor, retries int) *pipeline {
+	return &pipeline{
+		store:      store,
+		processors: processors,
+		retries:    retries,
+		backoff:    hookBackoff,
+		queue:      make(chan blobstore.FileInfo, hookQueueSize),
+	}
+}
+
+// submit queues a stored file. It never holds up the upload: when the
+// queue is full the file is skipped. A nil pipeline does nothing.
+func (p *pipeline) submit(file blobstore.FileInfo) {
+	if p == nil || len(p.processors) == 0 {
+		return
+	}
+	select {
+	case p.queue <- file:
+	default:
+		slog.Warn("processing queue full, file skipped", "file", file.Name, "id", file.ID)
+		hookRuns.inc("queue", "dropped")
+	}
+}
+
+// run processes queued files on workers goroutines until ctx is done.
+func (p *pipeline) run(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case file := <-p.queue:
+					p.process(ctx, file)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// process runs every processor on file, retrying each up to p.retries
+// times.
+func (p *pipeline) process(ctx context.Context, file blobstore.FileInfo) {
+	for _, proc := range p.processors {
+		log := slog.With("file", file.Name, "id", file.ID, "processor", proc.Name())
+		attempts, err := retry(ctx, log, p.retries, p.backoff, func() error {
+			return p.runProcessor(ctx, proc, file)
+		})
+		switch {
+		case err == nil:
+			hookRuns.inc(proc.Name(), "ok")
+		case ctx.Err() != nil:
+			return
+		default:
+			log.Error("processing file", "attempts", attempts, "err", err)
+			hookRuns.inc(proc.Name(), "failed")
+		}
+	}
+}
+
+// retry calls attempt until it succeeds, fails with a permanentError or
+// ErrNotFound, ctx is done, or it has been retried retries times. The first
+// retry waits backoff and every further one twice as long as the one
+// before. It returns how often attempt was called and its last error.
+func retry(ctx context.Context, log *slog.Logger, retries int, backoff time.Duration, attempt func() error) (int, error) {
+	delay := backoff
+	for attempts := 1; ; attempts++ {
+		err := attempt()
+		var permanent permanentError
+		if err == nil || ctx.Err() != nil || attempts > retries ||
+			errors.As(err, &permanent) || errors.Is(err, blobstore.ErrNotFound) {
+			return attempts, err
+		}
+		log.Warn("will retry", "retryIn", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (p *pipeline) runProcessor(ctx context.Context, proc processor, file blobstore.FileInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	content, _, err := p.store.Get(ctx, file.ID)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	props, err := proc.Process(ctx, file, content)
+	if err != nil || len(props) == 0 {
+		return err
+	}
+	return p.store.SetProperties(ctx, file.ID, props)
+}
+
+// builtinProcessors are the processors -processors can name.
+var builtinProcessors = map[string]func(a *app) processor{
+	"dimensions": func(*app) processor { return dimensionsProcessor{} },
+	"thumbnail":  func(a *app) processor { return thumbnailProcessor{cache: a.thumbs} },
+	"hashes":     func(*app) processor { return hashProcessor{} },
+}
+
+// newProcessors builds the processors named in the comma-separated list,
+// followed by a webhook if webhookURL is set.
+func newProcessors(a *app, names, webhookURL string) ([]processor, error) {
+	var processors []processor
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		build, ok := builtinProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown processor %q", name)
+		}
+		processors = append(processors, build(a))
+	}
+	if webhookURL != "" {
+		if err := checkWebhookURL(webhookURL); err != nil {
+			return nil, err
+		}
+		processors = append(processors, webhookProcessor{url: webhookURL, client: &http.Client{}})
+	}
+	return processors, nil
+}
+
+// dimensionsProcessor records the width and height of PNG and JPEG images.
+type dimensionsProcessor struct{}
+
+func (dimensionsProcessor) Name() string { return "dimensions" }
+
+func (dimensionsProcessor) Process(ctx context.Context, file blobstore.FileInfo, content io.ReadSeeker) (map[string]string, error) {
+	if !hasThumbnail(file) {
+		return nil, nil
+	}
+	config, _, err := image.DecodeConfig(content)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	return map[string]string{"width": strconv.Itoa(config.Width), "height": strconv.Itoa(config.Height)}, nil
+}
+
+// thumbnailProcessor renders thumbnails ahead of the first look at the
+// file manager.
+type thumbnailProcessor struct {
+	cache *thumbnailCache
+}
+
+func (thumbnailProcessor) Name() string { return "thumbnail" }
+
+func (p thumbnailProcessor) Process(ctx context.Context, file blobstore.FileInfo, content io.ReadSeeker) (map[string]string, error) {
+	if !hasThumbnail(file) {
+		return nil, nil
+	}
+	thumb, err := makeThumbnail(content)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	p.cache.put(file.ID, thumb)
+	return nil, nil
+}
+
+// hashProcessor records the digests other systems look files up by. The
+// SHA-256 is already in the metadata.
+type hashProcessor struct{}
+
+func (hashProcessor) Name() string { return "hashes" }
+
+func (hashProcessor) Process(ctx context.Context, file blobstore.FileInfo, content io.ReadSeeker) (map[string]string, error) {
+	hashes := map[string]hash.Hash{"md5": md5.New(), "sha1": sha1.New(), "sha512": sha512.New()}
+	writers := make([]io.Writer, 0, len(hashes))
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), blobstore.ContextReader(ctx, content)); err != nil {
+		return nil, err
+	}
+	props := map[string]string{}
+	for name, h := range hashes {
+		props[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return props, nil
+}
+
+// webhookEvent is the body POSTed for every stored file.
+type webhookEvent struct {
+	Event string             `json:"event"`
+	File  blobstore.FileInfo `json:"file"`
+}
+
+// webhookProcessor tells another system about every stored file by
+// POSTing a webhookEvent to url.
+type webhookProcessor struct {
+	url    string
+	client *http.Client
+}
+
+func (webhookProcessor) Name() string { return "webhook" }
+
+func (p webhookProcessor) Process(ctx context.Context, file blobstore.FileInfo, content io.ReadSeeker) (map[string]string, error) {
+	body, err := json.Marshal(webhookEvent{Event: "file.stored", File: file})
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	return nil, postWebhook(ctx, p.client, p.url, body, nil)
+}
+
+// checkWebhookURL refuses webhook URLs that are not http or https.
+func checkWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q is not an http or https URL", rawURL)
+	}
+	return nil
+}
+
+// postWebhook makes one attempt at POSTing body as JSON to url, with the
+// headers in header. Any 2xx answer is success; other 4xx answers, except
+// 408 and 429, are not retried, so they fail with a permanentError.
+func postWebhook(ctx context.Context, client *http.Client, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("webhook answered %s", resp.Status)}
+	default:
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+)
+
+// runPipeline processes files submitted to p until the test ends.
+func runPipeline(t testing.TB, p *pipeline) {
+	t.Helper()
+	p.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx, 2)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitForProperties waits until the file has a value for every key.
+func waitForProperties(t testing.TB, store blobstore.BlobStore, id string, keys ...string) map[string]string {
+	t.Helper()
+	for range 200 {
+		info, err := store.Stat(context.Background(), id)
+		assertNoError(t, err)
+		found := 0
+		for _, key := range keys {
+			if info.Metadata.Properties[key] != "" {
+				found++
+			}
+		}
+		if found == len(keys) {
+			return info.Metadata.Properties
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("file never got properties %v", keys)
+	return nil
+}
+
+func TestPipeline(t *testing.T) {
+	t.Run("built-in processors", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		a, _ := newTestApp(t, store, user{Username: "alice"})
+		processors, err := newProcessors(a, "dimensions,thumbnail,hashes", "")
+		assertNoError(t, err)
+		p := newPipeline(store, processors, 0)
+		runPipeline(t, p)
+		putFileType(t, store, "frame9.png", encodePNG(t, 4, 3), "image/png")
+		files, _ := store.List(context.Background(), blobstore.Query{})
+
+		p.submit(files[0])
+
+		props := waitForProperties(t, store, files[0].ID, "width", "height", "md5", "sha1", "sha512")
+		if props["width"] != "4" || props["height"] != "3" || len(props["md5"]) != 32 {
+			t.Errorf("got properties %v", props)
+		}
+		if _, ok := a.thumbs.get(files[0].ID); !ok {
+			t.Error("thumbnail was not rendered")
+		}
+	})
+	t.Run("webhook", func(t *testing.T) {
+		events := make(chan webhookEvent, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event webhookEvent
+			json.NewDecoder(r.Body).Decode(&event)
+			events <- event
+		}))
+		defer server.Close()
+		store := blobstore.NewMemory()
+		processors, err := newProcessors(&app{}, "", server.URL)
+		assertNoError(t, err)
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore(), hooks: newPipeline(store, processors, 0)}
+		runPipeline(t, ingest.hooks)
+
+		ack := uploadOverTCP(t, ingest, "frame9.png", "cam-1", "png bytes")
+
+		select {
+		case event := <-events:
+			if event.Event != "file.stored" || event.File.ID != ack.FileID || event.File.Metadata.ClientID != "cam-1" {
+				t.Errorf("got event %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook was not called")
+		}
+	})
+	t.Run("failures are retried", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+		store := blobstore.NewMemory()
+		file := putFile(t, store, "frame9.png", "cam-1", "png bytes")
+		p := newPipeline(store, []processor{webhookProcessor{url: server.URL, client: server.Client()}}, 3)
+		p.backoff = time.Millisecond
+		ok := hookRuns.value("webhook", "ok")
+
+		p.process(context.Background(), file)
+
+		if calls.Load() != 3 || hookRuns.value("webhook", "ok")-ok != 1 {
+			t.Errorf("webhook called %d times", calls.Load())
+		}
+	})
+	t.Run("permanent failures are not retried", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+		store := blobstore.NewMemory()
+		file := putFile(t, store, "frame9.png", "cam-1", "png bytes")
+		p := newPipeline(store, []processor{webhookProcessor{url: server.URL, client: server.Client()}}, 3)
+		failed := hookRuns.value("webhook", "failed")
+
+		p.process(context.Background(), file)
+
+		if calls.Load() != 1 || hookRuns.value("webhook", "failed")-failed != 1 {
+			t.Errorf("webhook called %d times", calls.Load())
+		}
+	})
+	t.Run("one failing processor does not stop the others", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		file := putFile(t, store, "frame9.png", "cam-1", "png bytes")
+		p := newPipeline(store, []processor{failingProcessor{}, hashProcessor{}}, 1)
+		p.backoff = time.Millisecond
+
+		p.process(context.Background(), file)
+
+		waitForProperties(t, store, file.ID, "md5")
+	})
+	t.Run("unknown processors and bad URLs are refused", func(t *testing.T) {
+		if _, err := newProcessors(&app{}, "dimensions,ocr", ""); err == nil {
+			t.Error("unknown processor accepted")
+		}
+		if _, err := newProcessors(&app{}, "", "ftp://example.com/hook"); err == nil {
+			t.Error("non-HTTP webhook accepted")
+		}
+	})
+}
+
+type failingProcessor struct{}
+
+func (failingProcessor) Name() string { return "failing" }
+
+func (failingProcessor) Process(ctx context.Context, file blobstore.FileInfo, content io.ReadSeeker) (map[string]string, error) {
+	return nil, errors.New("always fails")
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/filenames"
+	"example.com/hello/lucky2/protocol"
+)
+
+// maxChunkSize bounds a single session chunk, which is staged in memory and
+// stored as one MongoDB document.
+const maxChunkSize = 8 << 20
+
+// errDropConnection tells handleConnection that the stream can no longer be
+// parsed, e.g. because a frame's content was only partly consumed.
+var errDropConnection = errors.New("connection out of sync")
+
+var (
+	errServerClosing      = errors.New("server shutting down")
+	errTooManyConnections = errors.New("too many connections")
+)
+
+// ingestServer accepts uploads on the TCP ingest port.
+type ingestServer struct {
+	store    blobstore.BlobStore
+	sessions sessionStore
+	quota    retentionPolicy
+	limits   ingestLimits
+	limiter  *rateLimiter // nil when uploads are not rate limited
+	hooks    *pipeline    // nil when stored files are not processed
+	events   *eventBus    // nil when nobody listens for events
+	connIDs  atomic.Uint64
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*ingestConn]bool // true while a frame is being handled
+	closing  bool
+	active   sync.WaitGroup
+	ctx      context.Context // cancelled when shutdown gives up waiting
+	cancel   context.CancelFunc
+}
+
+// context returns the context storage calls are made with. It is cancelled
+// when shutdown stops waiting for uploads, which aborts them.
+func (s *ingestServer) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+// serve accepts connections on l until shutdown is called.
+func (s *ingestServer) serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			slog.Error("accepting ingest connection", "err", err)
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// shutdown stops accepting connections and closes idle ones. Frames being
+// handled may finish until ctx is done; then their connections are closed
+// and their uploads aborted, and ctx's error is returned.
+func (s *ingestServer) shutdown(ctx context.Context) error {
+	s.context()
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn, busy := range s.conns {
+		if !busy {
+			// Будим ReadFrame; соединение закроется само
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	s.cancel()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// track registers conn and starts its idle timeout. It fails if the
+// server is shutting down or already has as many connections as it may.
+func (s *ingestServer) track(conn *ingestConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return errServerClosing
+	}
+	if s.limits.MaxConnections > 0 && len(s.conns) >= s.limits.MaxConnections {
+		return errTooManyConnections
+	}
+	if s.conns == nil {
+		s.conns = map[*ingestConn]bool{}
+	}
+	s.conns[conn] = false
+	conn.idle = s.limits.IdleTimeout
+	conn.SetReadDeadline(conn.idleDeadline())
+	s.active.Add(1)
+	activeConnections.inc()
+	return nil
+}
+
+func (s *ingestServer) untrack(conn *ingestConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.active.Done()
+	activeConnections.add(-1)
+}
+
+// setBusy marks conn as handling a frame or not. A frame read before
+// shutdown began is still handled, within the transfer timeout; between
+// frames the idle timeout applies.
+func (s *ingestServer) setBusy(conn *ingestConn, busy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = busy
+	conn.receiving = busy
+	switch {
+	case busy:
+		conn.transferEnd = time.Time{}
+		if s.limits.TransferTimeout > 0 {
+			conn.transferEnd = time.Now().Add(s.limits.TransferTimeout)
+		}
+		// shutdown may have woken the read that returned this frame.
+		conn.SetReadDeadline(conn.transferEnd)
+	case !s.closing:
+		conn.SetReadDeadline(conn.idleDeadline())
+	}
+}
+
+func (s *ingestServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// ingestConn is a client connection together with the identity it proved
+// during the TLS handshake, if any, and a logger naming the connection.
+type ingestConn struct {
+	net.Conn
+	clientID string
+	log      *slog.Logger
+
+	idle        time.Duration
+	receiving   bool      // a frame is being handled
+	transferEnd time.Time // when its content must have arrived; zero for never
+}
+
+func (c *ingestConn) idleDeadline() time.Time {
+	if c.idle == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.idle)
+}
+
+// Read moves the read deadline along while a frame's content arrives: the
+// client may pause for the idle timeout at most, and must be done by the
+// end of the transfer timeout.
+func (c *ingestConn) Read(p []byte) (int, error) {
+	if c.receiving {
+		deadline := c.idleDeadline()
+		if deadline.IsZero() || (!c.transferEnd.IsZero() && c.transferEnd.Before(deadline)) {
+			deadline = c.transferEnd
+		}
+		c.Conn.SetReadDeadline(deadline)
+	}
+	return c.Conn.Read(p)
+}
+
+// isTimeout reports whether err comes from a passed deadline.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// header returns the upload header of frame. In mutual TLS mode the
+// certificate subject replaces whatever clientID the client declared.
+func (c *ingestConn) header(frame protocol.Frame) protocol.Header {
+	header := frame.Header()
+	if c.clientID != "" {
+		header.ClientID = c.clientID
+	}
+	return header
+}
+
+func (s *ingestServer) handleConnection(netConn net.Conn) {
+	defer netConn.Close()
+
+	log := slog.With("conn", s.connIDs.Add(1), "remote", netConn.RemoteAddr().String())
+	// Рукопожатие TLS тоже занимает соединение, поэтому считаем его до него
+	conn := &ingestConn{Conn: netConn, log: log}
+	if err := s.track(conn); err != nil {
+		if errors.Is(err, errTooManyConnections) {
+			log.Warn("ingest connection refused", "err", err)
+			// Over TLS the refusal needs a handshake too
+			conn.SetDeadline(time.Now().Add(handshakeTimeout))
+			reject(conn, protocol.StatusBusy, fmt.Sprintf("already serving %d connections", s.limits.MaxConnections))
+		}
+		return
+	}
+	defer s.untrack(conn)
+	clientID, err := peerClientID(netConn)
+	if err != nil {
+		if !s.isClosing() {
+			log.Warn("TLS handshake failed", "err", err)
+		}
+		return
+	}
+	if clientID != "" {
+		conn.clientID = clientID
+		conn.log = log.With("clientID", clientID)
+	}
+	// The handshake cleared the idle deadline
+	s.setBusy(conn, false)
+	if s.isClosing() {
+		return
+	}
+	conn.log.Debug("ingest connection opened")
+	defer conn.log.Debug("ingest connection closed")
+
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err == io.EOF {
+			return
+		}
+		if err != nil && s.isClosing() {
+			return
+		}
+		if isTimeout(err) {
+			conn.log.Info("closing idle ingest connection")
+			reject(conn, protocol.StatusTimeout, fmt.Sprintf("nothing received for %v", conn.idle))
+			return
+		}
+		if err != nil {
+			conn.log.Warn("reading frame", "err", err)
+			var versionErr protocol.VersionError
+			if errors.As(err, &versionErr) {
+				reject(conn, protocol.StatusUnsupportedVersion, err.Error())
+			} else {
+				reject(conn, protocol.StatusBadRequest, err.Error())
+			}
+			return
+		}
+
+		s.setBusy(conn, true)
+		switch frame.Type {
+		case protocol.TypeUpload:
+			err = s.handleUpload(conn, frame)
+		case protocol.TypeSessionOpen:
+			err = s.handleSessionOpen(conn, frame)
+		case protocol.TypeSessionChunk:
+			err = s.handleSessionChunk(conn, frame)
+		case protocol.TypeSessionStatus:
+			err = s.handleSessionStatus(conn, frame)
+		case protocol.TypeSessionCommit:
+			err = s.handleSessionCommit(conn, frame)
+		default:
+			reject(conn, protocol.StatusBadRequest, fmt.Sprintf("unexpected frame type %d", frame.Type))
+			return
+		}
+		s.setBusy(conn, false)
+		if err != nil || s.isClosing() {
+			return
+		}
+	}
+}
+
+// reject tells the client why its request was not carried out.
+func reject(conn *ingestConn, status protocol.Status, message string) {
+	sendRejection(conn, protocol.Ack{Status: status, Message: message})
+}
+
+// rejectAck sends err to the client if it is an Ack and reports any other
+// error as a storage failure.
+func rejectAck(conn *ingestConn, err error) {
+	var ack protocol.Ack
+	if !errors.As(err, &ack) {
+		ack = protocol.Ack{Status: protocol.StatusStorageError, Message: err.Error()}
+	}
+	sendRejection(conn, ack)
+}
+
+func sendRejection(conn *ingestConn, ack protocol.Ack) {
+	ingestRejections.inc(ack.Status.String())
+	if err := protocol.WriteAck(conn, ack); err != nil {
+		conn.log.Warn("sending ack", "err", err)
+	}
+}
+
+// validateHeader checks header and normalizes its filename.
+func validateHeader(header *protocol.Header) error {
+	filename, err := filenames.CleanFilePath(header.Filename)
+	if err != nil {
+		return protocol.Ack{Status: protocol.StatusBadRequest, Message: err.Error()}
+	}
+	header.Filename = filename
+	if header.ClientID == "" || len(header.ClientID) > maxClientIDLength {
+		return protocol.Ack{Status: protocol.StatusBadRequest, Message: fmt.Sprintf("clientID must be 1 to %d bytes", maxClientIDLength)}
+	}
+	if len(header.ContentType) > maxContentTypeLength {
+		return protocol.Ack{Status: protocol.StatusBadRequest, Message: fmt.Sprintf("content type must be at most %d bytes", maxContentTypeLength)}
+	}
+	if len(header.Checksum) != sha256.Size {
+		return protocol.Ack{Status: protocol.StatusBadRequest, Message: "missing or malformed SHA-256 checksum"}
+	}
+	return nil
+}
+
+func (s *ingestServer) handleUpload(conn *ingestConn, frame protocol.Frame) error {
+	header := conn.header(frame)
+	if err := validateHeader(&header); err != nil {
+		rejectAck(conn, err)
+		return errDropConnection
+	}
+
+	log := conn.log.With("file", header.Filename, "clientID", header.ClientID)
+	if err := s.checkLimits(conn, log, header.ClientID, frame.Length); err != nil {
+		rejectAck(conn, err)
+		return errDropConnection
+	}
+	if err := s.checkQuota(log, header.ClientID, frame.Length); err != nil {
+		rejectAck(conn, err)
+		return errDropConnection
+	}
+
+	log.Info("receiving upload", "size", frame.Length)
+	fileID, err := s.storeFile(log, header, conn, frame.Length)
+	if err != nil {
+		rejectAck(conn, err)
+		return errDropConnection
+	}
+	log.Info("upload stored", "id", fileID)
+	return protocol.WriteAck(conn, protocol.Ack{Status: protocol.StatusOK, FileID: fileID})
+}
+
+// checkQuota returns a StatusQuotaExceeded ack if clientID may not store
+// size more bytes.
+func (s *ingestServer) checkQuota(log *slog.Logger, clientID string, size int64) error {
+	err := s.quota.checkQuota(s.context(), s.store, clientID, size)
+	if errors.Is(err, errOverQuota) {
+		log.Warn("upload refused", "err", err)
+		return protocol.Ack{Status: protocol.StatusQuotaExceeded, Message: err.Error()}
+	}
+	return err
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyingReader hashes what it reads and fails at the end of the content
+// when fewer than length bytes arrived or the SHA-256 does not match, so the
+// store aborts the upload before it becomes visible.
+type verifyingReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	want   []byte
+	length int64
+	read   int64
+	err    error
+}
+
+func newVerifyingReader(r io.Reader, length int64, want []byte) *verifyingReader {
+	return &verifyingReader{r: io.LimitReader(r, length), hash: sha256.New(), want: want, length: length}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	v.read += int64(n)
+	switch {
+	case err == io.EOF && v.read < v.length:
+		err = io.ErrUnexpectedEOF
+	case err == io.EOF && !bytes.Equal(v.hash.Sum(nil), v.want):
+		err = errChecksumMismatch
+	}
+	if err != nil && err != io.EOF {
+		v.err = err
+	}
+	return n, err
+}
+
+// storeFile streams length bytes from src into the file store, verifying
+// them on the way and recording their sniffed MIME type. Failures are returned as protocol.Ack values.
+func (s *ingestServer) storeFile(log *slog.Logger, header protocol.Header, src io.Reader, length int64) (id string, err error) {
+	verified := newVerifyingReader(src, length, header.Checksum)
+	contentType, content := sniffContentType(verified, header.ContentType)
+	meta := blobstore.Metadata{
+		ClientID:    header.ClientID,
+		ContentType: contentType,
+		SHA256:      hex.EncodeToString(header.Checksum),
+	}
+	upload := blobstore.FileInfo{Name: header.Filename, Size: length, Metadata: meta}
+	timer := startUpload("ingest")
+	s.events.publish(event{Type: eventUploadStarted, File: upload})
+	defer func() {
+		timer.done(length, err)
+		if err != nil {
+			s.events.publish(event{Type: eventUploadFailed, File: upload, Error: err.Error()})
+		}
+	}()
+
+	info, err := s.store.Put(s.context(), header.Filename, meta, content)
+	switch {
+	case err == nil:
+		s.events.publish(event{Type: eventUploadCompleted, File: info})
+		s.hooks.submit(info)
+		return info.ID, nil
+	case errors.Is(verified.err, errChecksumMismatch):
+		sum := hex.EncodeToString(verified.hash.Sum(nil))
+		log.Warn("checksum mismatch", "got", sum, "want", hex.EncodeToString(header.Checksum))
+		return "", protocol.Ack{Status: protocol.StatusChecksumMismatch, Message: "SHA-256 of received data is " + sum}
+	case errors.Is(err, blobstore.ErrDuplicate):
+		return "", protocol.Ack{Status: protocol.StatusDuplicate, Message: header.Filename + " is already stored"}
+	case isTimeout(verified.err):
+		log.Warn("upload timed out", "received", verified.read)
+		return "", protocol.Ack{Status: protocol.StatusTimeout, Message: fmt.Sprintf("received %d of %d bytes in time", verified.read, length)}
+	case verified.err != nil:
+		log.Warn("upload interrupted", "err", verified.err, "received", verified.read)
+		return "", protocol.Ack{Status: protocol.StatusIncomplete, Message: fmt.Sprintf("received %d of %d bytes", verified.read, length)}
+	default:
+		log.Error("storing upload", "err", err)
+		return "", protocol.Ack{Status: protocol.StatusStorageError, Message: "could not store upload"}
+	}
+}
+
+func (s *ingestServer) handleSessionOpen(conn *ingestConn, frame protocol.Frame) error {
+	if frame.Length != 0 {
+		reject(conn, protocol.StatusBadRequest, "session open frame carries no content")
+		return errDropConnection
+	}
+	header := conn.header(frame)
+	if err := validateHeader(&header); err != nil {
+		rejectAck(conn, err)
+		return nil
+	}
+	size, okSize := frame.Fields.Uint64(protocol.FieldSize)
+	chunkSize, okChunk := frame.Fields.Uint64(protocol.FieldChunkSize)
+	if !okSize || !okChunk || chunkSize == 0 || chunkSize > maxChunkSize || size > 1<<62 {
+		reject(conn, protocol.StatusBadRequest, fmt.Sprintf("size and a chunk size of at most %d bytes are required", maxChunkSize))
+		return nil
+	}
+
+	log := conn.log.With("file", header.Filename, "clientID", header.ClientID)
+	if err := s.checkLimits(conn, log, header.ClientID, int64(size)); err != nil {
+		rejectAck(conn, err)
+		return nil
+	}
+	if err := s.checkQuota(log, header.ClientID, int64(size)); err != nil {
+		rejectAck(conn, err)
+		return nil
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		rejectAck(conn, err)
+		return nil
+	}
+	session := uploadSession{
+		ID:          id,
+		Filename:    header.Filename,
+		ClientID:    header.ClientID,
+		ContentType: header.ContentType,
+		Checksum:    header.Checksum,
+		Size:        int64(size),
+		ChunkSize:   int64(chunkSize),
+	}
+	if err := s.sessions.Create(s.context(), session); err != nil {
+		log.Error("creating upload session", "err", err)
+		rejectAck(conn, err)
+		return nil
+	}
+
+	log.Info("upload session opened", "session", id, "size", size)
+	return protocol.WriteAck(conn, protocol.Ack{
+		Status: protocol.StatusOK,
+		Fields: protocol.Fields{protocol.FieldUploadID: []byte(id)},
+	})
+}
+
+// loadSession looks up the session named in frame and reports a missing one
+// to the client.
+func (s *ingestServer) loadSession(conn *ingestConn, frame protocol.Frame) (uploadSession, bool) {
+	session, err := s.sessions.Get(s.context(), frame.Fields.String(protocol.FieldUploadID))
+	if errors.Is(err, errUnknownSession) {
+		reject(conn, protocol.StatusUnknownSession, "upload session expired or never existed")
+		return uploadSession{}, false
+	}
+	if err != nil {
+		conn.log.Error("loading upload session", "err", err)
+		rejectAck(conn, err)
+		return uploadSession{}, false
+	}
+	return session, true
+}
+
+func (s *ingestServer) handleSessionChunk(conn *ingestConn, frame protocol.Frame) error {
+	session, ok := s.loadSession(conn, frame)
+	if !ok {
+		return errDropConnection
+	}
+	n, ok := frame.Fields.Uint64(protocol.FieldChunk)
+	if !ok || n >= uint64(session.chunkCount()) {
+		reject(conn, protocol.StatusBadRequest, fmt.Sprintf("chunk number must be below %d", session.chunkCount()))
+		return errDropConnection
+	}
+	if want := session.chunkLen(uint32(n)); frame.Length != want {
+		reject(conn, protocol.StatusBadRequest, fmt.Sprintf("chunk %d must be %d bytes", n, want))
+		return errDropConnection
+	}
+
+	data := make([]byte, frame.Length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		conn.log.Warn("reading chunk", "session", session.ID, "chunk", n, "err", err)
+		if isTimeout(err) {
+			reject(conn, protocol.StatusTimeout, fmt.Sprintf("chunk %d did not arrive in time", n))
+		}
+		return errDropConnection
+	}
+	if err := s.sessions.PutChunk(s.context(), session.ID, uint32(n), data); err != nil {
+		conn.log.Error("storing chunk", "session", session.ID, "chunk", n, "err", err)
+		rejectAck(conn, err)
+		return nil
+	}
+	return protocol.WriteAck(conn, protocol.Ack{Status: protocol.StatusOK})
+}
+
+func (s *ingestServer) handleSessionStatus(conn *ingestConn, frame protocol.Frame) error {
+	session, ok := s.loadSession(conn, frame)
+	if !ok {
+		return nil
+	}
+	return protocol.WriteAck(conn, protocol.Ack{
+		Status: protocol.StatusOK,
+		Fields: protocol.Fields{protocol.FieldChunks: protocol.EncodeChunks(session.Received)},
+	})
+}
+
+func (s *ingestServer) handleSessionCommit(conn *ingestConn, frame protocol.Frame) error {
+	session, ok := s.loadSession(conn, frame)
+	if !ok {
+		return nil
+	}
+	if missing := session.missing(); missing > 0 {
+		reject(conn, protocol.StatusIncomplete, fmt.Sprintf("%d of %d chunks missing", missing, session.chunkCount()))
+		return nil
+	}
+
+	header := protocol.Header{
+		Filename:    session.Filename,
+		ClientID:    session.ClientID,
+		ContentType: session.ContentType,
+		Checksum:    session.Checksum,
+	}
+	// Квота могла закончиться, пока загружались части
+	log := conn.log.With("session", session.ID, "file", session.Filename, "clientID", session.ClientID)
+	if err := s.checkQuota(log, session.ClientID, session.Size); err != nil {
+		rejectAck(conn, err)
+		return nil
+	}
+	ctx := s.context()
+	src := &sessionReader{ctx: ctx, store: s.sessions, session: session}
+	fileID, err := s.storeFile(log, header, src, session.Size)
+	if err != nil {
+		rejectAck(conn, err)
+		return nil
+	}
+	if err := s.sessions.Delete(ctx, session.ID); err != nil {
+		log.Error("deleting upload session", "err", err)
+	}
+
+	log.Info("upload session committed", "id", fileID)
+	return protocol.WriteAck(conn, protocol.Ack{Status: protocol.StatusOK, FileID: fileID})
+}
+
+// expireSessions discards abandoned upload sessions every interval until
+// ctx is done.
+func (s *ingestServer) expireSessions(ctx context.Context, ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := s.sessions.Expire(ctx, time.Now().Add(-ttl))
+		if err != nil {
+			slog.Error("expiring upload sessions", "err", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("expired abandoned upload sessions", "count", n)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/protocol"
+)
+
+func hexString(b []byte) string {
+	return hex.EncodeToString(b)
+}
+
+// dialIngest connects a client to ingest over loopback TCP.
+func dialIngest(t testing.TB, ingest *ingestServer) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assertNoError(t, err)
+	server, err := listener.Accept()
+	assertNoError(t, err)
+	go ingest.handleConnection(server)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func uploadOverTCP(t testing.TB, ingest *ingestServer, name, clientID, content string) protocol.Ack {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	header := protocol.Header{Filename: name, ClientID: clientID, Checksum: sum[:]}
+	ack, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader(content), int64(len(content)))
+	assertNoError(t, err)
+	return ack
+}
+
+func TestIngestUpload(t *testing.T) {
+	t.Run("stored file carries the client's metadata", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+
+		ack := uploadOverTCP(t, ingest, "frame9.png", "cam-1", "png bytes")
+
+		info, err := store.Stat(context.Background(), ack.FileID)
+		assertNoError(t, err)
+		sum := sha256.Sum256([]byte("png bytes"))
+		if info.Metadata.ClientID != "cam-1" || info.Metadata.SHA256 != hexString(sum[:]) {
+			t.Errorf("got metadata %+v", info.Metadata)
+		}
+	})
+	t.Run("checksum mismatch stores nothing", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+		sum := sha256.Sum256([]byte("something else"))
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+
+		_, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader("png bytes"), 9)
+
+		assertAckStatus(t, err, protocol.StatusChecksumMismatch)
+		assertFileCount(t, store, 0)
+	})
+	t.Run("missing clientID is rejected", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+		sum := sha256.Sum256([]byte("png bytes"))
+		header := protocol.Header{Filename: "frame9.png", Checksum: sum[:]}
+
+		_, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader("png bytes"), 9)
+
+		assertAckStatus(t, err, protocol.StatusBadRequest)
+		assertFileCount(t, store, 0)
+	})
+	t.Run("folder names are normalized", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+
+		ack := uploadOverTCP(t, ingest, `/cam-1\2024-03-01//./frame9.png`, "cam-1", "png bytes")
+
+		info, err := store.Stat(context.Background(), ack.FileID)
+		assertNoError(t, err)
+		if info.Name != "cam-1/2024-03-01/frame9.png" {
+			t.Errorf("got name %q", info.Name)
+		}
+	})
+	t.Run("names escaping their folder are rejected", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+		sum := sha256.Sum256([]byte("png bytes"))
+		header := protocol.Header{Filename: "cam-1/../../etc/passwd", ClientID: "cam-1", Checksum: sum[:]}
+
+		_, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader("png bytes"), 9)
+
+		assertAckStatus(t, err, protocol.StatusBadRequest)
+		assertFileCount(t, store, 0)
+	})
+}
+
+func TestIngestSession(t *testing.T) {
+	store := blobstore.NewMemory()
+	ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+	content := []byte("0123456789")
+	sum := sha256.Sum256(content)
+	header := protocol.Header{Filename: "big.png", ClientID: "cam-1", Checksum: sum[:]}
+
+	conn := dialIngest(t, ingest)
+	id, err := protocol.OpenSession(conn, header, int64(len(content)), 4)
+	assertNoError(t, err)
+	assertNoError(t, protocol.SendChunk(conn, id, 2, content[8:]))
+	assertNoError(t, protocol.SendChunk(conn, id, 0, content[:4]))
+
+	t.Run("commit with missing chunks is refused", func(t *testing.T) {
+		_, err := protocol.CommitSession(conn, id)
+		assertAckStatus(t, err, protocol.StatusIncomplete)
+		assertFileCount(t, store, 0)
+	})
+
+	// Reconnect as if the first connection dropped.
+	conn = dialIngest(t, ingest)
+
+	t.Run("status lists persisted chunks", func(t *testing.T) {
+		chunks, err := protocol.SessionChunks(conn, id)
+		assertNoError(t, err)
+		if len(chunks) != 2 || chunks[0] != 0 || chunks[1] != 2 {
+			t.Errorf("got chunks %v want [0 2]", chunks)
+		}
+	})
+	t.Run("commit assembles the file", func(t *testing.T) {
+		assertNoError(t, protocol.SendChunk(conn, id, 1, content[4:8]))
+
+		ack, err := protocol.CommitSession(conn, id)
+		assertNoError(t, err)
+
+		r, _, err := store.Get(context.Background(), ack.FileID)
+		assertNoError(t, err)
+		var got bytes.Buffer
+		got.ReadFrom(r)
+		if got.String() != string(content) {
+			t.Errorf("got %q want %q", got.String(), content)
+		}
+	})
+	t.Run("committed session is gone", func(t *testing.T) {
+		_, err := protocol.SessionChunks(conn, id)
+		assertAckStatus(t, err, protocol.StatusUnknownSession)
+	})
+}
+
+func TestIngestRejectsDuplicates(t *testing.T) {
+	store := blobstore.WithVersionPolicy(blobstore.NewMemory(), blobstore.VersionPolicy{RejectDuplicates: true})
+	ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+	uploadOverTCP(t, ingest, "frame9.png", "cam-1", "first")
+
+	sum := sha256.Sum256([]byte("second"))
+	header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+	_, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader("second"), 6)
+
+	assertAckStatus(t, err, protocol.StatusDuplicate)
+	assertFileCount(t, store, 1)
+}
+
+func assertAckStatus(t testing.TB, err error, want protocol.Status) {
+	t.Helper()
+	var ack protocol.Ack
+	if !errors.As(err, &ack) || ack.Status != want {
+		t.Errorf("got %v want status %v", err, want)
+	}
+}
+
+func assertFileCount(t testing.TB, store blobstore.BlobStore, want int) {
+	t.Helper()
+	files, err := store.List(context.Background(), blobstore.Query{})
+	assertNoError(t, err)
+	if len(files) != want {
+		t.Errorf("got %d files want %d", len(files), want)
+	}
+}
+
+// serveIngest runs ingest on a local port and returns its address.
+func serveIngest(t testing.TB, ingest *ingestServer) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoError(t, err)
+	go ingest.serve(listener)
+	return listener.Addr().String()
+}
+
+// waitForConn waits until ingest has taken a connection, and with busy
+// set, until it is handling a frame on it.
+func waitForConn(t testing.TB, ingest *ingestServer, busy bool) {
+	t.Helper()
+	for range 200 {
+		ingest.mu.Lock()
+		found := false
+		for _, handling := range ingest.conns {
+			found = found || handling || !busy
+		}
+		ingest.mu.Unlock()
+		if found {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("connection never became ready")
+}
+
+func TestIngestShutdown(t *testing.T) {
+	t.Run("idle connections are closed and no new ones accepted", func(t *testing.T) {
+		ingest := &ingestServer{store: blobstore.NewMemory(), sessions: newInMemorySessionStore()}
+		address := serveIngest(t, ingest)
+		conn, err := net.Dial("tcp", address)
+		assertNoError(t, err)
+		defer conn.Close()
+		waitForConn(t, ingest, false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assertNoError(t, ingest.shutdown(ctx))
+
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("got %v from idle connection, want EOF", err)
+		}
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			t.Error("connection accepted after shutdown")
+		}
+	})
+	t.Run("upload in flight is finished", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+		conn, err := net.Dial("tcp", serveIngest(t, ingest))
+		assertNoError(t, err)
+		defer conn.Close()
+		content, rest := io.Pipe()
+		sum := sha256.Sum256([]byte("png bytes"))
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+		acks := make(chan protocol.Ack)
+		go func() {
+			ack, _ := protocol.Upload(conn, header, content, 9)
+			acks <- ack
+		}()
+		rest.Write([]byte("png "))
+		waitForConn(t, ingest, true)
+
+		shutdownErr := make(chan error)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			shutdownErr <- ingest.shutdown(ctx)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		rest.Write([]byte("bytes"))
+		rest.Close()
+
+		if ack := <-acks; ack.Status != protocol.StatusOK {
+			t.Errorf("got ack %v", ack)
+		}
+		assertNoError(t, <-shutdownErr)
+		assertFileCount(t, store, 1)
+	})
+	t.Run("uploads past the deadline are aborted", func(t *testing.T) {
+		store := blobstore.NewMemory()
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+		conn, err := net.Dial("tcp", serveIngest(t, ingest))
+		assertNoError(t, err)
+		defer conn.Close()
+		sum := sha256.Sum256([]byte("png bytes"))
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+		assertNoError(t, protocol.WriteFrame(conn, protocol.UploadFrame(header, 9)))
+		conn.Write([]byte("png "))
+		waitForConn(t, ingest, true)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := ingest.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+		}
+		assertFileCount(t, store, 0)
+	})
+}
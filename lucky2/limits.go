@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"example.com/hello/lucky2/protocol"
+)
+
+// Bounds on the header fields of an upload, beyond the filename's.
+const (
+	maxClientIDLength    = 128
+	maxContentTypeLength = 255
+)
+
+// ingestLimits protects the ingest port from slow, oversized and
+// overeager clients. Zero values turn a limit off.
+type ingestLimits struct {
+	// IdleTimeout is how long a client may send nothing, whether between
+	// frames or in the middle of one.
+	IdleTimeout time.Duration
+	// TransferTimeout is how long the content of one frame may take to
+	// arrive.
+	TransferTimeout time.Duration
+	MaxFileSize     int64
+	MaxConnections  int
+	// Rate is how many uploads a second each key may start after using up
+	// Burst. RateKey is "ip" or "clientID".
+	Rate    float64
+	Burst   int
+	RateKey string
+}
+
+// registerFlags binds l to command line flags on fs.
+func (l *ingestLimits) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&l.IdleTimeout, "ingest-idle-timeout", 2*time.Minute, "how long an ingest client may send nothing; 0 waits forever")
+	fs.DurationVar(&l.TransferTimeout, "ingest-transfer-timeout", time.Hour, "how long one upload or chunk may take to arrive; 0 is unlimited")
+	fs.Int64Var(&l.MaxFileSize, "max-file-size", 0, "largest file accepted on the ingest port and from browsers, in bytes; 0 is unlimited")
+	fs.IntVar(&l.MaxConnections, "max-connections", 256, "open ingest connections allowed at once; 0 is unlimited")
+	fs.Float64Var(&l.Rate, "rate-limit", 0, "uploads a second each IP or client ID may start; 0 is unlimited")
+	fs.IntVar(&l.Burst, "rate-burst", 10, "uploads an IP or client ID may start at once before -rate-limit applies")
+	fs.StringVar(&l.RateKey, "rate-key", "ip", `what -rate-limit counts uploads by: "ip" or "clientID"`)
+}
+
+func (l ingestLimits) validate() error {
+	switch {
+	case l.IdleTimeout < 0 || l.TransferTimeout < 0:
+		return errors.New("ingest timeouts must not be negative")
+	case l.MaxFileSize < 0 || l.MaxConnections < 0:
+		return errors.New("-max-file-size and -max-connections must not be negative")
+	case l.Rate < 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate):
+		return errors.New("-rate-limit must be a non-negative number")
+	case l.Rate > 0 && l.Burst < 1:
+		return errors.New("-rate-burst must be at least 1")
+	case l.RateKey != "ip" && l.RateKey != "clientID":
+		return fmt.Errorf(`-rate-key must be "ip" or "clientID", not %q`, l.RateKey)
+	}
+	return nil
+}
+
+// rateKey returns what uploads on conn for clientID are counted by.
+func (l ingestLimits) rateKey(conn net.Conn, clientID string) string {
+	if l.RateKey == "clientID" {
+		return clientID
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// maxBuckets is how many keys a rateLimiter tracks at most. When it needs
+// room it forgets the keys whose buckets have filled up again or, if every
+// key is busy, the one that went unused longest.
+const maxBuckets = 10000
+
+// rateLimiter is a token bucket per key: each key may take burst tokens
+// at once, and gets rate tokens back a second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}}
+}
+
+// allow takes a token for key. If there is none it reports false and how
+// long until there is.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.makeRoom(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// makeRoom drops the buckets that have refilled, as a new bucket for the
+// same key starts full anyway. If none has, it drops the least recently
+// used bucket, which gives that key a full burst again.
+func (l *rateLimiter) makeRoom(now time.Time) {
+	var oldest string
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		} else if oldest == "" || b.last.Before(l.buckets[oldest].last) {
+			oldest = key
+		}
+	}
+	if len(l.buckets) >= maxBuckets {
+		delete(l.buckets, oldest)
+	}
+}
+
+// checkLimits returns an ack refusing an upload of size bytes for clientID
+// on conn if it is too large or the client is over its rate.
+func (s *ingestServer) checkLimits(conn *ingestConn, log *slog.Logger, clientID string, size int64) error {
+	if s.limits.MaxFileSize > 0 && size > s.limits.MaxFileSize {
+		log.Warn("upload refused", "size", size, "maxFileSize", s.limits.MaxFileSize)
+		return protocol.Ack{Status: protocol.StatusTooLarge, Message: fmt.Sprintf("files may be at most %d bytes", s.limits.MaxFileSize)}
+	}
+	if s.limiter == nil {
+		return nil
+	}
+	key := s.limits.rateKey(conn, clientID)
+	if ok, wait := s.limiter.allow(key, time.Now()); !ok {
+		log.Warn("upload rate limited", "key", key, "retryAfter", wait)
+		ack := protocol.Ack{Status: protocol.StatusRateLimited, Message: "too many uploads from " + key, Fields: protocol.Fields{}}
+		ack.Fields.SetUint64(protocol.FieldRetryAfter, uint64(wait.Milliseconds())+1)
+		return ack
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/protocol"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, 2)
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	for i := range 2 {
+		if ok, _ := limiter.allow("10.0.0.1", now); !ok {
+			t.Fatalf("upload %d of the burst was refused", i+1)
+		}
+	}
+	ok, wait := limiter.allow("10.0.0.1", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("got %v, retry after %v; want refused, retry after 500ms", ok, wait)
+	}
+	if ok, _ := limiter.allow("10.0.0.2", now); !ok {
+		t.Error("another key was refused")
+	}
+	if ok, _ := limiter.allow("10.0.0.1", now.Add(500*time.Millisecond)); !ok {
+		t.Error("refused after the bucket refilled")
+	}
+}
+
+func TestRateLimiterBound(t *testing.T) {
+	limiter := newRateLimiter(0.001, 1)
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	// Every key has used its only token, so none has refilled.
+	for i := range maxBuckets + 10 {
+		limiter.allow(fmt.Sprintf("10.0.%d.%d", i/256, i%256), start.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	if len(limiter.buckets) > maxBuckets {
+		t.Errorf("tracking %d keys, more than %d", len(limiter.buckets), maxBuckets)
+	}
+	if _, ok := limiter.buckets["10.0.0.0"]; ok {
+		t.Error("the least recently used key was kept")
+	}
+	if ok, _ := limiter.allow(fmt.Sprintf("10.0.%d.%d", (maxBuckets+9)/256, (maxBuckets+9)%256), start.Add(time.Minute)); ok {
+		t.Error("the newest busy key was forgotten")
+	}
+}
+
+func TestIngestLimits(t *testing.T) {
+	newIngest := func(limits ingestLimits) (*ingestServer, blobstore.BlobStore) {
+		store := blobstore.NewMemory()
+		ingest := &ingestServer{store: store, sessions: newInMemorySessionStore(), limits: limits}
+		if limits.Rate > 0 {
+			ingest.limiter = newRateLimiter(limits.Rate, limits.Burst)
+		}
+		return ingest, store
+	}
+	upload := func(t *testing.T, ingest *ingestServer, header protocol.Header, content string) error {
+		t.Helper()
+		sum := sha256.Sum256([]byte(content))
+		header.Checksum = sum[:]
+		_, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader(content), int64(len(content)))
+		return err
+	}
+
+	t.Run("file too large", func(t *testing.T) {
+		ingest, store := newIngest(ingestLimits{MaxFileSize: 4})
+
+		err := upload(t, ingest, protocol.Header{Filename: "frame9.png", ClientID: "cam-1"}, "png bytes")
+
+		assertAckStatus(t, err, protocol.StatusTooLarge)
+		assertFileCount(t, store, 0)
+	})
+	t.Run("session too large", func(t *testing.T) {
+		ingest, _ := newIngest(ingestLimits{MaxFileSize: 4})
+		sum := sha256.Sum256([]byte("png bytes"))
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+
+		_, err := protocol.OpenSession(dialIngest(t, ingest), header, 9, 3)
+
+		assertAckStatus(t, err, protocol.StatusTooLarge)
+	})
+	t.Run("header fields out of bounds", func(t *testing.T) {
+		ingest, _ := newIngest(ingestLimits{})
+
+		err := upload(t, ingest, protocol.Header{Filename: "frame9.png", ClientID: strings.Repeat("c", maxClientIDLength+1)}, "png")
+		assertAckStatus(t, err, protocol.StatusBadRequest)
+
+		err = upload(t, ingest, protocol.Header{Filename: "frame9.png", ClientID: "cam-1", ContentType: strings.Repeat("t", maxContentTypeLength+1)}, "png")
+		assertAckStatus(t, err, protocol.StatusBadRequest)
+	})
+	t.Run("rate limited", func(t *testing.T) {
+		ingest, store := newIngest(ingestLimits{Rate: 0.01, Burst: 1, RateKey: "clientID"})
+		assertNoError(t, upload(t, ingest, protocol.Header{Filename: "a.png", ClientID: "cam-1"}, "a"))
+
+		err := upload(t, ingest, protocol.Header{Filename: "b.png", ClientID: "cam-1"}, "b")
+
+		assertAckStatus(t, err, protocol.StatusRateLimited)
+		if ack, _ := err.(protocol.Ack); ack.RetryAfter() < time.Minute {
+			t.Errorf("got retry after %v want about 100s", ack.RetryAfter())
+		}
+		assertNoError(t, upload(t, ingest, protocol.Header{Filename: "c.png", ClientID: "cam-2"}, "c"))
+		assertFileCount(t, store, 2)
+	})
+	t.Run("idle connection", func(t *testing.T) {
+		ingest, _ := newIngest(ingestLimits{IdleTimeout: 50 * time.Millisecond})
+
+		assertNextAck(t, dialIngest(t, ingest), protocol.StatusTimeout)
+	})
+	t.Run("stalled upload", func(t *testing.T) {
+		ingest, store := newIngest(ingestLimits{IdleTimeout: 50 * time.Millisecond})
+		conn := dialIngest(t, ingest)
+		sum := sha256.Sum256([]byte("png bytes"))
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+		assertNoError(t, protocol.WriteFrame(conn, protocol.UploadFrame(header, 9)))
+		conn.Write([]byte("png"))
+
+		assertNextAck(t, conn, protocol.StatusTimeout)
+		assertFileCount(t, store, 0)
+	})
+	t.Run("transfer deadline", func(t *testing.T) {
+		ingest, store := newIngest(ingestLimits{IdleTimeout: time.Minute, TransferTimeout: 100 * time.Millisecond})
+		conn := dialIngest(t, ingest)
+		sum := sha256.Sum256([]byte("png bytes"))
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+		assertNoError(t, protocol.WriteFrame(conn, protocol.UploadFrame(header, 9)))
+		// Дробные посылки сбрасывают простой, но не общий срок
+		for range 3 {
+			conn.Write([]byte("p"))
+			time.Sleep(40 * time.Millisecond)
+		}
+
+		assertNextAck(t, conn, protocol.StatusTimeout)
+		assertFileCount(t, store, 0)
+	})
+	t.Run("too many connections", func(t *testing.T) {
+		ingest, _ := newIngest(ingestLimits{MaxConnections: 1})
+		dialIngest(t, ingest)
+		waitForConn(t, ingest, false)
+
+		assertNextAck(t, dialIngest(t, ingest), protocol.StatusBusy)
+	})
+}
+
+// assertNextAck reads an ack the server sends without being asked.
+func assertNextAck(t testing.TB, conn io.Reader, want protocol.Status) {
+	t.Helper()
+	ack, err := protocol.ReadAck(conn)
+	assertNoError(t, err)
+	if ack.Status != want {
+		t.Errorf("got %v want status %v", ack, want)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/filenames"
+)
+
+// listing is a page of the file listing as asked for in the query string.
+type listing struct {
+	Query   blobstore.Query
+	Page    int
+	PerPage int
+}
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// dateLayout is how the from and to parameters give days.
+const dateLayout = "2006-01-02"
+
+// parseListing reads the listing parameters shared by /files and the API:
+//
+//	dir       folder to list; only files directly in it unless recursive is set
+//	name      substring of the name, or a glob if it has *, ? or [
+//	clientID  uploader client
+//	type      media type, or a family like "image/"
+//	from, to  upload days, inclusive, as YYYY-MM-DD or RFC 3339 times
+//	minSize, maxSize  size bounds in bytes
+//	sort      date, name or size; order  asc or desc
+//	page, per_page
+func parseListing(values url.Values) (listing, error) {
+	l := listing{Page: 1, PerPage: defaultPerPage}
+	q := &l.Query
+	var err error
+
+	if q.Folder, err = filenames.CleanPath(values.Get("dir")); err != nil {
+		return listing{}, fmt.Errorf("dir: %w", err)
+	}
+	q.Flat = values.Get("recursive") == ""
+	if name := values.Get("name"); strings.ContainsAny(name, "*?[") {
+		q.NameGlob = name
+	} else {
+		q.NameContains = name
+	}
+	if clientID := values.Get("clientID"); clientID != "" {
+		q.ClientIDs = []string{clientID}
+	}
+	q.ContentType = values.Get("type")
+	if q.UploadedAfter, err = parseDay(values.Get("from"), false); err != nil {
+		return listing{}, fmt.Errorf("from: %w", err)
+	}
+	if q.UploadedBefore, err = parseDay(values.Get("to"), true); err != nil {
+		return listing{}, fmt.Errorf("to: %w", err)
+	}
+	if q.MinSize, err = parseSize(values.Get("minSize")); err != nil {
+		return listing{}, fmt.Errorf("minSize: %w", err)
+	}
+	if q.MaxSize, err = parseSize(values.Get("maxSize")); err != nil {
+		return listing{}, fmt.Errorf("maxSize: %w", err)
+	}
+
+	switch sort := values.Get("sort"); sort {
+	case "", blobstore.SortDate, blobstore.SortName, blobstore.SortSize:
+		q.Sort = sort
+	default:
+		return listing{}, fmt.Errorf("sort must be date, name or size")
+	}
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		return listing{}, fmt.Errorf("order must be asc or desc")
+	}
+
+	if l.Page, err = positiveParam(values, "page", 1); err != nil {
+		return listing{}, err
+	}
+	if l.PerPage, err = positiveParam(values, "per_page", defaultPerPage); err != nil {
+		return listing{}, err
+	}
+	l.PerPage = min(l.PerPage, maxPerPage)
+	return l, nil
+}
+
+// parseDay parses a day or a time. With end set, a bare day is taken to
+// mean up to the end of that day.
+func parseDay(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation(dateLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("want YYYY-MM-DD")
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("want a number of bytes")
+	}
+	return n, nil
+}
+
+// positiveParam reads a positive integer query parameter.
+func positiveParam(values url.Values, name string, fallback int) (int, error) {
+	s := values.Get(name)
+	if s == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+// list returns the page of files l selects among those u may see, and how
+// many files there are on all pages and how much they take up.
+func (a *app) list(ctx context.Context, u user, l listing) ([]blobstore.FileInfo, blobstore.Usage, error) {
+	q := visibleQuery(u, l.Query)
+	usage, err := a.files.Usage(ctx, q)
+	if err != nil {
+		return nil, blobstore.Usage{}, err
+	}
+	q.Offset = (l.Page - 1) * l.PerPage
+	q.Limit = l.PerPage
+	files, err := a.files.List(ctx, q)
+	if err != nil {
+		return nil, blobstore.Usage{}, err
+	}
+	return files, usage, nil
+}
+
+// folders returns the subfolders of the listed folder that hold files l
+// selects, or none when l lists every subfolder's files already.
+func (a *app) folders(ctx context.Context, u user, l listing) ([]string, error) {
+	if !l.Query.Flat {
+		return []string{}, nil
+	}
+	folders, err := a.files.Folders(ctx, visibleQuery(u, l.Query))
+	if folders == nil && err == nil {
+		folders = []string{}
+	}
+	return folders, err
+}
+
+// pages is the number of pages total files fill.
+func (l listing) pages(total int) int {
+	return max((total+l.PerPage-1)/l.PerPage, 1)
+}
+
+// pageURL returns target with values, on page.
+func pageURL(target string, values url.Values, page int) string {
+	values = cloneValues(values)
+	values.Set("page", strconv.Itoa(page))
+	return target + "?" + values.Encode()
+}
+
+func cloneValues(values url.Values) url.Values {
+	clone := url.Values{}
+	for key, v := range values {
+		clone[key] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// pageGroups groups the files of a listing page by name. Each group holds
+// every revision of its name that u may see, not just those on the page, so
+// revision numbers stay the same on every page and under every filter.
+func (a *app) pageGroups(ctx context.Context, u user, files []blobstore.FileInfo) ([]fileGroup, error) {
+	var groups []fileGroup
+	seen := map[string]bool{}
+	for _, file := range files {
+		if seen[file.Name] {
+			continue
+		}
+		seen[file.Name] = true
+		revisions, err := a.visibleRevisions(ctx, u, file.Name)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, groupRevisions(revisions)...)
+	}
+	return groups, nil
+}
+
+// typeFilters are the content types the file manager offers to filter by.
+var typeFilters = map[string]string{
+	"image/":          "Изображения",
+	"text/":           "Текст",
+	"application/pdf": "PDF",
+	"video/":          "Видео",
+	"audio/":          "Аудио",
+}
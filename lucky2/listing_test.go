@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+)
+
+func TestParseListing(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		l, err := parseListing(url.Values{})
+		assertNoError(t, err)
+		if l.Page != 1 || l.PerPage != defaultPerPage || l.Query.Sort != "" || l.Query.Ascending {
+			t.Errorf("got %+v", l)
+		}
+	})
+	t.Run("name is a glob only with wildcards", func(t *testing.T) {
+		l, _ := parseListing(url.Values{"name": {"frame*.png"}})
+		if l.Query.NameGlob != "frame*.png" || l.Query.NameContains != "" {
+			t.Errorf("got glob %q contains %q", l.Query.NameGlob, l.Query.NameContains)
+		}
+		l, _ = parseListing(url.Values{"name": {"frame"}})
+		if l.Query.NameGlob != "" || l.Query.NameContains != "frame" {
+			t.Errorf("got glob %q contains %q", l.Query.NameGlob, l.Query.NameContains)
+		}
+	})
+	t.Run("to includes the whole day", func(t *testing.T) {
+		l, err := parseListing(url.Values{"from": {"2024-03-01"}, "to": {"2024-03-01"}})
+		assertNoError(t, err)
+		if got := l.Query.UploadedBefore.Sub(l.Query.UploadedAfter); got != 24*time.Hour {
+			t.Errorf("got range of %v", got)
+		}
+	})
+	t.Run("per_page is capped", func(t *testing.T) {
+		l, _ := parseListing(url.Values{"per_page": {"100000"}})
+		if l.PerPage != maxPerPage {
+			t.Errorf("got %d per page", l.PerPage)
+		}
+	})
+	for _, query := range []string{"sort=owner", "order=up", "from=yesterday", "minSize=-1", "maxSize=big", "page=0", "per_page=x"} {
+		t.Run("rejects "+query, func(t *testing.T) {
+			values, _ := url.ParseQuery(query)
+			if _, err := parseListing(values); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestVisibleQuery(t *testing.T) {
+	u := user{Username: "alice", ClientIDs: []string{"cam-1", "cam-2"}}
+
+	if got := visibleQuery(u, blobstore.Query{}).ClientIDs; !sameStrings(got, []string{"cam-1", "cam-2"}) {
+		t.Errorf("got %v", got)
+	}
+	if got := visibleQuery(u, blobstore.Query{ClientIDs: []string{"cam-2", "cam-3"}}).ClientIDs; !sameStrings(got, []string{"cam-2"}) {
+		t.Errorf("got %v", got)
+	}
+	if got := visibleQuery(u, blobstore.Query{ClientIDs: []string{"cam-3"}}).ClientIDs; got == nil || len(got) != 0 {
+		t.Errorf("got %v, want an empty non-nil list", got)
+	}
+}
+
+func sameStrings(got, want []string) bool {
+	return strings.Join(got, ",") == strings.Join(want, ",")
+}
+
+func TestFilesListing(t *testing.T) {
+	store := blobstore.NewMemory()
+	putFileType(t, store, "frame1.png", "one", "image/png")
+	putFileType(t, store, "frame2.png", "two", "image/png")
+	putFileType(t, store, "frame2.png", "two again", "image/png")
+	putFileType(t, store, "notes.txt", "some notes", "text/plain")
+	putFile(t, store, "secret.png", "cam-2", "hidden")
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+
+	t.Run("filters by type and name", func(t *testing.T) {
+		body := serve(a, cookie, http.MethodGet, "/files?type=image/&name=frame*").Body.String()
+
+		for _, name := range []string{"frame1.png", "frame2.png"} {
+			if !strings.Contains(body, name) {
+				t.Errorf("%s missing from listing", name)
+			}
+		}
+		for _, name := range []string{"notes.txt", "secret.png"} {
+			if strings.Contains(body, name) {
+				t.Errorf("%s should be filtered out", name)
+			}
+		}
+	})
+	t.Run("pages keep the filter and revision numbers", func(t *testing.T) {
+		body := serve(a, cookie, http.MethodGet, "/files?type=image/&per_page=1").Body.String()
+
+		if !strings.Contains(body, "Страница 1 из 3, файлов: 3") {
+			t.Error("page count missing")
+		}
+		if !strings.Contains(body, `href="/files?page=2&amp;per_page=1&amp;type=image%2F"`) {
+			t.Error("next link missing or drops the filter")
+		}
+		// The newest revision alone is on the page, but the group still
+		// shows both.
+		if !strings.Contains(body, "Ревизий: 2") {
+			t.Error("revisions off the page missing from group")
+		}
+	})
+	t.Run("sorts by name", func(t *testing.T) {
+		body := serve(a, cookie, http.MethodGet, "/files?sort=name&order=asc").Body.String()
+
+		first, last := strings.Index(body, "frame1.png"), strings.Index(body, "notes.txt")
+		if first < 0 || last < 0 || first > last {
+			t.Error("files not sorted by name")
+		}
+	})
+	t.Run("bad filter", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files?minSize=lots")
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+	t.Run("bad glob", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/files?name=frame[")
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func TestAPIListFilters(t *testing.T) {
+	store := blobstore.NewMemory()
+	putFileType(t, store, "small.txt", "tiny", "text/plain")
+	putFileType(t, store, "large.txt", strings.Repeat("x", 100), "text/plain")
+	putFileType(t, store, "frame.png", "png bytes", "image/png")
+	putFile(t, store, "secret.txt", "cam-2", "hidden")
+	a, token := newAPITestApp(t, store)
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{query: "type=text/plain", want: []string{"large.txt", "small.txt"}},
+		{query: "minSize=10&sort=size&order=asc", want: []string{"large.txt"}},
+		{query: "name=*.txt&sort=name&order=asc", want: []string{"large.txt", "small.txt"}},
+		{query: "clientID=cam-2", want: nil},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			response := apiRequest(a, token, http.MethodGet, "/api/v1/files?"+tt.query, nil)
+
+			assertStatus(t, response.Code, http.StatusOK)
+			var page struct {
+				Files []apiFile `json:"files"`
+				Total int       `json:"total"`
+			}
+			assertNoError(t, json.NewDecoder(response.Body).Decode(&page))
+			var got []string
+			for _, f := range page.Files {
+				got = append(got, f.Name)
+			}
+			if !sameStrings(got, tt.want) || page.Total != len(tt.want) {
+				t.Errorf("got %v (total %d) want %v", got, page.Total, tt.want)
+			}
+		})
+	}
+	t.Run("bad sort", func(t *testing.T) {
+		response := apiRequest(a, token, http.MethodGet, "/api/v1/files?sort=owner", nil)
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func TestDedupListing(t *testing.T) {
+	store := blobstore.NewMemory()
+	store.Dedup = true
+	putFile(t, store, "frame9.png", "cam-1", "png bytes")
+	putFile(t, store, "frame9.png", "cam-2", "png bytes")
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1", "cam-2"}})
+
+	body := serve(a, cookie, http.MethodGet, "/files").Body.String()
+
+	if !strings.Contains(body, "файлов: 2, 18 B (на диске 9 B)") {
+		t.Error("logical and stored sizes missing")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is one family of the /metrics endpoint, written in the Prometheus
+// text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// registry holds the metrics /metrics reports, in registration order.
+type registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// family is what every metric has: a name, help text, and label names.
+// Series are kept by their label values joined with a zero byte.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+}
+
+func seriesKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// labelPairs formats the labels of a series, with extra pairs appended.
+func (f family) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(f.labels) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, f.labels[i]+"="+strconv.Quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](series map[string]V) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter, or a gauge, per combination of label values.
+type counterVec struct {
+	family
+	mu     sync.Mutex
+	series map[string]float64
+}
+
+func newCounter(r *registry, name, help string, labels ...string) *counterVec {
+	c := &counterVec{family: family{name: name, help: help, kind: "counter", labels: labels}, series: map[string]float64{}}
+	r.register(c)
+	return c
+}
+
+func newGauge(r *registry, name, help string, labels ...string) *counterVec {
+	g := newCounter(r, name, help, labels...)
+	g.kind = "gauge"
+	return g
+}
+
+// add adds delta to the series with the given label values.
+func (c *counterVec) add(delta float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series[seriesKey(values)] += delta
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+// value returns the current value of a series.
+func (c *counterVec) value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.series[seriesKey(values)]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	if len(c.labels) == 0 && len(c.series) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(c.series[key]))
+	}
+}
+
+// histogramVec counts observations into cumulative buckets per
+// combination of label values.
+type histogramVec struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket, then +Inf
+	sum    float64
+}
+
+func newHistogram(r *registry, name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		family:  family{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  map[string]*histogram{},
+	}
+	r.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(values)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	i, _ := slices.BinarySearch(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var total uint64
+		for i, count := range s.counts {
+			total += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(bound)), total)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), total)
+	}
+}
+
+// The metrics of the process. Uploads are labelled with the way they came
+// in: "ingest" for the TCP port, "http" for the portal and the API.
+var (
+	metrics = &registry{}
+
+	uploadsStarted   = newCounter(metrics, "lucky2_uploads_started_total", "Uploads that began streaming into the file store.", "source")
+	uploadsCompleted = newCounter(metrics, "lucky2_uploads_completed_total", "Uploads stored successfully.", "source")
+	uploadsFailed    = newCounter(metrics, "lucky2_uploads_failed_total", "Uploads that were not stored.", "source")
+	bytesIngested    = newCounter(metrics, "lucky2_ingested_bytes_total", "Bytes of successfully stored uploads.", "source")
+	uploadDuration   = newHistogram(metrics, "lucky2_upload_duration_seconds", "Time taken to receive and store an upload.",
+		[]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}, "source")
+	activeConnections = newGauge(metrics, "lucky2_ingest_connections_active", "Open connections on the ingest port.")
+	hookRuns          = newCounter(metrics, "lucky2_processor_runs_total", "Post-upload processor runs by outcome.", "processor", "result")
+	eventsPublished   = newCounter(metrics, "lucky2_events_published_total", "File events published, by type.", "type")
+	eventsDropped     = newCounter(metrics, "lucky2_events_dropped_total", "File events a subscriber fell too far behind to receive.", "subscriber")
+	webhookDeliveries = newCounter(metrics, "lucky2_webhook_deliveries_total", "Webhook deliveries by outcome.", "result")
+	ingestRejections  = newCounter(metrics, "lucky2_ingest_rejections_total", "Requests refused on the ingest port, by ack status.", "status")
+	httpRequests      = newCounter(metrics, "lucky2_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code")
+)
+
+// uploadTimer measures one upload from when it starts streaming.
+type uploadTimer struct {
+	source string
+	start  time.Time
+}
+
+func startUpload(source string) uploadTimer {
+	uploadsStarted.inc(source)
+	return uploadTimer{source: source, start: time.Now()}
+}
+
+// done records the outcome of the upload: size bytes stored, or err.
+func (t uploadTimer) done(size int64, err error) {
+	uploadDuration.observe(time.Since(t.start).Seconds(), t.source)
+	if err != nil {
+		uploadsFailed.inc(t.source)
+		return
+	}
+	uploadsCompleted.inc(t.source)
+	bytesIngested.add(float64(size), t.source)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/protocol"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	a, cookie := newTestApp(t, blobstore.NewMemory(), user{Username: "alice"})
+
+	for _, target := range []string{"/healthz", "/readyz"} {
+		t.Run(target, func(t *testing.T) {
+			response := serve(a, cookie, http.MethodGet, target)
+
+			assertStatus(t, response.Code, http.StatusOK)
+			if response.Body.String() != "ok\n" {
+				t.Errorf("got body %q", response.Body.String())
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	store := blobstore.NewMemory()
+	a, token := newAPITestApp(t, store)
+	ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+	started := uploadsStarted.value("ingest")
+	completed := uploadsCompleted.value("ingest")
+	failed := uploadsFailed.value("ingest")
+	bytes := bytesIngested.value("ingest")
+	requests := httpRequests.value("GET /api/v1/files/{id}", "GET", "404")
+
+	uploadOverTCP(t, ingest, "frame9.png", "cam-1", "png bytes")
+	uploadOverTCP(t, ingest, "frame9.png", "cam-1", "")
+	apiRequest(a, token, http.MethodGet, "/api/v1/files/nope", nil)
+
+	if got := uploadsStarted.value("ingest") - started; got != 2 {
+		t.Errorf("got %v uploads started want 2", got)
+	}
+	if got := uploadsCompleted.value("ingest") - completed; got != 2 {
+		t.Errorf("got %v uploads completed want 2", got)
+	}
+	if got := uploadsFailed.value("ingest") - failed; got != 0 {
+		t.Errorf("got %v uploads failed want 0", got)
+	}
+	if got := bytesIngested.value("ingest") - bytes; got != 9 {
+		t.Errorf("got %v bytes ingested want 9", got)
+	}
+	if got := httpRequests.value("GET /api/v1/files/{id}", "GET", "404") - requests; got != 1 {
+		t.Errorf("got %v requests counted under the route pattern want 1", got)
+	}
+
+	t.Run("failed upload", func(t *testing.T) {
+		failed := uploadsFailed.value("ingest")
+		conn := dialIngest(t, ingest)
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: make([]byte, 32)}
+		protocol.Upload(conn, header, strings.NewReader("png bytes"), 9)
+
+		if got := uploadsFailed.value("ingest") - failed; got != 1 {
+			t.Errorf("got %v uploads failed want 1", got)
+		}
+	})
+	t.Run("exposition", func(t *testing.T) {
+		response := apiRequest(a, "", http.MethodGet, "/metrics", nil)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		body := response.Body.String()
+		for _, want := range []string{
+			"# TYPE lucky2_uploads_started_total counter\n",
+			`lucky2_uploads_completed_total{source="ingest"} `,
+			"# TYPE lucky2_upload_duration_seconds histogram\n",
+			`lucky2_upload_duration_seconds_bucket{source="ingest",le="+Inf"} `,
+			`lucky2_upload_duration_seconds_count{source="ingest"} `,
+			"# TYPE lucky2_ingest_connections_active gauge\n",
+			`lucky2_http_requests_total{route="GET /api/v1/files/{id}",method="GET",code="404"} `,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("metrics missing %q", want)
+			}
+		}
+	})
+}
+
+func TestHistogram(t *testing.T) {
+	r := &registry{}
+	h := newHistogram(r, "test_seconds", "Test.", []float64{0.1, 1}, "kind")
+	h.observe(0.05, "a")
+	h.observe(0.1, "a")
+	h.observe(5, "a")
+
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	want := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{kind="a",le="0.1"} 2
+test_seconds_bucket{kind="a",le="1"} 2
+test_seconds_bucket{kind="a",le="+Inf"} 3
+test_seconds_sum{kind="a"} 5.15
+test_seconds_count{kind="a"} 3
+`
+	if got := response.Body.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
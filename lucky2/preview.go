@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"example.com/hello/blobstore"
+)
+
+// sniffLen is how much content http.DetectContentType looks at.
+const sniffLen = 512
+
+// sniffContentType returns the MIME type of the content read from r
+// together with a reader that still yields all of it. The declared type is
+// only used when the content itself is not recognised.
+func sniffContentType(r io.Reader, declared string) (string, io.Reader) {
+	buffered := bufio.NewReaderSize(r, sniffLen)
+	// A short or failed read still leaves whatever arrived in the buffer;
+	// the error resurfaces when the store reads the content.
+	head, _ := buffered.Peek(sniffLen)
+	return detectContentType(head, declared), buffered
+}
+
+func detectContentType(head []byte, declared string) string {
+	sniffed := http.DetectContentType(head)
+	if sniffed == "application/octet-stream" && declared != "" {
+		return declared
+	}
+	return sniffed
+}
+
+// contentType returns the stored MIME type of a file. Files stored before
+// types were recorded are sniffed from their first bytes; rs is rewound.
+func contentType(info blobstore.FileInfo, rs io.ReadSeeker) (string, error) {
+	if info.Metadata.ContentType != "" {
+		return info.Metadata.ContentType, nil
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(rs, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return detectContentType(head[:n], mime.TypeByExtension(path.Ext(info.Name))), nil
+}
+
+// inlineSafe reports whether a browser may render the type in the portal's
+// origin. Anything else, HTML and SVG in particular, is always downloaded.
+func inlineSafe(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain":
+		return true
+	}
+	return false
+}
+
+// fileKind groups a file for its icon in the file manager.
+func fileKind(info blobstore.FileInfo) string {
+	contentType := info.Metadata.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(info.Name))
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return "image"
+	case mediaType == "application/pdf":
+		return "pdf"
+	case strings.HasPrefix(mediaType, "text/"):
+		return "text"
+	case mediaType == "application/zip", mediaType == "application/x-gzip", mediaType == "application/gzip":
+		return "archive"
+	}
+	return "other"
+}
+
+// hasThumbnail reports whether a thumbnail can be made for the file. PDF
+// pages are not rendered: there is no pure Go PDF rasteriser worth the
+// dependency, so PDFs get an icon instead.
+func hasThumbnail(info blobstore.FileInfo) bool {
+	switch info.Metadata.ContentType {
+	case "image/png", "image/jpeg":
+		return true
+	}
+	return false
+}
+
+// humanSize formats a byte count for people.
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+const (
+	thumbnailSize = 160
+	// maxThumbnailPixels bounds the images we decode, so a small file that
+	// claims huge dimensions cannot exhaust memory.
+	maxThumbnailPixels  = 50_000_000
+	maxCachedThumbnails = 512
+)
+
+var errImageTooLarge = errors.New("image too large for a thumbnail")
+
+// makeThumbnail decodes a PNG or JPEG image and returns it scaled to fit a
+// thumbnailSize square, encoded as PNG.
+func makeThumbnail(rs io.ReadSeeker) ([]byte, error) {
+	config, _, err := image.DecodeConfig(rs)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, errImageTooLarge
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(rs)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleDown(src, thumbnailSize)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown shrinks src to fit a size×size square, averaging the source
+// pixels that fall on each thumbnail pixel. Smaller images are copied as is.
+func scaleDown(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, max(h*size/w, 1)
+		} else {
+			tw, th = max(w*size/h, 1), size
+		}
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+max((y+1)*h/th, y*h/th+1)
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+max((x+1)*w/tw, x*w/tw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// thumbnailCache keeps encoded thumbnails by file ID. Stored files never
+// change, so entries never go stale; when the cache is full an arbitrary
+// entry makes room.
+type thumbnailCache struct {
+	mu     sync.Mutex
+	thumbs map[string][]byte
+}
+
+func newThumbnailCache() *thumbnailCache {
+	return &thumbnailCache{thumbs: map[string][]byte{}}
+}
+
+func (c *thumbnailCache) get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	thumb, ok := c.thumbs[id]
+	return thumb, ok
+}
+
+func (c *thumbnailCache) put(id string, thumb []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.thumbs) >= maxCachedThumbnails {
+		for old := range c.thumbs {
+			delete(c.thumbs, old)
+			break
+		}
+	}
+	c.thumbs[id] = thumb
+}
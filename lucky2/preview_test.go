@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"example.com/hello/blobstore"
+)
+
+func encodePNG(t testing.TB, width, height int) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	assertNoError(t, png.Encode(&buf, img))
+	return buf.String()
+}
+
+func TestIngestSniffsContentType(t *testing.T) {
+	store := blobstore.NewMemory()
+	ingest := &ingestServer{store: store, sessions: newInMemorySessionStore()}
+
+	for name, tt := range map[string]struct {
+		content string
+		want    string
+	}{
+		"png":        {content: encodePNG(t, 4, 4), want: "image/png"},
+		"pdf":        {content: "%PDF-1.7\n...", want: "application/pdf"},
+		"short text": {content: "hi", want: "text/plain; charset=utf-8"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ack := uploadOverTCP(t, ingest, name, "cam-1", tt.content)
+
+			info, err := store.Stat(context.Background(), ack.FileID)
+			assertNoError(t, err)
+			if info.Metadata.ContentType != tt.want {
+				t.Errorf("got content type %q want %q", info.Metadata.ContentType, tt.want)
+			}
+		})
+	}
+}
+
+func TestView(t *testing.T) {
+	store := blobstore.NewMemory()
+	putFileType(t, store, "frame9.png", encodePNG(t, 4, 4), "image/png")
+	putFileType(t, store, "page.html", "<script>alert(1)</script>", "text/html; charset=utf-8")
+	putFileType(t, store, "old.png", encodePNG(t, 4, 4), "")
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+
+	t.Run("images are shown inline", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/view?filename=frame9.png")
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "Content-Type", "image/png")
+		assertHeader(t, response.Header(), "Content-Disposition", `inline; filename="frame9.png"`)
+	})
+	t.Run("HTML is downloaded", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/view?filename=page.html")
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertHeader(t, response.Header(), "Content-Type", "application/octet-stream")
+		assertHeader(t, response.Header(), "Content-Disposition", `attachment; filename="page.html"`)
+	})
+	t.Run("files without a stored type are sniffed", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/view?filename=old.png")
+
+		assertHeader(t, response.Header(), "Content-Type", "image/png")
+		if !strings.HasPrefix(response.Body.String(), "\x89PNG") {
+			t.Error("sniffing consumed the start of the body")
+		}
+	})
+}
+
+func TestThumbnail(t *testing.T) {
+	store := blobstore.NewMemory()
+	putFileType(t, store, "frame9.png", encodePNG(t, 400, 200), "image/png")
+	putFileType(t, store, "report.pdf", "%PDF-1.7\n...", "application/pdf")
+	a, cookie := newTestApp(t, store, user{Username: "alice", ClientIDs: []string{"cam-1"}})
+
+	t.Run("PNG is scaled to fit", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/thumbnail?filename=frame9.png")
+
+		assertStatus(t, response.Code, http.StatusOK)
+		config, err := png.DecodeConfig(response.Body)
+		assertNoError(t, err)
+		if config.Width != 160 || config.Height != 80 {
+			t.Errorf("got %dx%d want 160x80", config.Width, config.Height)
+		}
+	})
+	t.Run("PDF has no thumbnail", func(t *testing.T) {
+		response := serve(a, cookie, http.MethodGet, "/thumbnail?filename=report.pdf")
+
+		assertStatus(t, response.Code, http.StatusUnsupportedMediaType)
+	})
+	t.Run("listing shows thumbnails and sizes", func(t *testing.T) {
+		body := serve(a, cookie, http.MethodGet, "/files").Body.String()
+
+		if !strings.Contains(body, `src="/thumbnail?filename=frame9.png"`) {
+			t.Error("thumbnail missing from listing")
+		}
+		if !strings.Contains(body, "12 B") {
+			t.Error("size missing from listing")
+		}
+	})
+}
+
+func TestHumanSize(t *testing.T) {
+	for size, want := range map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+	} {
+		if got := humanSize(size); got != want {
+			t.Errorf("humanSize(%d) = %q want %q", size, got, want)
+		}
+	}
+}
+
+func putFileType(t testing.TB, store blobstore.BlobStore, name, content, contentType string) {
+	t.Helper()
+	meta := blobstore.Metadata{ClientID: "cam-1", ContentType: contentType}
+	_, err := store.Put(context.Background(), name, meta, strings.NewReader(content))
+	assertNoError(t, err)
+}
+
+func assertHeader(t testing.TB, header http.Header, key, want string) {
+	t.Helper()
+	if got := header.Get(key); got != want {
+		t.Errorf("got %s %q want %q", key, got, want)
+	}
+}
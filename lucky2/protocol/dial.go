@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// Dial connects to an ingest server, over TLS when cfg is not nil.
+func Dial(address string, cfg *tls.Config) (net.Conn, error) {
+	if cfg == nil {
+		return net.Dial("tcp", address)
+	}
+	return tls.Dial("tcp", address, cfg)
+}
+
+// ClientTLSConfig builds a client TLS configuration. caFile replaces the
+// system roots when set; certFile and keyFile present a client certificate
+// to servers running in mutual TLS mode.
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("protocol: CA file contains no certificates")
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,453 @@
+// Package protocol implements the framed wire format spoken on the lucky2
+// ingest port.
+//
+// Every frame starts with a fixed preamble followed by a typed header block
+// and a declared content length:
+//
+//	magic      [4]byte  "LKY2"
+//	version    uint8
+//	type       uint8
+//	fieldCount uint16
+//	fields     fieldCount * (tag uint8, len uint16, value [len]byte)
+//	length     uint64   number of content bytes following the frame
+//
+// All integers are big-endian.
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Magic identifies a lucky2 frame on the wire.
+const Magic = "LKY2"
+
+// Version is the protocol version spoken by this package.
+const Version uint8 = 1
+
+// MaxFields bounds the number of header fields accepted in one frame.
+const MaxFields = 64
+
+// MaxHeaderSize bounds the total size of the field values of one frame.
+const MaxHeaderSize = 128 << 10
+
+// MsgType tells the receiver how to interpret a frame.
+type MsgType uint8
+
+const (
+	TypeUpload MsgType = 1
+	TypeAck    MsgType = 2
+
+	// Resumable upload sessions: open a session, send numbered chunks in any
+	// order, query which chunks the server holds, then commit.
+	TypeSessionOpen   MsgType = 3
+	TypeSessionChunk  MsgType = 4
+	TypeSessionStatus MsgType = 5
+	TypeSessionCommit MsgType = 6
+)
+
+// Field is the tag of a typed header field.
+type Field uint8
+
+const (
+	FieldFilename    Field = 1
+	FieldClientID    Field = 2
+	FieldContentType Field = 3
+	FieldChecksum    Field = 4
+	FieldStatus      Field = 5
+	FieldMessage     Field = 6
+	FieldFileID      Field = 7
+	FieldUploadID    Field = 8
+	FieldSize        Field = 9
+	FieldChunkSize   Field = 10
+	FieldChunk       Field = 11
+	FieldChunks      Field = 12
+	FieldRetryAfter  Field = 13
+)
+
+// Status is the outcome reported by the server in an ack frame.
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusBadRequest
+	StatusUnsupportedVersion
+	StatusIncomplete
+	StatusStorageError
+	StatusChecksumMismatch
+	StatusUnknownSession
+	StatusDuplicate
+	StatusQuotaExceeded
+	StatusTooLarge
+	StatusTimeout
+	StatusRateLimited
+	StatusBusy
+)
+
+var statusName = map[Status]string{
+	StatusOK:                 "ok",
+	StatusBadRequest:         "bad request",
+	StatusUnsupportedVersion: "unsupported version",
+	StatusIncomplete:         "incomplete upload",
+	StatusStorageError:       "storage error",
+	StatusChecksumMismatch:   "checksum mismatch",
+	StatusUnknownSession:     "unknown upload session",
+	StatusDuplicate:          "file already exists",
+	StatusQuotaExceeded:      "quota exceeded",
+	StatusTooLarge:           "file too large",
+	StatusTimeout:            "timed out",
+	StatusRateLimited:        "rate limited",
+	StatusBusy:               "server busy",
+}
+
+func (s Status) String() string {
+	if name, ok := statusName[s]; ok {
+		return name
+	}
+	return "status " + strconv.Itoa(int(s))
+}
+
+var (
+	ErrBadMagic       = errors.New("protocol: bad magic number")
+	ErrTooManyFields  = errors.New("protocol: too many header fields")
+	ErrFieldTooLong   = errors.New("protocol: header field too long")
+	ErrHeaderTooLarge = errors.New("protocol: header too large")
+	ErrNegativeLength = errors.New("protocol: negative content length")
+	ErrLengthTooLarge = errors.New("protocol: content length too large")
+)
+
+// VersionError is returned when a peer speaks a protocol version this
+// package does not understand.
+type VersionError struct {
+	Got uint8
+}
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("protocol: unsupported version %d (want %d)", e.Got, Version)
+}
+
+// Fields holds the typed header block of a frame.
+type Fields map[Field][]byte
+
+func (f Fields) String(tag Field) string {
+	return string(f[tag])
+}
+
+func (f Fields) SetString(tag Field, value string) {
+	if value != "" {
+		f[tag] = []byte(value)
+	}
+}
+
+func (f Fields) Uint64(tag Field) (uint64, bool) {
+	value, ok := f[tag]
+	if !ok || len(value) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(value), true
+}
+
+func (f Fields) SetUint64(tag Field, value uint64) {
+	f[tag] = binary.BigEndian.AppendUint64(nil, value)
+}
+
+// Frame is a single protocol message. Length content bytes follow it on
+// the wire.
+type Frame struct {
+	Type   MsgType
+	Fields Fields
+	Length int64
+}
+
+// WriteFrame encodes f to w. It does not write any content bytes.
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Fields) > MaxFields {
+		return ErrTooManyFields
+	}
+	if f.Length < 0 {
+		return ErrNegativeLength
+	}
+
+	buf := make([]byte, 0, 16)
+	buf = append(buf, Magic...)
+	buf = append(buf, Version, byte(f.Type))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(f.Fields)))
+	for tag, value := range f.Fields {
+		if len(value) > 0xFFFF {
+			return ErrFieldTooLong
+		}
+		buf = append(buf, byte(tag))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+		buf = append(buf, value...)
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(f.Length))
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame decodes one frame from r, leaving any content bytes unread.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var preamble [8]byte
+	if _, err := io.ReadFull(r, preamble[:]); err != nil {
+		return Frame{}, err
+	}
+	if string(preamble[:4]) != Magic {
+		return Frame{}, ErrBadMagic
+	}
+	if preamble[4] != Version {
+		return Frame{}, VersionError{Got: preamble[4]}
+	}
+
+	f := Frame{Type: MsgType(preamble[5]), Fields: Fields{}}
+	count := binary.BigEndian.Uint16(preamble[6:])
+	if count > MaxFields {
+		return Frame{}, ErrTooManyFields
+	}
+	size := 0
+	for i := 0; i < int(count); i++ {
+		var fieldHeader [3]byte
+		if _, err := io.ReadFull(r, fieldHeader[:]); err != nil {
+			return Frame{}, err
+		}
+		n := int(binary.BigEndian.Uint16(fieldHeader[1:]))
+		if size += n; size > MaxHeaderSize {
+			return Frame{}, ErrHeaderTooLarge
+		}
+		value := make([]byte, n)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return Frame{}, err
+		}
+		f.Fields[Field(fieldHeader[0])] = value
+	}
+
+	var length uint64
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return Frame{}, err
+	}
+	if length > 1<<62 {
+		return Frame{}, ErrLengthTooLarge
+	}
+	f.Length = int64(length)
+	return f, nil
+}
+
+// Header describes a file being uploaded. Checksum is the SHA-256 digest
+// of the content.
+type Header struct {
+	Filename    string
+	ClientID    string
+	ContentType string
+	Checksum    []byte
+}
+
+// Digest returns the SHA-256 digest of r and rewinds it so the content can
+// be sent afterwards.
+func Digest(r io.ReadSeeker) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// UploadFrame builds the frame announcing an upload of length bytes.
+func UploadFrame(h Header, length int64) Frame {
+	fields := Fields{}
+	fields.SetString(FieldFilename, h.Filename)
+	fields.SetString(FieldClientID, h.ClientID)
+	fields.SetString(FieldContentType, h.ContentType)
+	if len(h.Checksum) > 0 {
+		fields[FieldChecksum] = h.Checksum
+	}
+	return Frame{Type: TypeUpload, Fields: fields, Length: length}
+}
+
+// Header extracts the upload header carried by f.
+func (f Frame) Header() Header {
+	return Header{
+		Filename:    f.Fields.String(FieldFilename),
+		ClientID:    f.Fields.String(FieldClientID),
+		ContentType: f.Fields.String(FieldContentType),
+		Checksum:    f.Fields[FieldChecksum],
+	}
+}
+
+// Ack is the server's reply to an upload or session frame. Fields carries
+// any additional typed values, such as the upload ID of a new session.
+type Ack struct {
+	Status  Status
+	FileID  string
+	Message string
+	Fields  Fields
+}
+
+// RetryAfter returns how long a rate limited client should wait before
+// trying again, or 0 if the server did not say.
+func (a Ack) RetryAfter() time.Duration {
+	ms, ok := a.Fields.Uint64(FieldRetryAfter)
+	if !ok {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (a Ack) Error() string {
+	if a.Message == "" {
+		return a.Status.String()
+	}
+	return a.Status.String() + ": " + a.Message
+}
+
+// AckFrame builds the frame carrying a.
+func AckFrame(a Ack) Frame {
+	fields := Fields{}
+	for tag, value := range a.Fields {
+		fields[tag] = value
+	}
+	fields[FieldStatus] = []byte{byte(a.Status)}
+	fields.SetString(FieldFileID, a.FileID)
+	fields.SetString(FieldMessage, a.Message)
+	return Frame{Type: TypeAck, Fields: fields}
+}
+
+// WriteAck sends a to w.
+func WriteAck(w io.Writer, a Ack) error {
+	return WriteFrame(w, AckFrame(a))
+}
+
+// ReadAck reads an ack frame from r.
+func ReadAck(r io.Reader) (Ack, error) {
+	f, err := ReadFrame(r)
+	if err != nil {
+		return Ack{}, err
+	}
+	if f.Type != TypeAck {
+		return Ack{}, fmt.Errorf("protocol: expected ack frame, got type %d", f.Type)
+	}
+	status := f.Fields[FieldStatus]
+	if len(status) != 1 {
+		return Ack{}, errors.New("protocol: ack frame without status")
+	}
+	return Ack{
+		Status:  Status(status[0]),
+		FileID:  f.Fields.String(FieldFileID),
+		Message: f.Fields.String(FieldMessage),
+		Fields:  f.Fields,
+	}, nil
+}
+
+// EncodeChunks packs a list of chunk numbers into a field value.
+func EncodeChunks(chunks []uint32) []byte {
+	buf := make([]byte, 0, 4*len(chunks))
+	for _, n := range chunks {
+		buf = binary.BigEndian.AppendUint32(buf, n)
+	}
+	return buf
+}
+
+// DecodeChunks unpacks a field value built by EncodeChunks.
+func DecodeChunks(value []byte) ([]uint32, error) {
+	if len(value)%4 != 0 {
+		return nil, errors.New("protocol: malformed chunk list")
+	}
+	chunks := make([]uint32, 0, len(value)/4)
+	for i := 0; i < len(value); i += 4 {
+		chunks = append(chunks, binary.BigEndian.Uint32(value[i:]))
+	}
+	return chunks, nil
+}
+
+// Upload sends h followed by size bytes of body over rw and waits for the
+// server's ack. A non-OK ack is returned as the error.
+func Upload(rw io.ReadWriter, h Header, body io.Reader, size int64) (Ack, error) {
+	if err := WriteFrame(rw, UploadFrame(h, size)); err != nil {
+		return Ack{}, err
+	}
+	if _, err := io.CopyN(rw, body, size); err != nil {
+		// The server may have rejected the upload before reading the body.
+		if ack, ackErr := ReadAck(rw); ackErr == nil && ack.Status != StatusOK {
+			return ack, ack
+		}
+		return Ack{}, err
+	}
+	return expectOK(rw)
+}
+
+// expectOK reads an ack and turns a non-OK status into an error.
+func expectOK(r io.Reader) (Ack, error) {
+	ack, err := ReadAck(r)
+	if err != nil {
+		return Ack{}, err
+	}
+	if ack.Status != StatusOK {
+		return ack, ack
+	}
+	return ack, nil
+}
+
+// OpenSession starts a resumable upload of size bytes split into chunks of
+// chunkSize bytes and returns the upload ID assigned by the server.
+func OpenSession(rw io.ReadWriter, h Header, size, chunkSize int64) (string, error) {
+	f := UploadFrame(h, 0)
+	f.Type = TypeSessionOpen
+	f.Fields.SetUint64(FieldSize, uint64(size))
+	f.Fields.SetUint64(FieldChunkSize, uint64(chunkSize))
+	if err := WriteFrame(rw, f); err != nil {
+		return "", err
+	}
+	ack, err := expectOK(rw)
+	if err != nil {
+		return "", err
+	}
+	return ack.Fields.String(FieldUploadID), nil
+}
+
+// SendChunk uploads chunk number n of a session. The server acks once the
+// chunk is persisted.
+func SendChunk(rw io.ReadWriter, uploadID string, n uint32, data []byte) error {
+	f := Frame{Type: TypeSessionChunk, Fields: Fields{}, Length: int64(len(data))}
+	f.Fields.SetString(FieldUploadID, uploadID)
+	f.Fields.SetUint64(FieldChunk, uint64(n))
+	if err := WriteFrame(rw, f); err != nil {
+		return err
+	}
+	if _, err := rw.Write(data); err != nil {
+		return err
+	}
+	_, err := expectOK(rw)
+	return err
+}
+
+// SessionChunks asks the server which chunks of a session it has persisted.
+func SessionChunks(rw io.ReadWriter, uploadID string) ([]uint32, error) {
+	f := Frame{Type: TypeSessionStatus, Fields: Fields{}}
+	f.Fields.SetString(FieldUploadID, uploadID)
+	if err := WriteFrame(rw, f); err != nil {
+		return nil, err
+	}
+	ack, err := expectOK(rw)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeChunks(ack.Fields[FieldChunks])
+}
+
+// CommitSession asks the server to assemble the session's chunks into a
+// stored file.
+func CommitSession(rw io.ReadWriter, uploadID string) (Ack, error) {
+	f := Frame{Type: TypeSessionCommit, Fields: Fields{}}
+	f.Fields.SetString(FieldUploadID, uploadID)
+	if err := WriteFrame(rw, f); err != nil {
+		return Ack{}, err
+	}
+	return expectOK(rw)
+}
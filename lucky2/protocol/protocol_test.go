@@ -0,0 +1,205 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	t.Run("upload header survives encoding", func(t *testing.T) {
+		want := Header{
+			Filename:    "frame9.png",
+			ClientID:    "camera-1",
+			ContentType: "image/png",
+			Checksum:    []byte{1, 2, 3},
+		}
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, UploadFrame(want, 42)); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := ReadFrame(&buf)
+		assertNoError(t, err)
+		if f.Type != TypeUpload {
+			t.Errorf("got type %d want %d", f.Type, TypeUpload)
+		}
+		if f.Length != 42 {
+			t.Errorf("got length %d want 42", f.Length)
+		}
+		if got := f.Header(); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v want %+v", got, want)
+		}
+	})
+	t.Run("ack survives encoding", func(t *testing.T) {
+		want := Ack{Status: StatusStorageError, FileID: "abc", Message: "disk full"}
+		var buf bytes.Buffer
+		if err := WriteAck(&buf, want); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ReadAck(&buf)
+		assertNoError(t, err)
+		if got.Status != want.Status || got.FileID != want.FileID || got.Message != want.Message {
+			t.Errorf("got %+v want %+v", got, want)
+		}
+	})
+	t.Run("chunk list survives encoding", func(t *testing.T) {
+		want := []uint32{0, 1, 7, 1 << 20}
+
+		got, err := DecodeChunks(EncodeChunks(want))
+		assertNoError(t, err)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+	})
+}
+
+func TestReadFrameRejectsMismatches(t *testing.T) {
+	t.Run("legacy length-prefixed header", func(t *testing.T) {
+		legacy := []byte{0, 0, 0, 10, 'f', 'r', 'a', 'm', 'e', '9', '.', 'p', 'n', 'g'}
+
+		_, err := ReadFrame(bytes.NewReader(legacy))
+		if err != ErrBadMagic {
+			t.Errorf("got %v want %v", err, ErrBadMagic)
+		}
+	})
+	t.Run("future version", func(t *testing.T) {
+		frame := []byte{'L', 'K', 'Y', '2', Version + 1, byte(TypeUpload), 0, 0}
+
+		_, err := ReadFrame(bytes.NewReader(frame))
+		var versionErr VersionError
+		if !errors.As(err, &versionErr) || versionErr.Got != Version+1 {
+			t.Errorf("got %v want a VersionError for %d", err, Version+1)
+		}
+	})
+	t.Run("truncated header", func(t *testing.T) {
+		var buf bytes.Buffer
+		WriteFrame(&buf, UploadFrame(Header{Filename: "a.png"}, 1))
+		truncated := buf.Bytes()[:buf.Len()-3]
+
+		_, err := ReadFrame(bytes.NewReader(truncated))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("got %v want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+	t.Run("oversized header", func(t *testing.T) {
+		fields := Fields{}
+		for tag := Field(1); tag <= 3; tag++ {
+			fields[tag] = bytes.Repeat([]byte{'x'}, 0xFFFF)
+		}
+		var buf bytes.Buffer
+		WriteFrame(&buf, Frame{Type: TypeUpload, Fields: fields})
+
+		_, err := ReadFrame(&buf)
+		if err != ErrHeaderTooLarge {
+			t.Errorf("got %v want %v", err, ErrHeaderTooLarge)
+		}
+	})
+}
+
+func TestDigest(t *testing.T) {
+	r := bytes.NewReader([]byte("hello"))
+
+	digest, err := Digest(r)
+	assertNoError(t, err)
+
+	got := hex.EncodeToString(digest)
+	want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "hello" {
+		t.Errorf("reader was not rewound, %q left", rest)
+	}
+}
+
+type pipe struct {
+	io.Reader
+	io.Writer
+}
+
+func TestUpload(t *testing.T) {
+	t.Run("returns the server's ack", func(t *testing.T) {
+		var sent, reply bytes.Buffer
+		WriteAck(&reply, Ack{Status: StatusOK, FileID: "id-1"})
+
+		ack, err := Upload(pipe{&reply, &sent}, Header{Filename: "a.txt"}, bytes.NewBufferString("hello"), 5)
+		assertNoError(t, err)
+		if ack.FileID != "id-1" {
+			t.Errorf("got file ID %q want %q", ack.FileID, "id-1")
+		}
+
+		f, err := ReadFrame(&sent)
+		assertNoError(t, err)
+		body, _ := io.ReadAll(&sent)
+		if f.Length != 5 || string(body) != "hello" {
+			t.Errorf("got length %d body %q", f.Length, body)
+		}
+	})
+	t.Run("rejection is returned as an error", func(t *testing.T) {
+		var sent, reply bytes.Buffer
+		WriteAck(&reply, Ack{Status: StatusBadRequest, Message: "missing clientID"})
+
+		_, err := Upload(pipe{&reply, &sent}, Header{Filename: "a.txt"}, bytes.NewBufferString("hello"), 5)
+		var ack Ack
+		if !errors.As(err, &ack) || ack.Status != StatusBadRequest {
+			t.Errorf("got %v want a bad request ack", err)
+		}
+	})
+}
+
+func TestSessionFrames(t *testing.T) {
+	t.Run("open session returns the upload ID", func(t *testing.T) {
+		var sent, reply bytes.Buffer
+		WriteAck(&reply, Ack{Status: StatusOK, Fields: Fields{FieldUploadID: []byte("u-1")}})
+
+		id, err := OpenSession(pipe{&reply, &sent}, Header{Filename: "big.png"}, 100, 30)
+		assertNoError(t, err)
+		if id != "u-1" {
+			t.Errorf("got upload ID %q want %q", id, "u-1")
+		}
+
+		f, err := ReadFrame(&sent)
+		assertNoError(t, err)
+		size, _ := f.Fields.Uint64(FieldSize)
+		chunkSize, _ := f.Fields.Uint64(FieldChunkSize)
+		if f.Type != TypeSessionOpen || size != 100 || chunkSize != 30 {
+			t.Errorf("got type %d size %d chunk size %d", f.Type, size, chunkSize)
+		}
+	})
+	t.Run("chunk carries its number and data", func(t *testing.T) {
+		var sent, reply bytes.Buffer
+		WriteAck(&reply, Ack{Status: StatusOK})
+
+		assertNoError(t, SendChunk(pipe{&reply, &sent}, "u-1", 3, []byte("abc")))
+
+		f, err := ReadFrame(&sent)
+		assertNoError(t, err)
+		n, _ := f.Fields.Uint64(FieldChunk)
+		body, _ := io.ReadAll(&sent)
+		if f.Fields.String(FieldUploadID) != "u-1" || n != 3 || string(body) != "abc" {
+			t.Errorf("got upload ID %q chunk %d body %q", f.Fields.String(FieldUploadID), n, body)
+		}
+	})
+	t.Run("status lists persisted chunks", func(t *testing.T) {
+		var sent, reply bytes.Buffer
+		WriteAck(&reply, Ack{Status: StatusOK, Fields: Fields{FieldChunks: EncodeChunks([]uint32{0, 2})}})
+
+		chunks, err := SessionChunks(pipe{&reply, &sent}, "u-1")
+		assertNoError(t, err)
+		if !reflect.DeepEqual(chunks, []uint32{0, 2}) {
+			t.Errorf("got %v want [0 2]", chunks)
+		}
+	})
+}
+
+func assertNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("got an error but didn't want one: %v", err)
+	}
+}
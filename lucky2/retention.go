@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"example.com/hello/blobstore"
+)
+
+var errOverQuota = errors.New("over quota")
+
+// retentionPolicy bounds what each clientID may keep. Zero limits are
+// unlimited. The janitor deletes a client's oldest files until it is within
+// the limits again; until it has, further uploads are refused.
+type retentionPolicy struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+	MaxFiles int
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.MaxAge > 0 || p.MaxBytes > 0 || p.MaxFiles > 0
+}
+
+// over reports whether usage exceeds the size limits.
+func (p retentionPolicy) over(usage blobstore.Usage) bool {
+	return (p.MaxBytes > 0 && usage.Bytes > p.MaxBytes) || (p.MaxFiles > 0 && usage.Files > p.MaxFiles)
+}
+
+// checkQuota refuses an upload of size bytes for clientID when storing it
+// would take the client over quota. A negative size means the size is not
+// known yet, so only the file itself is counted.
+func (p retentionPolicy) checkQuota(ctx context.Context, store blobstore.BlobStore, clientID string, size int64) error {
+	if p.MaxBytes == 0 && p.MaxFiles == 0 {
+		return nil
+	}
+	if p.MaxBytes > 0 && size > p.MaxBytes {
+		return fmt.Errorf("%w: %d bytes is more than the quota of %d bytes", errOverQuota, size, p.MaxBytes)
+	}
+	usage, err := store.Usage(ctx, blobstore.Query{ClientIDs: []string{clientID}})
+	if err != nil {
+		return err
+	}
+	if p.over(blobstore.Usage{Files: usage.Files + 1, Bytes: usage.Bytes + max(size, 0)}) {
+		return fmt.Errorf("%w: client %s stores %d files, %d bytes", errOverQuota, clientID, usage.Files, usage.Bytes)
+	}
+	return nil
+}
+
+// expired returns the files of one client the policy removes. files must be
+// newest first.
+func (p retentionPolicy) expired(files []blobstore.FileInfo, now time.Time) []blobstore.FileInfo {
+	var kept blobstore.Usage
+	for i, file := range files {
+		if p.MaxAge > 0 && now.Sub(file.UploadDate) > p.MaxAge {
+			return files[i:]
+		}
+		kept.Files++
+		kept.Bytes += file.Size
+		if p.over(kept) {
+			return files[i:]
+		}
+	}
+	return nil
+}
+
+// janitorUser is who retention deletes are recorded as.
+var janitorUser = user{Username: "janitor", Admin: true}
+
+// enforceRetention deletes every file policy removes and returns how many
+// were deleted.
+func (a *app) enforceRetention(ctx context.Context, policy retentionPolicy) (int, error) {
+	files, err := a.files.List(ctx, blobstore.Query{})
+	if err != nil {
+		return 0, err
+	}
+	byClient := map[string][]blobstore.FileInfo{}
+	for _, file := range files {
+		byClient[file.Metadata.ClientID] = append(byClient[file.Metadata.ClientID], file)
+	}
+
+	ctx = context.WithValue(ctx, userContextKey{}, janitorUser)
+	now := time.Now()
+	deleted := 0
+	for clientID, files := range byClient {
+		for _, file := range policy.expired(files, now) {
+			if err := ctx.Err(); err != nil {
+				return deleted, err
+			}
+			err := a.files.Delete(ctx, file.ID)
+			if errors.Is(err, blobstore.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return deleted, err
+			}
+			deleted++
+			a.audit(ctx, "expire", file, "retention policy of client "+clientID)
+			a.events.publish(event{Type: eventFileDeleted, File: file})
+		}
+	}
+	return deleted, nil
+}
+
+// pruned records a revision the version policy deleted when a newer one
+// was stored, as deleted by the portal user or ingest client that stored
+// it.
+func (a *app) pruned(ctx context.Context, file blobstore.FileInfo) {
+	// Загрузки через ingest идут без пользователя портала
+	if currentUser(ctx).Username == "" {
+		ctx = context.WithValue(ctx, userContextKey{}, user{Username: "ingest:" + file.Metadata.ClientID})
+	}
+	a.audit(ctx, "delete", file, "version policy")
+	a.events.publish(event{Type: eventFileDeleted, File: file})
+}
+
+// runJanitor enforces policy now and then every interval until ctx is
+// done.
+func (a *app) runJanitor(ctx context.Context, policy retentionPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := a.enforceRetention(ctx, policy)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("enforcing retention", "err", err)
+		}
+		if n > 0 {
+			slog.Info("deleted files past retention", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
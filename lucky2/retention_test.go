@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/protocol"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	file := func(name string, age time.Duration, size int64) blobstore.FileInfo {
+		return blobstore.FileInfo{ID: name, Name: name, UploadDate: now.Add(-age), Size: size}
+	}
+	// Newest first, as List returns them.
+	files := []blobstore.FileInfo{
+		file("d", time.Hour, 10),
+		file("c", 2*24*time.Hour, 20),
+		file("b", 5*24*time.Hour, 30),
+		file("a", 9*24*time.Hour, 40),
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy retentionPolicy
+		want   string
+	}{
+		{"unlimited", retentionPolicy{}, ""},
+		{"max age", retentionPolicy{MaxAge: 3 * 24 * time.Hour}, "b,a"},
+		{"max files", retentionPolicy{MaxFiles: 3}, "a"},
+		{"max bytes", retentionPolicy{MaxBytes: 35}, "b,a"},
+		{"strictest rule wins", retentionPolicy{MaxAge: 7 * 24 * time.Hour, MaxFiles: 1}, "c,b,a"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range tt.policy.expired(files, now) {
+				got = append(got, f.Name)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("got %v want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnforceRetention(t *testing.T) {
+	a, _, store, audit := newEditApp(t)
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		putFile(t, store, name, "cam-1", name)
+		time.Sleep(2 * time.Millisecond)
+	}
+	putFile(t, store, "other.png", "cam-2", "other")
+
+	n, err := a.enforceRetention(context.Background(), retentionPolicy{MaxFiles: 2})
+
+	assertNoError(t, err)
+	if n != 1 {
+		t.Errorf("deleted %d files, want 1", n)
+	}
+	if files, _ := store.List(context.Background(), blobstore.Query{Name: "a.png"}); len(files) != 0 {
+		t.Error("oldest file of cam-1 was kept")
+	}
+	assertFileCount(t, store, 3)
+	if records := audit.all(); len(records) != 1 || records[0].Username != "janitor" || records[0].Action != "expire" || records[0].Filename != "a.png" {
+		t.Errorf("got audit records %v", records)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	store := blobstore.NewMemory()
+	putFile(t, store, "a.png", "cam-1", "01234")
+	putFile(t, store, "b.png", "cam-1", "56789")
+
+	for _, tt := range []struct {
+		name     string
+		policy   retentionPolicy
+		clientID string
+		size     int64
+		refused  bool
+	}{
+		{"unlimited", retentionPolicy{}, "cam-1", 100, false},
+		{"room for one more file", retentionPolicy{MaxFiles: 3}, "cam-1", 1, false},
+		{"at the file limit", retentionPolicy{MaxFiles: 2}, "cam-1", 1, true},
+		{"fills the byte quota exactly", retentionPolicy{MaxBytes: 15}, "cam-1", 5, false},
+		{"one byte over the byte quota", retentionPolicy{MaxBytes: 15}, "cam-1", 6, true},
+		{"at the byte limit, size unknown", retentionPolicy{MaxBytes: 10}, "cam-1", -1, false},
+		{"over the byte limit, size unknown", retentionPolicy{MaxBytes: 9}, "cam-1", -1, true},
+		{"larger than the quota", retentionPolicy{MaxBytes: 15}, "cam-2", 16, true},
+		{"other clients are not counted", retentionPolicy{MaxFiles: 1, MaxBytes: 5}, "cam-2", 5, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.checkQuota(context.Background(), store, tt.clientID, tt.size)
+
+			if refused := errors.Is(err, errOverQuota); refused != tt.refused {
+				t.Errorf("got %v, want refused %v", err, tt.refused)
+			}
+		})
+	}
+}
+
+func TestIngestQuota(t *testing.T) {
+	newIngest := func(t *testing.T, quota retentionPolicy) (*ingestServer, blobstore.BlobStore) {
+		store := blobstore.NewMemory()
+		putFile(t, store, "old.png", "cam-1", "0123456789")
+		return &ingestServer{store: store, sessions: newInMemorySessionStore(), quota: quota}, store
+	}
+
+	t.Run("client over quota is refused", func(t *testing.T) {
+		ingest, store := newIngest(t, retentionPolicy{MaxBytes: 8})
+		sum := sha256.Sum256([]byte("png"))
+		header := protocol.Header{Filename: "frame9.png", ClientID: "cam-1", Checksum: sum[:]}
+
+		_, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader("png"), 3)
+
+		assertAckStatus(t, err, protocol.StatusQuotaExceeded)
+		assertFileCount(t, store, 1)
+	})
+	t.Run("upload larger than the quota is refused", func(t *testing.T) {
+		ingest, store := newIngest(t, retentionPolicy{MaxBytes: 15})
+		sum := sha256.Sum256([]byte(strings.Repeat("x", 20)))
+		header := protocol.Header{Filename: "big.bin", ClientID: "cam-2", Checksum: sum[:]}
+
+		_, err := protocol.Upload(dialIngest(t, ingest), header, strings.NewReader(strings.Repeat("x", 20)), 20)
+
+		assertAckStatus(t, err, protocol.StatusQuotaExceeded)
+		assertFileCount(t, store, 1)
+	})
+	t.Run("other clients are not affected", func(t *testing.T) {
+		ingest, store := newIngest(t, retentionPolicy{MaxFiles: 1, MaxBytes: 5})
+		ack := uploadOverTCP(t, ingest, "frame9.png", "cam-2", "png")
+
+		if ack.Status != protocol.StatusOK {
+			t.Errorf("got %v", ack)
+		}
+		assertFileCount(t, store, 2)
+	})
+}
+
+func TestUploadQuota(t *testing.T) {
+	a, cookie, store, _ := newEditApp(t)
+	a.quota = retentionPolicy{MaxFiles: 1}
+	putFile(t, store, "a.png", "cam-1", "a")
+	putFile(t, store, "b.png", "cam-1", "b")
+	body, contentType := uploadForm(t, nil, map[string]string{"frame9.png": "png bytes"})
+
+	response := postUpload(a, cookie, body, contentType, http.Header{csrfHeader: {csrfOf(a, cookie)}})
+
+	assertStatus(t, response.Code, http.StatusInsufficientStorage)
+	assertFileCount(t, store, 2)
+}
+
+func TestUploadOverQuotaIsDeleted(t *testing.T) {
+	a, cookie, store, _ := newEditApp(t)
+	a.quota = retentionPolicy{MaxBytes: 10}
+	putFile(t, store, "a.png", "cam-1", "01234")
+	body, contentType := uploadForm(t, nil, map[string]string{"frame9.png": "png bytes"})
+
+	response := postUpload(a, cookie, body, contentType, http.Header{csrfHeader: {csrfOf(a, cookie)}})
+
+	assertStatus(t, response.Code, http.StatusInsufficientStorage)
+	assertFileCount(t, store, 1)
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	a, cookie, store, _ := newEditApp(t)
+	a.maxFileSize = 4
+	body, contentType := uploadForm(t, nil, map[string]string{"frame9.png": strings.Repeat("x", maxFormOverhead)})
+
+	response := postUpload(a, cookie, body, contentType, http.Header{csrfHeader: {csrfOf(a, cookie)}})
+
+	assertStatus(t, response.Code, http.StatusRequestEntityTooLarge)
+	assertFileCount(t, store, 0)
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
+	"example.com/hello/blobstore"
+	"example.com/hello/config"
+	"example.com/hello/lucky2/filenames"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -35,211 +46,532 @@ func getLocalIP() (string, error) {
 	return "", fmt.Errorf("no IPv4 address found")
 }
 
-func connectToDB() *mongo.Client {
-	clientOptions := options.Client().ApplyURI(mongoURI)
+// connectToDB creates the MongoDB client shared by the whole process. The
+// driver connects lazily, so a database that is down at startup only makes
+// requests fail with 503 until it comes back.
+func connectToDB(uri string) (*mongo.Client, error) {
+	clientOptions := options.Client().ApplyURI(uri).SetServerSelectionTimeout(5 * time.Second)
 	client, err := mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
-		fmt.Println("Error connecting to MongoDB:", err)
-		return nil
+		return nil, err
 	}
-	err = client.Ping(context.TODO(), nil)
-	if err != nil {
-		fmt.Println("Could not ping MongoDB:", err)
-		return nil
+	if err := client.Ping(context.TODO(), nil); err != nil {
+		slog.Warn("could not ping MongoDB", "err", err)
+		return client, nil
 	}
-	fmt.Println("Connected to MongoDB!")
-	return client
+	slog.Info("connected to MongoDB")
+	return client, nil
+}
+
+// app owns the MongoDB connection and file store for the lifetime of the
+// process; the HTTP handlers hang off it.
+type app struct {
+	client      *mongo.Client
+	files       blobstore.BlobStore
+	auth        *authService
+	thumbs      *thumbnailCache
+	auditLog    auditLog
+	quota       retentionPolicy
+	maxFileSize int64     // of browser uploads, as on the ingest port; 0 is unlimited
+	hooks       *pipeline // nil when stored files are not processed
+	events      *eventBus
 }
 
-const httpPort = ":5000"
-const mongoURI = "mongodb://localhost:27017"
-const databaseName = "fileStore"
+func newApp(client *mongo.Client, files blobstore.BlobStore, users userStore, tokens tokenStore, audit auditLog) *app {
+	a := &app{
+		client:   client,
+		files:    files,
+		auth:     &authService{users: users, sessions: newWebSessions(24 * time.Hour), tokens: tokens},
+		thumbs:   newThumbnailCache(),
+		auditLog: audit,
+		events:   newEventBus(),
+	}
+	blobstore.OnPrune(files, a.pruned)
+	return a
+}
+
+func (a *app) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/login", a.auth.loginHandler)
+	mux.Handle("/logout", a.auth.authMiddleware(csrfProtect(http.HandlerFunc(a.auth.logoutHandler))))
+	mux.Handle("/download", a.auth.authMiddleware(http.HandlerFunc(a.downloadHandler)))
+	mux.Handle("/view", a.auth.authMiddleware(http.HandlerFunc(a.viewHandler)))
+	mux.Handle("/thumbnail", a.auth.authMiddleware(http.HandlerFunc(a.thumbnailHandler)))
+	mux.Handle("/files", a.auth.authMiddleware(http.HandlerFunc(a.filesListHandler)))
+	mux.Handle("/files/archive", a.auth.authMiddleware(http.HandlerFunc(a.archiveHandler)))
+	mux.Handle("/files/events", a.auth.authMiddleware(http.HandlerFunc(a.eventsHandler)))
+	a.apiRoutes(mux)
+	mux.Handle("/upload", a.auth.authMiddleware(http.HandlerFunc(a.uploadHandler)))
+	mux.Handle("/files/delete", a.auth.authMiddleware(csrfProtect(http.HandlerFunc(a.deleteHandler))))
+	mux.Handle("/files/rename", a.auth.authMiddleware(csrfProtect(http.HandlerFunc(a.renameHandler))))
+	mux.Handle("/files/annotate", a.auth.authMiddleware(csrfProtect(http.HandlerFunc(a.annotateHandler))))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", a.readyzHandler)
+	mux.Handle("/metrics", metrics)
+	return instrument(mux)
+}
 
 func main() {
-	go func() {
-		port := ":55000"
-		localIP, err := getLocalIP()
+	httpAddr := flag.String("http-addr", ":5000", "address of the web portal and API")
+	ingestAddr := flag.String("ingest-addr", ":55000", "address of the ingest server; without a host it listens on the machine's first IPv4 address")
+	sessionTTL := flag.Duration("session-ttl", 24*time.Hour, "how long an idle resumable upload session is kept")
+	tlsCert := flag.String("tls-cert", "", "ingest server certificate (PEM); enables TLS")
+	tlsKey := flag.String("tls-key", "", "ingest server private key (PEM)")
+	clientCA := flag.String("client-ca", "", "CA bundle for client certificates (PEM); enables mutual TLS")
+	userBackend := flag.String("user-store", "mongo", `where portal accounts and API tokens are kept: "mongo" or "memory"`)
+	addUser := flag.String("add-user", "", "create or reset a portal account, reading its password from stdin, and exit")
+	addUserClients := flag.String("clients", "", "comma-separated client IDs the -add-user account may access")
+	addUserAdmin := flag.Bool("admin", false, "give the -add-user account access to every file")
+	var retention retentionPolicy
+	flag.DurationVar(&retention.MaxAge, "retain-max-age", 0, "delete files older than this; 0 keeps them forever")
+	flag.Int64Var(&retention.MaxBytes, "quota-bytes", 0, "bytes each client may store; 0 is unlimited")
+	flag.IntVar(&retention.MaxFiles, "quota-files", 0, "files each client may store; 0 is unlimited")
+	var limits ingestLimits
+	limits.registerFlags(flag.CommandLine)
+	processorNames := flag.String("processors", "dimensions,thumbnail,hashes", "comma-separated processors run on every stored file: dimensions, thumbnail, hashes")
+	hookWorkers := flag.Int("processor-workers", 2, "files processed at once")
+	hookRetries := flag.Int("processor-retries", 3, "how often a failed processor is retried")
+	webhookURL := flag.String("webhook-url", "", "URL POSTed a JSON event for every stored file")
+	eventWebhookURL := flag.String("event-webhook-url", "", "URL POSTed a signed JSON event whenever an upload starts, completes or fails and a file is deleted")
+	eventWebhookSecret := flag.String("event-webhook-secret", "", "key event webhook requests are signed with (HMAC-SHA256)")
+	eventWebhookRetries := flag.Int("event-webhook-retries", 5, "how often a failed event webhook delivery is retried")
+	janitorInterval := flag.Duration("janitor-interval", time.Hour, "how often retention rules are enforced")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long uploads in flight may take to finish on shutdown")
+	logFormat := flag.String("log-format", "text", `log output: "text" or "json"`)
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "lowest level logged: DEBUG, INFO, WARN or ERROR")
+	var storeConfig blobstore.Config
+	storeConfig.RegisterFlags(flag.CommandLine)
+	settings := config.New(flag.CommandLine, "LUCKY2")
+	settings.Secret("event-webhook-secret")
+	settings.Check(func() error { return storeConfig.Validate() })
+	settings.Check(func() error { return limits.validate() })
+	settings.Check(func() error {
+		switch {
+		case *userBackend != "mongo" && *userBackend != "memory":
+			return fmt.Errorf(`-user-store must be "mongo" or "memory", not %q`, *userBackend)
+		case (*tlsCert == "") != (*tlsKey == ""):
+			return errors.New("-tls-cert and -tls-key must be given together")
+		case *clientCA != "" && *tlsCert == "":
+			return errors.New("-client-ca needs -tls-cert")
+		case retention.MaxAge < 0 || retention.MaxBytes < 0 || retention.MaxFiles < 0:
+			return errors.New("retention limits must not be negative")
+		case *hookWorkers < 1 || *hookRetries < 0:
+			return errors.New("-processor-workers must be positive and -processor-retries not negative")
+		case *eventWebhookRetries < 0:
+			return errors.New("-event-webhook-retries must not be negative")
+		case *sessionTTL <= 0 || *janitorInterval <= 0 || *shutdownTimeout <= 0:
+			return errors.New("-session-ttl, -janitor-interval and -shutdown-timeout must be positive")
+		}
+		if _, err := newLogger(*logFormat, logLevel); err != nil {
+			return err
+		}
+		if _, err := newProcessors(&app{}, *processorNames, *webhookURL); err != nil {
+			return err
+		}
+		if *eventWebhookURL != "" {
+			if _, err := newWebhookSender(*eventWebhookURL, *eventWebhookSecret, *eventWebhookRetries); err != nil {
+				return err
+			}
+		}
+		for _, addr := range []string{*httpAddr, *ingestAddr} {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	settings.MustParse(os.Args[1:])
+
+	logger, err := newLogger(*logFormat, logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	var client *mongo.Client
+	if storeConfig.Backend == "gridfs" || *userBackend == "mongo" {
+		var err error
+		client, err = connectToDB(storeConfig.MongoURI)
 		if err != nil {
-			fmt.Println("Error getting local IP:", err)
+			slog.Error("connecting to MongoDB", "err", err)
 			return
 		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := client.Disconnect(ctx); err != nil {
+				slog.Error("disconnecting from MongoDB", "err", err)
+			}
+		}()
+	}
 
-		listener, err := net.Listen("tcp", localIP+port)
+	var users userStore = newInMemoryUserStore()
+	var tokens tokenStore = newInMemoryTokenStore()
+	if *userBackend == "mongo" {
+		users = newMongoUserStore(client.Database(storeConfig.Database))
+		tokens = newMongoTokenStore(client.Database(storeConfig.Database))
+	}
+	if *addUser != "" {
+		account := user{Username: *addUser, Admin: *addUserAdmin}
+		if *addUserClients != "" {
+			account.ClientIDs = strings.Split(*addUserClients, ",")
+		}
+		if err := addUserFromReader(context.TODO(), users, account, os.Stdin); err != nil {
+			slog.Error("adding user", "err", err)
+			return
+		}
+		slog.Info("user saved", "user", *addUser)
+		return
+	}
+	if err := bootstrapAdmin(context.TODO(), users, os.Getenv("LUCKY2_ADMIN_PASSWORD")); err != nil {
+		slog.Error("creating admin user", "err", err)
+	}
+
+	// Resumable upload chunks are staged next to the files: in MongoDB for
+	// GridFS, in memory otherwise.
+	var files blobstore.BlobStore
+	var sessions sessionStore
+	if storeConfig.Backend == "gridfs" {
+		var gridFS *blobstore.GridFS
+		gridFS, err = blobstore.NewGridFS(client.Database(storeConfig.Database))
+		if err == nil {
+			gridFS.Dedup = storeConfig.Dedup
+			// Без индексов список работает, только медленнее
+			if indexErr := gridFS.EnsureIndexes(context.TODO()); indexErr != nil {
+				slog.Warn("creating file indexes", "err", indexErr)
+			}
+		}
+		files = blobstore.WithVersionPolicy(gridFS, storeConfig.Versions)
+		sessions = newMongoSessionStore(client.Database(storeConfig.Database))
+	} else {
+		files, err = blobstore.Open(context.TODO(), storeConfig)
+		sessions = newInMemorySessionStore()
+	}
+	if err != nil {
+		slog.Error("opening file store", "err", err)
+		return
+	}
+	defer files.Close()
+	// Audit records always go to stdout, and to MongoDB whenever it is in
+	// use.
+	var audit auditLog
+	if client != nil {
+		audit = newMongoAuditLog(client.Database(storeConfig.Database))
+	}
+	a := newApp(client, files, users, tokens, audit)
+	a.quota = retention
+	a.maxFileSize = limits.MaxFileSize
+	processors, err := newProcessors(a, *processorNames, *webhookURL)
+	if err != nil {
+		slog.Error("setting up processors", "err", err)
+		return
+	}
+	a.hooks = newPipeline(a.files, processors, *hookRetries)
+	var webhooks *webhookSender
+	if *eventWebhookURL != "" {
+		webhooks, err = newWebhookSender(*eventWebhookURL, *eventWebhookSecret, *eventWebhookRetries)
 		if err != nil {
-			fmt.Println("Error starting server:", err)
+			slog.Error("setting up event webhooks", "err", err)
 			return
 		}
-		defer listener.Close()
-		fmt.Println("TCP Server listening on port", port)
+	}
+
+	// Фоновые задачи останавливаются вместе с сервером
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var background sync.WaitGroup
+	if retention.enabled() {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			a.runJanitor(ctx, retention, *janitorInterval)
+		}()
+	}
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		a.hooks.run(ctx, *hookWorkers)
+	}()
+	if webhooks != nil {
+		sub := a.events.subscribe("webhook", hookQueueSize)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			webhooks.run(ctx, sub)
+		}()
+	}
 
-		client := connectToDB()
-		defer client.Disconnect(context.TODO())
+	ingest := &ingestServer{store: a.files, sessions: sessions, quota: retention, limits: limits, hooks: a.hooks, events: a.events}
+	if limits.Rate > 0 {
+		ingest.limiter = newRateLimiter(limits.Rate, limits.Burst)
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		ingest.expireSessions(ctx, *sessionTTL, max(min(*sessionTTL/4, time.Hour), time.Second))
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		a.auth.sessions.expireEvery(ctx, time.Hour)
+	}()
 
-		gridFSBucket, err := gridfs.NewBucket(client.Database(databaseName))
+	go func() {
+		addr := *ingestAddr
+		if strings.HasPrefix(addr, ":") {
+			localIP, err := getLocalIP()
+			if err != nil {
+				slog.Error("getting local IP", "err", err)
+				return
+			}
+			addr = localIP + addr
+		}
+
+		listener, err := net.Listen("tcp", addr)
 		if err != nil {
-			fmt.Println("Error creating GridFS bucket:", err)
+			slog.Error("starting ingest server", "err", err)
 			return
 		}
 
-		for {
-			conn, err := listener.Accept()
+		if *tlsCert != "" {
+			tlsConfig, err := loadTLSConfig(*tlsCert, *tlsKey, *clientCA)
 			if err != nil {
-				fmt.Println("Error accepting connection:", err)
-				continue
+				listener.Close()
+				slog.Error("loading TLS configuration", "err", err)
+				return
 			}
-			go handleConnection(conn, gridFSBucket)
+			listener = tls.NewListener(listener, tlsConfig)
+			slog.Info("TLS enabled", "mutualTLS", *clientCA != "")
 		}
+		slog.Info("ingest server listening", "addr", listener.Addr().String())
+		ingest.serve(listener)
 	}()
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-	})
-	http.HandleFunc("/login", loginHandler)
-	http.HandleFunc("/logout", logoutHandler)
-	http.Handle("/download", authMiddleware(http.HandlerFunc(downloadHandler)))
-	http.Handle("/files", authMiddleware(http.HandlerFunc(filesListHandler)))
 
-	httpServer := &http.Server{Addr: httpPort}
+	httpServer := &http.Server{Addr: *httpAddr, Handler: a.routes()}
+	// Потоки событий не заканчиваются сами и задержали бы остановку
+	httpServer.RegisterOnShutdown(a.events.close)
 	go func() {
-		fmt.Printf("HTTP server started on %s\n", httpPort)
-		if err := httpServer.ListenAndServe(); err != nil {
-			fmt.Println("HTTP server error:", err)
+		slog.Info("HTTP server listening", "addr", *httpAddr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server", "err", err)
 		}
 	}()
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-	<-signalChan
-	fmt.Println("Shutting down...")
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	shutdown(shutdownCtx, ingest, httpServer)
+	background.Wait()
+	slog.Info("shutdown complete")
 }
 
-func handleConnection(conn net.Conn, gridFSBucket *gridfs.Bucket) {
-	defer conn.Close()
-	var fileNameLen int32
-	if err := binary.Read(conn, binary.BigEndian, &fileNameLen); err != nil {
-		fmt.Println("Error reading filename length:", err)
-		conn.Close()
-		return
-	}
-	if fileNameLen <= 0 || fileNameLen > 255 {
-		fmt.Println("Invalid filename length")
-		conn.Close()
-		return
-	}
-	fmt.Println("len of filename:", fileNameLen)
+// shutdown stops the ingest and HTTP servers together. Both stop accepting
+// at once and get until ctx is done to finish what is in flight; after that
+// open connections are closed, which aborts the uploads on them.
+func shutdown(ctx context.Context, ingest *ingestServer, httpServer *http.Server) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := ingest.shutdown(ctx); err != nil {
+			slog.Warn("ingest uploads aborted", "err", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Warn("HTTP requests aborted", "err", err)
+			httpServer.Close()
+		}
+	}()
+	wg.Wait()
+}
 
-	fileName := make([]byte, fileNameLen)
-	if _, err := io.ReadFull(conn, fileName); err != nil {
-		fmt.Println("Error reading filename:", err)
-		conn.Close()
-		return
+// httpErrorFunc writes an error response; http.Error is one, apiError
+// another.
+type httpErrorFunc func(w http.ResponseWriter, message string, code int)
+
+// storeHTTPError reports a fileStore error with the matching status code.
+func storeHTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	reportStoreError(w, err, http.Error)
+}
+
+func reportStoreError(w http.ResponseWriter, err error, fail httpErrorFunc) {
+	switch {
+	case errors.Is(err, blobstore.ErrNotFound):
+		fail(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, blobstore.ErrInvalidQuery):
+		fail(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, blobstore.ErrUnavailable):
+		fail(w, "File store unavailable", http.StatusServiceUnavailable)
+	default:
+		slog.Error("file store", "err", err)
+		fail(w, "File store error", http.StatusInternalServerError)
 	}
+}
 
-	var clientIDLen int32
-	if err := binary.Read(conn, binary.BigEndian, &clientIDLen); err != nil {
-		fmt.Println("Error reading ClientID length:", err)
-		return
+// openRequested opens the file named by the filename and revision query
+// parameters. On failure it writes the error response and reports false.
+func (a *app) openRequested(w http.ResponseWriter, r *http.Request) (io.ReadSeekCloser, blobstore.FileInfo, bool) {
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		http.Error(w, "Filename is required", http.StatusBadRequest)
+		return nil, blobstore.FileInfo{}, false
+	}
+	revision, err := parseRevision(r.URL.Query().Get("revision"))
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return nil, blobstore.FileInfo{}, false
 	}
 
-	clientID := make([]byte, clientIDLen)
-	if _, err := io.ReadFull(conn, clientID); err != nil {
-		fmt.Println("Error reading ClientID:", err)
-		return
+	// Берём запрошенную ревизию среди файлов, доступных пользователю. Чужие
+	// файлы отдаются как 404, чтобы не раскрывать их существование.
+	stream, file, err := a.openRevision(r.Context(), currentUser(r.Context()), filename, revision)
+	if err != nil {
+		storeHTTPError(w, r, err)
+		return nil, blobstore.FileInfo{}, false
 	}
+	return stream, file, true
+}
 
-	fmt.Printf("Receiving data for file: %s (ClientID: %s)\n", fileName, clientID)
+// downloadHandler serves a file as an attachment.
+func (a *app) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	a.serveFile(w, r, false)
+}
 
-	opts := options.GridFSUpload().
-		SetMetadata(bson.D{{"clientID", string(clientID)}})
+// viewHandler serves a file for display in the browser. Types that are not
+// safe to render in the portal's origin are still sent as attachments.
+func (a *app) viewHandler(w http.ResponseWriter, r *http.Request) {
+	a.serveFile(w, r, true)
+}
 
-	uploadStream, err := gridFSBucket.OpenUploadStream(
-		string(fileName),
-		opts,
-	)
-	if err != nil {
-		fmt.Println("Error opening upload stream:", err)
-		conn.Close()
+// serveFile serves GET and HEAD of the file named in the query with
+// support for Range, If-None-Match and If-Modified-Since.
+func (a *app) serveFile(w http.ResponseWriter, r *http.Request, inline bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	downloadStream, file, ok := a.openRequested(w, r)
+	if !ok {
 		return
 	}
+	defer downloadStream.Close()
+	serveStream(w, r, downloadStream, file, inline)
+}
 
-	_, err = io.Copy(uploadStream, conn)
-	if err != nil {
-		fmt.Println("Error uploading data:", err)
+// serveStream sends an opened file.
+func serveStream(w http.ResponseWriter, r *http.Request, downloadStream io.ReadSeeker, file blobstore.FileInfo, inline bool) {
+	filename := path.Base(file.Name)
+
+	// Устанавливаем заголовки
+	if digest := fileDigest(file); digest != nil {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(digest))
+	}
+	w.Header().Set("ETag", fileETag(file))
+	if inline {
+		contentType, err := contentType(file, downloadStream)
+		if err != nil {
+			storeHTTPError(w, r, err)
+			return
+		}
+		inline = inlineSafe(contentType)
+		if inline {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Content-Security-Policy", "sandbox")
+		}
+	}
+	if inline {
+		w.Header().Set("Content-Disposition", filenames.ContentDisposition("inline", filename))
 	} else {
-		fmt.Println("Data received and uploaded successfully")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", filenames.ContentDisposition("attachment", filename))
 	}
-	uploadStream.Close()
+
+	// Отправляем данные; ServeContent обрабатывает Range и условные запросы
+	http.ServeContent(w, r, filename, file.UploadDate, downloadStream)
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	filename := r.URL.Query().Get("filename")
-	if filename == "" {
-		http.Error(w, "Filename is required", http.StatusBadRequest)
+// thumbnailHandler serves a small PNG preview of an image file.
+func (a *app) thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	stream, file, ok := a.openRequested(w, r)
+	if !ok {
+		return
+	}
+	defer stream.Close()
+	if !hasThumbnail(file) {
+		http.Error(w, "No preview for this file type", http.StatusUnsupportedMediaType)
 		return
 	}
 
-	// Подключаемся к MongoDB
-	client := connectToDB()
-	defer client.Disconnect(context.TODO())
+	thumb, ok := a.thumbs.get(file.ID)
+	if !ok {
+		var err error
+		thumb, err = makeThumbnail(stream)
+		if err != nil {
+			slog.Warn("making thumbnail", "err", err)
+			http.Error(w, "Could not make a preview", http.StatusUnprocessableEntity)
+			return
+		}
+		a.thumbs.put(file.ID, thumb)
+	}
 
-	gridFSBucket, err := gridfs.NewBucket(client.Database(databaseName))
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", strings.TrimSuffix(fileETag(file), `"`)+`-thumb"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", file.UploadDate, bytes.NewReader(thumb))
+}
+
+func (a *app) filesListHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := parseListing(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Error connecting to GridFS", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Проверяем существование файла
-
-	// Скачиваем файл
-	downloadStream, err := gridFSBucket.OpenDownloadStreamByName(filename)
+	// Выбираем страницу файлов, доступных пользователю
+	u := currentUser(r.Context())
+	files, usage, err := a.list(r.Context(), u, l)
 	if err != nil {
-		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		storeHTTPError(w, r, err)
 		return
 	}
-	defer downloadStream.Close()
-
-	// Устанавливаем заголовки
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-
-	// Отправляем данные
-	if _, err := io.Copy(w, downloadStream); err != nil {
-		http.Error(w, "Error sending file", http.StatusInternalServerError)
+	groups, err := a.pageGroups(r.Context(), u, files)
+	if err != nil {
+		storeHTTPError(w, r, err)
 		return
 	}
-}
-
-func filesListHandler(w http.ResponseWriter, r *http.Request) {
-	// Подключаемся к MongoDB
-	client := connectToDB()
-	defer client.Disconnect(context.TODO())
-
-	// Получаем коллекцию GridFS
-	db := client.Database(databaseName)
-	filesCollection := db.Collection("fs.files") // Коллекция с метаданными файлов
-
-	// Выбираем все документы d
-	cursor, err := filesCollection.Find(context.Background(), bson.M{})
+	folders, err := a.folders(r.Context(), u, l)
 	if err != nil {
-		http.Error(w, "Error fetching files", http.StatusInternalServerError)
+		storeHTTPError(w, r, err)
 		return
 	}
-	defer cursor.Close(context.Background())
-
-	// Собираем имена файлов
-	var filenames []string
-	for cursor.Next(context.Background()) {
-		var file struct {
-			Filename string `bson:"filename"`
-		}
-		if err := cursor.Decode(&file); err != nil {
-			http.Error(w, "Error decoding file", http.StatusInternalServerError)
-			return
-		}
-		filenames = append(filenames, file.Filename)
+	folder := l.Query.Folder
+	var folderLinks []folderLink
+	for _, f := range folders {
+		folderLinks = append(folderLinks, folderLink{Name: path.Base(f), URL: folderURL(f)})
 	}
 
-	// Отображаем шаблон с списком файлов
-	tmpl := template.Must(template.New("files").Parse(`
+	// Отображаем шаблон с списком файлов, сгруппированных по имени
+	tmpl := template.Must(template.New("files").Funcs(template.FuncMap{
+		"kind":         fileKind,
+		"size":         humanSize,
+		"hasThumbnail": hasThumbnail,
+		"date":         func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+		"join":         strings.Join,
+		"typeFilters":  func() map[string]string { return typeFilters },
+		"relative":     func(name string) string { return strings.TrimPrefix(name, folder+"/") },
+	}).Parse(`
 	<!DOCTYPE html>
 	<html lang="en">
 	<head>
@@ -278,12 +610,102 @@ func filesListHandler(w http.ResponseWriter, r *http.Request) {
 			}
 	
 			li {
+				display: flex;
+				align-items: center;
+				gap: 15px;
 				background: #333;
 				margin: 10px 0;
 				padding: 15px;
 				border-radius: 5px;
 				transition: all 0.3s ease;
 			}
+
+			.preview {
+				flex: none;
+				width: 64px;
+				height: 64px;
+				display: flex;
+				align-items: center;
+				justify-content: center;
+				font-size: 2rem;
+				background: #222;
+				border-radius: 5px;
+				overflow: hidden;
+			}
+
+			.preview img {
+				max-width: 100%;
+				max-height: 100%;
+			}
+
+			.name {
+				flex: 1;
+				word-break: break-all;
+			}
+
+			.size {
+				color: #aaa;
+				white-space: nowrap;
+			}
+
+			.details {
+				flex: 1;
+				min-width: 0;
+			}
+
+			details {
+				margin-top: 8px;
+				color: #aaa;
+				font-size: 0.9em;
+			}
+
+			summary {
+				cursor: pointer;
+			}
+
+			table {
+				width: 100%;
+				margin-top: 8px;
+				border-collapse: collapse;
+			}
+
+			td {
+				padding: 4px 8px 4px 0;
+			}
+
+			td form {
+				margin: 0;
+			}
+
+			details form {
+				display: flex;
+				gap: 8px;
+				margin-top: 8px;
+			}
+
+			details input[type=text] {
+				flex: 1;
+				padding: 4px;
+				background: #222;
+				color: #f5f5f5;
+				border: 1px solid #555;
+				border-radius: 3px;
+			}
+
+			.description {
+				color: #ccc;
+				font-size: 0.9em;
+				margin-top: 4px;
+			}
+
+			.tag {
+				display: inline-block;
+				margin: 4px 4px 0 0;
+				padding: 1px 6px;
+				background: #27ae60;
+				border-radius: 3px;
+				font-size: 0.8em;
+			}
 	
 			li:hover {
 				background: #444;
@@ -301,6 +723,72 @@ func filesListHandler(w http.ResponseWriter, r *http.Request) {
 				color: #3498db;
 			}
 	
+			.drop {
+				padding: 20px;
+				border: 2px dashed #555;
+				border-radius: 10px;
+				text-align: center;
+				transition: all 0.3s ease;
+			}
+
+			.drop.over {
+				border-color: #27ae60;
+				background: #333;
+			}
+
+			#progress li {
+				display: block;
+			}
+
+			#progress progress {
+				width: 100%;
+				margin-top: 6px;
+			}
+
+			.notice {
+				display: block;
+				margin: 10px 0;
+				padding: 10px;
+				background: #333;
+				border-left: 3px solid #3498db;
+			}
+
+			.notice[hidden] {
+				display: none;
+			}
+
+			.filter {
+				display: flex;
+				flex-wrap: wrap;
+				gap: 8px;
+				margin: 1rem 0;
+				align-items: center;
+			}
+
+			.filter input, .filter select {
+				padding: 4px;
+				background: #222;
+				color: #f5f5f5;
+				border: 1px solid #555;
+				border-radius: 3px;
+			}
+
+			.crumbs {
+				margin-bottom: 1rem;
+				color: #aaa;
+			}
+
+			.crumbs .archive {
+				float: right;
+			}
+
+			.pages {
+				display: flex;
+				justify-content: space-between;
+				margin-top: 1rem;
+				color: #aaa;
+			}
+
 			.back-link {
 				display: block;
 				text-align: center;
@@ -314,25 +802,339 @@ func filesListHandler(w http.ResponseWriter, r *http.Request) {
 			.back-link:hover {
 				background: #2ecc71;
 			}
+
+			button.back-link {
+				width: 100%;
+				border: none;
+				color: inherit;
+				font: inherit;
+				cursor: pointer;
+			}
 		</style>
 	</head>
 	<body>
 		<div class="container">
 			<h2>Файл менеджер</h2>
+			<nav class="crumbs">
+				{{range $i, $crumb := .Crumbs}}{{if $i}} / {{end}}<a href="{{$crumb.URL}}">{{$crumb.Name}}</a>{{end}}
+				<span class="archive">Скачать папку: <a href="{{.Archive}}&format=zip">ZIP</a> · <a href="{{.Archive}}&format=tar.gz">tar.gz</a></span>
+			</nav>
+			<form id="upload" class="drop" action="/upload" method="POST" enctype="multipart/form-data" data-csrf="{{.CSRF}}">
+				<input type="hidden" name="csrf" value="{{.CSRF}}">
+				<input type="hidden" name="folder" id="folder" value="{{.Folder}}">
+				{{if gt (len .ClientIDs) 1}}
+					<select name="clientID" id="clientID">
+						{{range .ClientIDs}}<option>{{.}}</option>{{end}}
+					</select>
+				{{end}}
+				<p>Перетащите файлы сюда или</p>
+				<input type="file" name="file" id="picker" multiple>
+				<button type="submit">Загрузить</button>
+			</form>
+			<ul id="progress" data-user="{{.User}}"></ul>
+			<a id="changes" class="notice" href="" hidden>Список файлов изменился — обновить</a>
+			<form class="filter" action="/files" method="GET">
+				<input type="hidden" name="dir" value="{{.Folder}}">
+				<input type="text" name="name" placeholder="Имя или маска (*.jpg)" value="{{.Filter.Get "name"}}">
+				<select name="type">
+					<option value="">Любой тип</option>
+					{{$type := .Filter.Get "type"}}
+					{{range $value, $label := typeFilters}}<option value="{{$value}}"{{if eq $value $type}} selected{{end}}>{{$label}}</option>{{end}}
+				</select>
+				{{if gt (len .ClientIDs) 1}}
+					{{$client := .Filter.Get "clientID"}}
+					<select name="clientID">
+						<option value="">Все клиенты</option>
+						{{range .ClientIDs}}<option{{if eq . $client}} selected{{end}}>{{.}}</option>{{end}}
+					</select>
+				{{end}}
+				<label>с <input type="date" name="from" value="{{.Filter.Get "from"}}"></label>
+				<label>по <input type="date" name="to" value="{{.Filter.Get "to"}}"></label>
+				<input type="number" name="minSize" min="0" placeholder="От, байт" value="{{.Filter.Get "minSize"}}">
+				<input type="number" name="maxSize" min="0" placeholder="До, байт" value="{{.Filter.Get "maxSize"}}">
+				{{$sort := .Filter.Get "sort"}}
+				<select name="sort">
+					<option value="date">По дате</option>
+					<option value="name"{{if eq $sort "name"}} selected{{end}}>По имени</option>
+					<option value="size"{{if eq $sort "size"}} selected{{end}}>По размеру</option>
+				</select>
+				<select name="order">
+					<option value="desc">По убыванию</option>
+					<option value="asc"{{if eq (.Filter.Get "order") "asc"}} selected{{end}}>По возрастанию</option>
+				</select>
+				<label><input type="checkbox" name="recursive" value="1"{{if .Filter.Get "recursive"}} checked{{end}}> во вложенных папках</label>
+				<button type="submit">Найти</button>
+				<a href="{{with .Folder}}/files?dir={{.}}{{else}}/files{{end}}">Сбросить</a>
+			</form>
 			<ul>
-				{{range .}}
-					<li><a href="/download?filename={{.}}">{{.}}</a></li>
+				{{range .Folders}}
+					<li>
+						<div class="preview">📁</div>
+						<a class="name" href="{{.URL}}">{{.Name}}/</a>
+					</li>
+				{{end}}
+				{{range .Groups}}
+					{{$latest := .Latest}}
+					<li>
+						<div class="preview">
+							{{if hasThumbnail $latest.FileInfo}}<img src="/thumbnail?filename={{.Name}}" alt="" loading="lazy">
+							{{else if eq (kind $latest.FileInfo) "pdf"}}📕
+							{{else if eq (kind $latest.FileInfo) "image"}}🖼️
+							{{else if eq (kind $latest.FileInfo) "text"}}📄
+							{{else if eq (kind $latest.FileInfo) "archive"}}🗜️
+							{{else}}📦{{end}}
+						</div>
+						<div class="details">
+							<a class="name" href="/view?filename={{.Name}}">{{relative .Name}}</a>
+							{{with $latest.Metadata.Description}}<div class="description">{{.}}</div>{{end}}
+							{{range $latest.Metadata.Tags}}<span class="tag">{{.}}</span>{{end}}
+							<details>
+								<summary>Ревизий: {{len .Revisions}}, последняя {{date $latest.UploadDate}}</summary>
+								<table>
+									{{range .Revisions}}
+										<tr>
+											<td>#{{.Number}}</td>
+											<td>{{date .UploadDate}}</td>
+											<td>{{.Metadata.ClientID}}{{with .Metadata.Uploader}} ({{.}}){{end}}</td>
+											<td>{{size .Size}}</td>
+											<td><a href="/download?filename={{.Name}}&revision={{.Number}}">Скачать</a></td>
+											<td>
+												<form action="/files/delete" method="POST">
+													<input type="hidden" name="csrf" value="{{$.CSRF}}">
+													<input type="hidden" name="filename" value="{{.Name}}">
+													<input type="hidden" name="revision" value="{{.Number}}">
+													<button type="submit">Удалить</button>
+												</form>
+											</td>
+										</tr>
+									{{end}}
+								</table>
+								<form action="/files/annotate" method="POST">
+									<input type="hidden" name="csrf" value="{{$.CSRF}}">
+									<input type="hidden" name="filename" value="{{.Name}}">
+									<input type="text" name="tags" placeholder="Теги через запятую" value="{{join $latest.Metadata.Tags ", "}}">
+									<input type="text" name="description" placeholder="Описание" value="{{$latest.Metadata.Description}}">
+									<button type="submit">Сохранить</button>
+								</form>
+								<form action="/files/rename" method="POST">
+									<input type="hidden" name="csrf" value="{{$.CSRF}}">
+									<input type="hidden" name="filename" value="{{.Name}}">
+									<input type="text" name="name" value="{{.Name}}" required>
+									<button type="submit">Переименовать</button>
+								</form>
+								<form action="/files/delete" method="POST" onsubmit="return confirm('Удалить все ревизии?')">
+									<input type="hidden" name="csrf" value="{{$.CSRF}}">
+									<input type="hidden" name="filename" value="{{.Name}}">
+									<button type="submit">Удалить все ревизии</button>
+								</form>
+							</details>
+						</div>
+						<span class="size">{{size $latest.Size}}</span>
+						<a href="/download?filename={{.Name}}">Скачать</a>
+					</li>
+				{{else}}
+					{{if not .Folders}}<li>Файлы не найдены</li>{{end}}
 				{{end}}
 			</ul>
-			<a href="/logout" class="back-link">Logout</a>
+			<div class="pages">
+				{{with .Prev}}<a href="{{.}}">← Назад</a>{{end}}
+				<span>Страница {{.Page}} из {{.Pages}}, файлов: {{.Usage.Files}}, {{size .Usage.Bytes}}{{if ne .Usage.Bytes .Usage.StoredBytes}} (на диске {{size .Usage.StoredBytes}}){{end}}</span>
+				{{with .Next}}<a href="{{.}}">Вперёд →</a>{{end}}
+			</div>
+			<form action="/logout" method="POST">
+				<input type="hidden" name="csrf" value="{{.CSRF}}">
+				<button type="submit" class="back-link">Logout</button>
+			</form>
 		</div>
+		<script>
+			// Каждый файл отправляется отдельным запросом, чтобы показать его прогресс
+			(function () {
+				var form = document.getElementById("upload");
+				var picker = document.getElementById("picker");
+				var list = document.getElementById("progress");
+				var pending = 0;
+
+				function upload(file) {
+					var item = document.createElement("li");
+					var label = document.createElement("div");
+					var bar = document.createElement("progress");
+					label.textContent = file.name;
+					bar.max = file.size || 1;
+					bar.value = 0;
+					item.appendChild(label);
+					item.appendChild(bar);
+					list.appendChild(item);
+
+					var data = new FormData();
+					data.append("folder", document.getElementById("folder").value);
+					var client = document.getElementById("clientID");
+					if (client) {
+						data.append("clientID", client.value);
+					}
+					data.append("file", file);
+
+					var xhr = new XMLHttpRequest();
+					xhr.open("POST", "/upload");
+					xhr.setRequestHeader("X-CSRF-Token", form.dataset.csrf);
+					xhr.setRequestHeader("Accept", "application/json");
+					xhr.upload.onprogress = function (e) {
+						if (e.lengthComputable) {
+							bar.max = e.total;
+							bar.value = e.loaded;
+						}
+					};
+					xhr.onload = function () {
+						if (xhr.status === 200) {
+							bar.value = bar.max;
+							label.textContent = file.name + " — готово";
+						} else {
+							label.textContent = file.name + " — ошибка: " + xhr.responseText.trim();
+						}
+						done();
+					};
+					xhr.onerror = function () {
+						label.textContent = file.name + " — ошибка сети";
+						done();
+					};
+					pending++;
+					xhr.send(data);
+				}
+
+				function done() {
+					pending--;
+					if (pending === 0) {
+						reloadSoon();
+					}
+				}
+
+				var reloadTimer;
+				function reloadSoon() {
+					clearTimeout(reloadTimer);
+					reloadTimer = setTimeout(function () { location.reload(); }, 1500);
+				}
+
+				// Загрузки через TCP и удаления в других окнах видны сразу. Пока
+				// пользователь что-то редактирует, страница не перезагружается.
+				function changed(file) {
+					var folder = document.getElementById("folder").value;
+					if (folder && file.name.indexOf(folder + "/") !== 0) {
+						return;
+					}
+					if (pending > 0) {
+						return;
+					}
+					var active = document.activeElement;
+					if (document.querySelector("details[open]") || (active && /^(INPUT|SELECT)$/.test(active.tagName))) {
+						document.getElementById("changes").hidden = false;
+						return;
+					}
+					reloadSoon();
+				}
+
+				var receiving = {};
+				function follow(type, e) {
+					var ev = JSON.parse(e.data);
+					var file = ev.file;
+					if (type === "file.deleted") {
+						changed(file);
+						return;
+					}
+					if (file.metadata.uploader === list.dataset.user) {
+						return; // свои загрузки показаны выше
+					}
+					var key = file.metadata.clientID + "/" + file.name;
+					var item = receiving[key];
+					if (!item) {
+						item = document.createElement("li");
+						list.appendChild(item);
+						receiving[key] = item;
+					}
+					var label = file.name + " (" + file.metadata.clientID + ")";
+					if (type === "upload.started") {
+						item.textContent = label + " — загружается";
+						return;
+					}
+					delete receiving[key];
+					if (type === "upload.completed") {
+						item.textContent = label + " — готово";
+						changed(file);
+					} else {
+						item.textContent = label + " — ошибка: " + ev.error;
+					}
+				}
+
+				if (window.EventSource) {
+					var events = new EventSource("/files/events");
+					["upload.started", "upload.completed", "upload.failed", "file.deleted"].forEach(function (type) {
+						events.addEventListener(type, function (e) { follow(type, e); });
+					});
+				}
+
+				function uploadAll(files) {
+					for (var i = 0; i < files.length; i++) {
+						upload(files[i]);
+					}
+				}
+
+				form.addEventListener("dragover", function (e) {
+					e.preventDefault();
+					form.classList.add("over");
+				});
+				form.addEventListener("dragleave", function () {
+					form.classList.remove("over");
+				});
+				form.addEventListener("drop", function (e) {
+					e.preventDefault();
+					form.classList.remove("over");
+					uploadAll(e.dataTransfer.files);
+				});
+				form.addEventListener("submit", function (e) {
+					e.preventDefault();
+					uploadAll(picker.files);
+					picker.value = "";
+				});
+			})();
+		</script>
 	</body>
 	</html>
     `))
-	tmpl.Execute(w, filenames)
+	data := struct {
+		Groups      []fileGroup
+		Folder      string
+		Crumbs      []folderLink
+		Folders     []folderLink
+		Archive     string
+		CSRF        string
+		ClientIDs   []string
+		User        string
+		Filter      url.Values
+		Page, Pages int
+		Usage       blobstore.Usage
+		Prev, Next  string
+	}{
+		Groups:    groups,
+		Folder:    folder,
+		Crumbs:    breadcrumbs(folder),
+		Folders:   folderLinks,
+		Archive:   "/files/archive?dir=" + queryEscape(folder),
+		CSRF:      currentSession(r.Context()).CSRFToken,
+		ClientIDs: u.ClientIDs,
+		User:      u.Username,
+		Filter:    r.URL.Query(),
+		Page:      l.Page,
+		Pages:     l.pages(usage.Files),
+		Usage:     usage,
+	}
+	if l.Page > 1 {
+		data.Prev = pageURL("/files", data.Filter, l.Page-1)
+	}
+	if l.Page < data.Pages {
+		data.Next = pageURL("/files", data.Filter, l.Page+1)
+	}
+	tmpl.Execute(w, data)
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
+func (a *authService) loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		tmpl := template.Must(template.New("login").Parse(`
         <!DOCTYPE html>
@@ -459,38 +1261,70 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		username := r.FormValue("username")
 		password := r.FormValue("password")
 
-		if username == "root" && password == "root" {
-
-			cookie := &http.Cookie{
-				Name:     "auth",
-				Value:    "trueWithSimpleDefence",
-				Expires:  time.Now().Add(24 * time.Hour),
-				Path:     "/",
-				HttpOnly: true,
-			}
-			http.SetCookie(w, cookie)
-			http.Redirect(w, r, "/files", http.StatusSeeOther)
+		_, err := authenticate(r.Context(), a.users, username, password)
+		if errors.Is(err, errInvalidCredentials) {
+			http.Error(w, "Неверный логин или пароль", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			storeHTTPError(w, r, err)
 			return
 		}
 
-		http.Error(w, "Неверный логин или пароль", http.StatusForbidden)
+		id, session, err := a.sessions.create(username)
+		if err != nil {
+			http.Error(w, "Error creating session", http.StatusInternalServerError)
+			return
+		}
+		cookie := &http.Cookie{
+			Name:     sessionCookie,
+			Value:    id,
+			Expires:  session.Expires,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		http.SetCookie(w, cookie)
+		http.Redirect(w, r, "/files", http.StatusSeeOther)
 	}
 }
 
-func authMiddleware(next http.Handler) http.Handler {
+func (a *authService) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("auth")
-		if err != nil || cookie.Value != "trueWithSimpleDefence" {
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		session, ok := a.sessions.lookup(cookie.Value)
+		if !ok {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
-		next.ServeHTTP(w, r)
+		// Load the account on every request so permission changes apply
+		// to existing sessions.
+		u, err := a.users.GetUser(r.Context(), session.Username)
+		if errors.Is(err, errUserNotFound) {
+			a.sessions.revoke(cookie.Value)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			storeHTTPError(w, r, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey{}, u)
+		ctx = context.WithValue(ctx, sessionContextKey{}, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
+func (a *authService) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		a.sessions.revoke(cookie.Value)
+	}
 	http.SetCookie(w, &http.Cookie{
-		Name:   "auth",
+		Name:   sessionCookie,
 		Value:  "",
 		Path:   "/",
 		MaxAge: -1,
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errUnknownSession = errors.New("unknown upload session")
+
+// uploadSession is a resumable upload whose chunks are staged until the
+// client commits it.
+type uploadSession struct {
+	ID          string    `bson:"_id"`
+	Filename    string    `bson:"filename"`
+	ClientID    string    `bson:"clientID"`
+	ContentType string    `bson:"contentType,omitempty"`
+	Checksum    []byte    `bson:"checksum"`
+	Size        int64     `bson:"size"`
+	ChunkSize   int64     `bson:"chunkSize"`
+	Received    []uint32  `bson:"received"`
+	UpdatedAt   time.Time `bson:"updatedAt"`
+}
+
+// chunkCount is the number of chunks the session is split into.
+func (s uploadSession) chunkCount() uint32 {
+	return uint32((s.Size + s.ChunkSize - 1) / s.ChunkSize)
+}
+
+// chunkLen is the expected length of chunk n.
+func (s uploadSession) chunkLen(n uint32) int64 {
+	return min(s.ChunkSize, s.Size-int64(n)*s.ChunkSize)
+}
+
+// missing returns how many chunks have not been persisted yet.
+func (s uploadSession) missing() int {
+	missing := int(s.chunkCount())
+	for _, n := range s.Received {
+		if n < s.chunkCount() {
+			missing--
+		}
+	}
+	return missing
+}
+
+// newRandomID returns 32 random hex digits, which name upload sessions and
+// events.
+func newRandomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// sessionStore persists upload sessions and their staged chunks.
+type sessionStore interface {
+	Create(ctx context.Context, s uploadSession) error
+	Get(ctx context.Context, id string) (uploadSession, error)
+	PutChunk(ctx context.Context, id string, n uint32, data []byte) error
+	Chunk(ctx context.Context, id string, n uint32) ([]byte, error)
+	Delete(ctx context.Context, id string) error
+	// Expire deletes every session not touched since before.
+	Expire(ctx context.Context, before time.Time) (int, error)
+}
+
+// inMemorySessionStore keeps sessions for the lifetime of the process.
+type inMemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]uploadSession
+	chunks   map[string][]byte
+}
+
+func newInMemorySessionStore() *inMemorySessionStore {
+	return &inMemorySessionStore{sessions: map[string]uploadSession{}, chunks: map[string][]byte{}}
+}
+
+func (m *inMemorySessionStore) Create(ctx context.Context, s uploadSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.UpdatedAt = time.Now()
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *inMemorySessionStore) Get(ctx context.Context, id string) (uploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return uploadSession{}, errUnknownSession
+	}
+	s.Received = slices.Clone(s.Received)
+	slices.Sort(s.Received)
+	return s, nil
+}
+
+func (m *inMemorySessionStore) PutChunk(ctx context.Context, id string, n uint32, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return errUnknownSession
+	}
+	m.chunks[chunkKey(id, n)] = data
+	if !slices.Contains(s.Received, n) {
+		s.Received = append(s.Received, n)
+	}
+	s.UpdatedAt = time.Now()
+	m.sessions[id] = s
+	return nil
+}
+
+func (m *inMemorySessionStore) Chunk(ctx context.Context, id string, n uint32) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.chunks[chunkKey(id, n)]
+	if !ok {
+		return nil, fmt.Errorf("chunk %d of %s not found", n, id)
+	}
+	return data, nil
+}
+
+func (m *inMemorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil
+	}
+	for _, n := range s.Received {
+		delete(m.chunks, chunkKey(id, n))
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *inMemorySessionStore) Expire(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	var stale []string
+	for id, s := range m.sessions {
+		if s.UpdatedAt.Before(before) {
+			stale = append(stale, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, id := range stale {
+		m.Delete(ctx, id)
+	}
+	return len(stale), nil
+}
+
+// mongoSessionStore keeps sessions and chunks in two collections next to the
+// GridFS bucket, so staged data survives a server restart.
+type mongoSessionStore struct {
+	sessions *mongo.Collection
+	chunks   *mongo.Collection
+}
+
+func newMongoSessionStore(db *mongo.Database) *mongoSessionStore {
+	return &mongoSessionStore{
+		sessions: db.Collection("uploadSessions"),
+		chunks:   db.Collection("uploadChunks"),
+	}
+}
+
+func chunkKey(id string, n uint32) string {
+	return fmt.Sprintf("%s/%d", id, n)
+}
+
+func (m *mongoSessionStore) Create(ctx context.Context, s uploadSession) error {
+	s.UpdatedAt = time.Now()
+	_, err := m.sessions.InsertOne(ctx, s)
+	return err
+}
+
+func (m *mongoSessionStore) Get(ctx context.Context, id string) (uploadSession, error) {
+	var s uploadSession
+	err := m.sessions.FindOne(ctx, bson.M{"_id": id}).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return uploadSession{}, errUnknownSession
+	}
+	slices.Sort(s.Received)
+	return s, err
+}
+
+func (m *mongoSessionStore) PutChunk(ctx context.Context, id string, n uint32, data []byte) error {
+	if _, err := m.Get(ctx, id); err != nil {
+		return err
+	}
+	_, err := m.chunks.ReplaceOne(ctx,
+		bson.M{"_id": chunkKey(id, n)},
+		bson.M{"_id": chunkKey(id, n), "session": id, "n": n, "data": data},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = m.sessions.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$addToSet": bson.M{"received": n},
+		"$set":      bson.M{"updatedAt": time.Now()},
+	})
+	return err
+}
+
+func (m *mongoSessionStore) Chunk(ctx context.Context, id string, n uint32) ([]byte, error) {
+	var chunk struct {
+		Data []byte `bson:"data"`
+	}
+	err := m.chunks.FindOne(ctx, bson.M{"_id": chunkKey(id, n)}).Decode(&chunk)
+	return chunk.Data, err
+}
+
+func (m *mongoSessionStore) Delete(ctx context.Context, id string) error {
+	if _, err := m.chunks.DeleteMany(ctx, bson.M{"session": id}); err != nil {
+		return err
+	}
+	_, err := m.sessions.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (m *mongoSessionStore) Expire(ctx context.Context, before time.Time) (int, error) {
+	cursor, err := m.sessions.Find(ctx, bson.M{"updatedAt": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	var stale []uploadSession
+	if err := cursor.All(ctx, &stale); err != nil {
+		return 0, err
+	}
+	for i, s := range stale {
+		if err := m.Delete(ctx, s.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(stale), nil
+}
+
+// sessionReader streams a committed session's chunks in order.
+type sessionReader struct {
+	ctx     context.Context
+	store   sessionStore
+	session uploadSession
+	next    uint32
+	buf     []byte
+}
+
+func (r *sessionReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next >= r.session.chunkCount() {
+			return 0, io.EOF
+		}
+		data, err := r.store.Chunk(r.ctx, r.session.ID, r.next)
+		if err != nil {
+			return 0, fmt.Errorf("reading chunk %d: %w", r.next, err)
+		}
+		r.buf = data
+		r.next++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestUploadSessionChunks(t *testing.T) {
+	session := uploadSession{Size: 10, ChunkSize: 4}
+
+	t.Run("last chunk holds the remainder", func(t *testing.T) {
+		if got := session.chunkCount(); got != 3 {
+			t.Errorf("got %d chunks want 3", got)
+		}
+		if got := session.chunkLen(2); got != 2 {
+			t.Errorf("got last chunk length %d want 2", got)
+		}
+	})
+	t.Run("counts missing chunks", func(t *testing.T) {
+		session.Received = []uint32{0, 2}
+		if got := session.missing(); got != 1 {
+			t.Errorf("got %d missing want 1", got)
+		}
+	})
+	t.Run("empty file needs no chunks", func(t *testing.T) {
+		empty := uploadSession{Size: 0, ChunkSize: 4}
+		if got := empty.missing(); got != 0 {
+			t.Errorf("got %d missing want 0", got)
+		}
+	})
+}
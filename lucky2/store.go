@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+
+	"example.com/hello/blobstore"
+)
+
+// visibleQuery restricts q to the files u may access. Client IDs q
+// already asks for are narrowed to those u can see.
+func visibleQuery(u user, q blobstore.Query) blobstore.Query {
+	if u.Admin {
+		return q
+	}
+	if q.ClientIDs == nil {
+		q.ClientIDs = u.ClientIDs
+	} else {
+		var visible []string
+		for _, clientID := range q.ClientIDs {
+			if u.canSee(clientID) {
+				visible = append(visible, clientID)
+			}
+		}
+		q.ClientIDs = visible
+	}
+	if q.ClientIDs == nil {
+		q.ClientIDs = []string{}
+	}
+	return q
+}
+
+// latestRevision selects the newest revision of a name.
+const latestRevision = -1
+
+// parseRevision reads the optional revision parameter. Revisions are
+// numbered the way GridFS numbers them: 0 is the oldest, 1 the next, and
+// -1 the newest, -2 the one before it.
+func parseRevision(s string) (int, error) {
+	if s == "" {
+		return latestRevision, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// visibleRevisions returns the revisions of name that u may see, newest
+// first.
+func (a *app) visibleRevisions(ctx context.Context, u user, name string) ([]blobstore.FileInfo, error) {
+	return a.files.List(ctx, visibleQuery(u, blobstore.Query{Name: name}))
+}
+
+// selectRevision picks a revision out of files, which must be newest
+// first.
+func selectRevision(files []blobstore.FileInfo, revision int) (blobstore.FileInfo, error) {
+	i := -revision - 1
+	if revision >= 0 {
+		i = len(files) - 1 - revision
+	}
+	if i < 0 || i >= len(files) {
+		return blobstore.FileInfo{}, blobstore.ErrNotFound
+	}
+	return files[i], nil
+}
+
+// findRevision returns a revision of name visible to u. Revisions are
+// counted among the files u may see; others are reported as
+// blobstore.ErrNotFound.
+func (a *app) findRevision(ctx context.Context, u user, name string, revision int) (blobstore.FileInfo, error) {
+	files, err := a.visibleRevisions(ctx, u, name)
+	if err != nil {
+		return blobstore.FileInfo{}, err
+	}
+	return selectRevision(files, revision)
+}
+
+// openRevision opens a revision of name visible to u.
+func (a *app) openRevision(ctx context.Context, u user, name string, revision int) (io.ReadSeekCloser, blobstore.FileInfo, error) {
+	file, err := a.findRevision(ctx, u, name, revision)
+	if err != nil {
+		return nil, blobstore.FileInfo{}, err
+	}
+	return a.files.Get(ctx, file.ID)
+}
+
+// visibleFile returns the file with the given ID if u may see it. Other
+// files are reported as blobstore.ErrNotFound.
+func (a *app) visibleFile(ctx context.Context, u user, id string) (blobstore.FileInfo, error) {
+	file, err := a.files.Stat(ctx, id)
+	if err != nil {
+		return blobstore.FileInfo{}, err
+	}
+	if !u.canSee(file.Metadata.ClientID) {
+		return blobstore.FileInfo{}, blobstore.ErrNotFound
+	}
+	return file, nil
+}
+
+// openVisibleFile opens the file with the given ID if u may see it.
+func (a *app) openVisibleFile(ctx context.Context, u user, id string) (io.ReadSeekCloser, blobstore.FileInfo, error) {
+	stream, file, err := a.files.Get(ctx, id)
+	if err != nil {
+		return nil, blobstore.FileInfo{}, err
+	}
+	if !u.canSee(file.Metadata.ClientID) {
+		stream.Close()
+		return nil, blobstore.FileInfo{}, blobstore.ErrNotFound
+	}
+	return stream, file, nil
+}
+
+// revision is one stored version of a filename.
+type revision struct {
+	Number int
+	blobstore.FileInfo
+}
+
+// fileGroup is a filename with its revisions, newest first.
+type fileGroup struct {
+	Name      string
+	Revisions []revision
+}
+
+// Latest returns the newest revision.
+func (g fileGroup) Latest() revision {
+	return g.Revisions[0]
+}
+
+// groupRevisions groups files, which must be newest first, by name. Groups
+// are ordered by their newest revision.
+func groupRevisions(files []blobstore.FileInfo) []fileGroup {
+	var groups []fileGroup
+	index := map[string]int{}
+	for _, file := range files {
+		i, ok := index[file.Name]
+		if !ok {
+			i = len(groups)
+			index[file.Name] = i
+			groups = append(groups, fileGroup{Name: file.Name})
+		}
+		groups[i].Revisions = append(groups[i].Revisions, revision{FileInfo: file})
+	}
+	for _, group := range groups {
+		for i := range group.Revisions {
+			group.Revisions[i].Number = len(group.Revisions) - 1 - i
+		}
+	}
+	return groups
+}
+
+// fileDigest returns the SHA-256 digest recorded at ingest, or nil for
+// files stored before digests were tracked.
+func fileDigest(info blobstore.FileInfo) []byte {
+	digest, err := hex.DecodeString(info.Metadata.SHA256)
+	if err != nil || len(digest) != sha256.Size {
+		return nil
+	}
+	return digest
+}
+
+// fileETag identifies the content of a stored file. Stored files never
+// change, so the file ID is a valid fallback for files without a digest.
+func fileETag(info blobstore.FileInfo) string {
+	if digest := fileDigest(info); digest != nil {
+		return `"` + hex.EncodeToString(digest) + `"`
+	}
+	return `"id-` + info.ID + `"`
+}
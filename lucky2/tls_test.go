@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/protocol"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t testing.TB) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lucky2 test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, ca.path("ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue writes a certificate and key for commonName and returns their paths.
+func (ca *testCA) issue(t testing.TB, commonName string, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := ca.path(commonName+".pem"), ca.path(commonName+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t testing.TB, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// acceptClientID runs one TLS handshake against serverConfig and returns
+// the client identity the server derived from it.
+func acceptClientID(t testing.TB, serverConfig, clientConfig *tls.Config) (string, error) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := protocol.Dial(listener.Addr().String(), clientConfig)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+		conn.Read(make([]byte, 1))
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return peerClientID(conn)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "ingest.local", x509.ExtKeyUsageServerAuth)
+
+	t.Run("client certificate subject becomes the clientID", func(t *testing.T) {
+		serverConfig, err := loadTLSConfig(serverCert, serverKey, ca.path("ca.pem"))
+		assertNoError(t, err)
+		clientCert, clientKey := ca.issue(t, "camera-7", x509.ExtKeyUsageClientAuth)
+		clientConfig, err := protocol.ClientTLSConfig(ca.path("ca.pem"), clientCert, clientKey)
+		assertNoError(t, err)
+
+		clientID, err := acceptClientID(t, serverConfig, clientConfig)
+		assertNoError(t, err)
+		if clientID != "camera-7" {
+			t.Errorf("got clientID %q want %q", clientID, "camera-7")
+		}
+	})
+	t.Run("client without certificate is refused", func(t *testing.T) {
+		serverConfig, err := loadTLSConfig(serverCert, serverKey, ca.path("ca.pem"))
+		assertNoError(t, err)
+		clientConfig, err := protocol.ClientTLSConfig(ca.path("ca.pem"), "", "")
+		assertNoError(t, err)
+
+		if _, err := acceptClientID(t, serverConfig, clientConfig); err == nil {
+			t.Error("wanted a handshake error but didn't get one")
+		}
+	})
+	t.Run("server-only TLS leaves the declared clientID in place", func(t *testing.T) {
+		serverConfig, err := loadTLSConfig(serverCert, serverKey, "")
+		assertNoError(t, err)
+		clientConfig, err := protocol.ClientTLSConfig(ca.path("ca.pem"), "", "")
+		assertNoError(t, err)
+
+		clientID, err := acceptClientID(t, serverConfig, clientConfig)
+		assertNoError(t, err)
+		if clientID != "" {
+			t.Errorf("got clientID %q want none", clientID)
+		}
+	})
+}
+
+func TestHandshakesCountAsConnections(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "ingest.local", x509.ExtKeyUsageServerAuth)
+	serverConfig, err := loadTLSConfig(serverCert, serverKey, "")
+	assertNoError(t, err)
+	clientConfig, err := protocol.ClientTLSConfig(ca.path("ca.pem"), "", "")
+	assertNoError(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	assertNoError(t, err)
+	defer listener.Close()
+	ingest := &ingestServer{store: blobstore.NewMemory(), sessions: newInMemorySessionStore(), limits: ingestLimits{MaxConnections: 1}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ingest.handleConnection(conn)
+		}
+	}()
+
+	// A client that never starts its handshake still holds the only slot.
+	stalled, err := net.Dial("tcp", listener.Addr().String())
+	assertNoError(t, err)
+	defer stalled.Close()
+	waitForConn(t, ingest, false)
+
+	conn, err := protocol.Dial(listener.Addr().String(), clientConfig)
+	assertNoError(t, err)
+	defer conn.Close()
+	assertNextAck(t, conn, protocol.StatusBusy)
+}
+
+func TestIngestConnHeader(t *testing.T) {
+	frame := protocol.UploadFrame(protocol.Header{Filename: "a.png", ClientID: "self-declared"}, 0)
+
+	conn := &ingestConn{clientID: "camera-7"}
+	if got := conn.header(frame).ClientID; got != "camera-7" {
+		t.Errorf("got clientID %q want %q", got, "camera-7")
+	}
+}
+
+func assertNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("got an error but didn't want one: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/hello/blobstore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errTokenNotFound = errors.New("API token not found")
+
+// apiTokenPrefix marks lucky2 API tokens so they are easy to spot in
+// scripts and secret scanners.
+const apiTokenPrefix = "lk2_"
+
+// apiToken lets scripts use the API as a user. Only the SHA-256 of the
+// token is stored.
+type apiToken struct {
+	Hash     string    `bson:"_id"`
+	Username string    `bson:"username"`
+	Name     string    `bson:"name"`
+	Created  time.Time `bson:"created"`
+}
+
+// newAPIToken returns a fresh token for username and the record to store.
+func newAPIToken(username, name string) (string, apiToken, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", apiToken{}, err
+	}
+	token := apiTokenPrefix + secret
+	return token, apiToken{Hash: hashToken(token), Username: username, Name: name, Created: time.Now().UTC()}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// tokenStore keeps API tokens by hash.
+type tokenStore interface {
+	PutToken(ctx context.Context, t apiToken) error
+	GetToken(ctx context.Context, hash string) (apiToken, error)
+	DeleteToken(ctx context.Context, hash string) error
+}
+
+type inMemoryTokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]apiToken
+}
+
+func newInMemoryTokenStore() *inMemoryTokenStore {
+	return &inMemoryTokenStore{tokens: map[string]apiToken{}}
+}
+
+func (s *inMemoryTokenStore) PutToken(ctx context.Context, t apiToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.Hash] = t
+	return nil
+}
+
+func (s *inMemoryTokenStore) GetToken(ctx context.Context, hash string) (apiToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tokens[hash]
+	if !ok {
+		return apiToken{}, errTokenNotFound
+	}
+	return t, nil
+}
+
+func (s *inMemoryTokenStore) DeleteToken(ctx context.Context, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[hash]; !ok {
+		return errTokenNotFound
+	}
+	delete(s.tokens, hash)
+	return nil
+}
+
+// mongoTokenStore keeps tokens in the apiTokens collection of the file
+// store database.
+type mongoTokenStore struct {
+	tokens *mongo.Collection
+}
+
+func newMongoTokenStore(db *mongo.Database) *mongoTokenStore {
+	return &mongoTokenStore{tokens: db.Collection("apiTokens")}
+}
+
+func (s *mongoTokenStore) PutToken(ctx context.Context, t apiToken) error {
+	_, err := s.tokens.InsertOne(ctx, t)
+	return blobstore.MongoError(err)
+}
+
+func (s *mongoTokenStore) GetToken(ctx context.Context, hash string) (apiToken, error) {
+	var t apiToken
+	err := s.tokens.FindOne(ctx, bson.M{"_id": hash}).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return apiToken{}, errTokenNotFound
+	}
+	if err != nil {
+		return apiToken{}, blobstore.MongoError(err)
+	}
+	return t, nil
+}
+
+func (s *mongoTokenStore) DeleteToken(ctx context.Context, hash string) error {
+	result, err := s.tokens.DeleteOne(ctx, bson.M{"_id": hash})
+	if err != nil {
+		return blobstore.MongoError(err)
+	}
+	if result.DeletedCount == 0 {
+		return errTokenNotFound
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"example.com/hello/blobstore"
+	"example.com/hello/lucky2/filenames"
+)
+
+// maxFormValue bounds the non-file fields of an upload form.
+const maxFormValue = 1024
+
+// maxFormOverhead is what an upload form may hold besides the file content
+// when the file size is limited: boundaries, part headers and fields.
+const maxFormOverhead = 64 << 10
+
+// uploadClientID picks the clientID a browser upload is stored under. Users
+// may only upload under client IDs they can see, so the file shows up in
+// their own listing; admins without client IDs upload under their username.
+func uploadClientID(u user, requested string) (string, error) {
+	switch {
+	case requested != "" && u.canSee(requested):
+		return requested, nil
+	case requested != "":
+		return "", fmt.Errorf("no access to client %s", requested)
+	case len(u.ClientIDs) > 0:
+		return u.ClientIDs[0], nil
+	case u.Admin:
+		return u.Username, nil
+	}
+	return "", errors.New("account has no client to upload under")
+}
+
+// partReader remembers why reading an upload failed, so the client's
+// connection problems are not reported as storage errors.
+type partReader struct {
+	r   io.Reader
+	err error
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	return n, err
+}
+
+// uploadHandler streams the files of a multipart form into the store with
+// the metadata ingest records, plus the uploading user. The CSRF token comes
+// in the csrfHeader or a csrf field ahead of the files, and the optional
+// clientID and folder fields must also precede them.
+func (a *app) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stored, ok := a.receiveUpload(w, r, true, http.Error)
+	if !ok {
+		return
+	}
+
+	// Скрипт на странице ждёт JSON, обычная форма — редирект
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stored)
+		return
+	}
+	http.Redirect(w, r, "/files", http.StatusSeeOther)
+}
+
+// receiveUpload stores every file of a multipart upload. On failure it
+// writes the error response with fail and reports false; files stored
+// before the failure are kept.
+func (a *app) receiveUpload(w http.ResponseWriter, r *http.Request, checkCSRF bool, fail httpErrorFunc) ([]blobstore.FileInfo, bool) {
+	if a.maxFileSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, a.maxFileSize+maxFormOverhead)
+	}
+	form, err := r.MultipartReader()
+	if err != nil {
+		fail(w, "Expected a multipart form", http.StatusBadRequest)
+		return nil, false
+	}
+	upload := partUpload{user: currentUser(r.Context()), checkCSRF: checkCSRF, token: r.Header.Get(csrfHeader), fail: fail}
+	var stored []blobstore.FileInfo
+
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			break
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			fail(w, "Upload too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		if err != nil {
+			fail(w, "Malformed multipart form", http.StatusBadRequest)
+			return nil, false
+		}
+
+		switch part.FormName() {
+		case csrfField:
+			upload.token, err = readFormValue(part)
+		case "clientID":
+			upload.clientID, err = readFormValue(part)
+		case "folder":
+			upload.folder, err = readFolder(part)
+		case "file":
+			info, ok := a.storePart(w, r, upload, part)
+			if !ok {
+				return nil, false
+			}
+			stored = append(stored, info)
+		}
+		if err != nil {
+			fail(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if len(stored) == 0 {
+		fail(w, "No files uploaded", http.StatusBadRequest)
+		return nil, false
+	}
+	return stored, true
+}
+
+// keepWithinQuota deletes a file just stored by a browser, whose size is
+// not known up front, when it took its client over quota. If the usage
+// cannot be read the file is kept and left to the janitor.
+func (a *app) keepWithinQuota(ctx context.Context, file blobstore.FileInfo) error {
+	if a.quota.MaxBytes == 0 && a.quota.MaxFiles == 0 {
+		return nil
+	}
+	clientID := file.Metadata.ClientID
+	usage, err := a.files.Usage(ctx, blobstore.Query{ClientIDs: []string{clientID}})
+	if err != nil {
+		slog.Warn("checking quota after upload", "file", file.Name, "clientID", clientID, "err", err)
+		return nil
+	}
+	if !a.quota.over(usage) {
+		return nil
+	}
+	if err := a.files.Delete(context.WithoutCancel(ctx), file.ID); err != nil {
+		slog.Error("deleting upload over quota", "file", file.Name, "id", file.ID, "err", err)
+	}
+	return fmt.Errorf("%w: %s would take client %s to %d bytes", errOverQuota, file.Name, clientID, usage.Bytes)
+}
+
+// partUpload is what the fields of an upload form said so far.
+type partUpload struct {
+	user      user
+	checkCSRF bool
+	token     string
+	clientID  string
+	folder    string
+	fail      httpErrorFunc
+}
+
+func readFormValue(part io.Reader) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxFormValue+1))
+	if err != nil {
+		return "", errors.New("upload interrupted")
+	}
+	if len(value) > maxFormValue {
+		return "", errors.New("form field too long")
+	}
+	return string(value), nil
+}
+
+// readFolder reads the folder field, which files of the form are stored
+// under.
+func readFolder(part io.Reader) (string, error) {
+	value, err := readFormValue(part)
+	if err != nil {
+		return "", err
+	}
+	folder, err := filenames.CleanPath(value)
+	if err != nil {
+		return "", errors.New("invalid folder")
+	}
+	return folder, nil
+}
+
+// storePart stores one file of an upload form. On failure it writes the
+// error response and reports false.
+func (a *app) storePart(w http.ResponseWriter, r *http.Request, upload partUpload, part *multipart.Part) (blobstore.FileInfo, bool) {
+	fail := func(message string, status int) (blobstore.FileInfo, bool) {
+		upload.fail(w, message, status)
+		return blobstore.FileInfo{}, false
+	}
+	if upload.checkCSRF && !validCSRF(r, upload.token) {
+		return fail("Invalid CSRF token", http.StatusForbidden)
+	}
+	u := upload.user
+	clientID, err := uploadClientID(u, upload.clientID)
+	if err != nil {
+		return fail(err.Error(), http.StatusForbidden)
+	}
+	filename, err := filenames.Clean(part.FileName())
+	if err == nil {
+		filename, err = filenames.CleanFilePath(joinPath(upload.folder, filename))
+	}
+	if err != nil {
+		return fail(err.Error(), http.StatusBadRequest)
+	}
+
+	err = a.quota.checkQuota(r.Context(), a.files, clientID, -1)
+	if errors.Is(err, errOverQuota) {
+		return fail(err.Error(), http.StatusInsufficientStorage)
+	}
+	if err != nil {
+		reportStoreError(w, err, upload.fail)
+		return blobstore.FileInfo{}, false
+	}
+
+	slog.Info("receiving HTTP upload", "file", filename, "clientID", clientID, "user", u.Username)
+	src := &partReader{r: part}
+	contentType, content := sniffContentType(src, part.Header.Get("Content-Type"))
+	meta := blobstore.Metadata{ClientID: clientID, ContentType: contentType, Uploader: u.Username}
+	started := blobstore.FileInfo{Name: filename, Metadata: meta}
+	timer := startUpload("http")
+	a.events.publish(event{Type: eventUploadStarted, File: started})
+	info, err := a.files.Put(r.Context(), filename, meta, content)
+	if err == nil {
+		err = a.keepWithinQuota(r.Context(), info)
+	}
+	timer.done(info.Size, err)
+	if err != nil {
+		a.events.publish(event{Type: eventUploadFailed, File: started, Error: err.Error()})
+	}
+	switch {
+	case err == nil:
+		a.audit(r.Context(), "upload", info, "clientID "+clientID)
+		a.events.publish(event{Type: eventUploadCompleted, File: info})
+		a.hooks.submit(info)
+		return info, true
+	case errors.Is(err, blobstore.ErrDuplicate):
+		return fail(filename+" already exists", http.StatusConflict)
+	case errors.Is(err, errOverQuota):
+		return fail(err.Error(), http.StatusInsufficientStorage)
+	case errors.As(src.err, new(*http.MaxBytesError)):
+		return fail("Upload too large", http.StatusRequestEntityTooLarge)
+	case src.err != nil:
+		return fail("Upload interrupted", http.StatusBadRequest)
+	default:
+		reportStoreError(w, err, upload.fail)
+		return blobstore.FileInfo{}, false
+	}
+}
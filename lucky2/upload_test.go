@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"example.com/hello/blobstore"
+)
+
+// uploadForm builds a multipart body with fields written in order before
+// the files.
+func uploadForm(t testing.TB, fields [][2]string, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, field := range fields {
+		assertNoError(t, form.WriteField(field[0], field[1]))
+	}
+	for name, content := range files {
+		part, err := form.CreateFormFile("file", name)
+		assertNoError(t, err)
+		part.Write([]byte(content))
+	}
+	assertNoError(t, form.Close())
+	return &body, form.FormDataContentType()
+}
+
+func postUpload(a *app, cookie *http.Cookie, body *bytes.Buffer, contentType string, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/upload", body)
+	request.Header.Set("Content-Type", contentType)
+	for key, values := range header {
+		request.Header.Set(key, values[0])
+	}
+	request.AddCookie(cookie)
+	response := httptest.NewRecorder()
+	a.routes().ServeHTTP(response, request)
+	return response
+}
+
+func csrfOf(a *app, cookie *http.Cookie) string {
+	session, _ := a.auth.sessions.lookup(cookie.Value)
+	return session.CSRFToken
+}
+
+func TestUpload(t *testing.T) {
+	t.Run("stores files with ingest's metadata and the uploader", func(t *testing.T) {
+		a, cookie, store, audit := newEditApp(t)
+		png := encodePNG(t, 2, 2)
+		body, contentType := uploadForm(t, nil, map[string]string{"frame9.png": png})
+
+		response := postUpload(a, cookie, body, contentType, http.Header{
+			csrfHeader: {csrfOf(a, cookie)},
+			"Accept":   {"application/json"},
+		})
+
+		assertStatus(t, response.Code, http.StatusOK)
+		var stored []blobstore.FileInfo
+		assertNoError(t, json.NewDecoder(response.Body).Decode(&stored))
+		if len(stored) != 1 {
+			t.Fatalf("got %d stored files want 1", len(stored))
+		}
+		info, err := store.Stat(context.Background(), stored[0].ID)
+		assertNoError(t, err)
+		sum := sha256.Sum256([]byte(png))
+		want := blobstore.Metadata{ClientID: "cam-1", ContentType: "image/png", SHA256: hexString(sum[:]), Uploader: "alice"}
+		if info.Name != "frame9.png" || info.Metadata.ClientID != want.ClientID || info.Metadata.ContentType != want.ContentType ||
+			info.Metadata.SHA256 != want.SHA256 || info.Metadata.Uploader != want.Uploader {
+			t.Errorf("got %+v want metadata %+v", info, want)
+		}
+		assertAudit(t, audit, "upload")
+	})
+	t.Run("plain form with token field redirects", func(t *testing.T) {
+		a, cookie, store, _ := newEditApp(t)
+		body, contentType := uploadForm(t, [][2]string{{csrfField, csrfOf(a, cookie)}}, map[string]string{"a.txt": "a", "b.txt": "b"})
+
+		response := postUpload(a, cookie, body, contentType, nil)
+
+		assertStatus(t, response.Code, http.StatusSeeOther)
+		assertFileCount(t, store, 2)
+	})
+	t.Run("missing CSRF token stores nothing", func(t *testing.T) {
+		a, cookie, store, _ := newEditApp(t)
+		body, contentType := uploadForm(t, nil, map[string]string{"a.txt": "a"})
+
+		response := postUpload(a, cookie, body, contentType, nil)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertFileCount(t, store, 0)
+	})
+	t.Run("token after the file is too late", func(t *testing.T) {
+		a, cookie, store, _ := newEditApp(t)
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "a.txt")
+		part.Write([]byte("a"))
+		form.WriteField(csrfField, csrfOf(a, cookie))
+		form.Close()
+
+		response := postUpload(a, cookie, &body, form.FormDataContentType(), nil)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertFileCount(t, store, 0)
+	})
+	t.Run("another user's client is refused", func(t *testing.T) {
+		a, cookie, store, _ := newEditApp(t)
+		body, contentType := uploadForm(t, [][2]string{{"clientID", "cam-2"}}, map[string]string{"a.txt": "a"})
+
+		response := postUpload(a, cookie, body, contentType, http.Header{csrfHeader: {csrfOf(a, cookie)}})
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertFileCount(t, store, 0)
+	})
+	t.Run("form without files", func(t *testing.T) {
+		a, cookie, _, _ := newEditApp(t)
+		body, contentType := uploadForm(t, nil, nil)
+
+		response := postUpload(a, cookie, body, contentType, http.Header{csrfHeader: {csrfOf(a, cookie)}})
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func TestUploadClientID(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		u         user
+		requested string
+		want      string
+		ok        bool
+	}{
+		{name: "first client by default", u: user{ClientIDs: []string{"cam-1", "cam-2"}}, want: "cam-1", ok: true},
+		{name: "requested own client", u: user{ClientIDs: []string{"cam-1", "cam-2"}}, requested: "cam-2", want: "cam-2", ok: true},
+		{name: "requested foreign client", u: user{ClientIDs: []string{"cam-1"}}, requested: "cam-2"},
+		{name: "admin without clients", u: user{Username: "admin", Admin: true}, want: "admin", ok: true},
+		{name: "user without clients", u: user{Username: "bob"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := uploadClientID(tt.u, tt.requested)
+			if (err == nil) != tt.ok || got != tt.want {
+				t.Errorf("got %q, %v want %q, ok %v", got, err, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"example.com/hello/blobstore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errUserNotFound       = errors.New("user not found")
+	errInvalidCredentials = errors.New("invalid username or password")
+)
+
+// user is a web portal account. Only the bcrypt hash of the password is
+// ever stored. Admins see every file; everyone else sees the files uploaded
+// under their ClientIDs.
+type user struct {
+	Username     string   `bson:"_id"`
+	PasswordHash []byte   `bson:"passwordHash"`
+	Admin        bool     `bson:"admin"`
+	ClientIDs    []string `bson:"clientIDs"`
+}
+
+// canSee reports whether u may access files uploaded by clientID.
+func (u user) canSee(clientID string) bool {
+	return u.Admin || slices.Contains(u.ClientIDs, clientID)
+}
+
+func newUser(username, password string) (user, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return user{}, err
+	}
+	return user{Username: username, PasswordHash: hash}, nil
+}
+
+// userStore looks up and saves portal accounts.
+type userStore interface {
+	GetUser(ctx context.Context, username string) (user, error)
+	PutUser(ctx context.Context, u user) error
+}
+
+// dummyHash is compared against when a username does not exist, so unknown
+// and known users take the same time to reject.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("lucky2"), bcrypt.DefaultCost)
+
+// authenticate checks a username and password against store.
+func authenticate(ctx context.Context, store userStore, username, password string) (user, error) {
+	u, err := store.GetUser(ctx, username)
+	if errors.Is(err, errUserNotFound) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return user{}, errInvalidCredentials
+	}
+	if err != nil {
+		return user{}, err
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil {
+		return user{}, errInvalidCredentials
+	}
+	return u, nil
+}
+
+// adminUsername is the account bootstrapAdmin creates.
+const adminUsername = "admin"
+
+// bootstrapAdmin creates the admin account with password if the store does
+// not have one yet, so a fresh deployment can be logged into.
+func bootstrapAdmin(ctx context.Context, store userStore, password string) error {
+	if password == "" {
+		return nil
+	}
+	_, err := store.GetUser(ctx, adminUsername)
+	if !errors.Is(err, errUserNotFound) {
+		return err
+	}
+	u, err := newUser(adminUsername, password)
+	if err != nil {
+		return err
+	}
+	u.Admin = true
+	return store.PutUser(ctx, u)
+}
+
+// addUserFromReader saves account with the password on the first line of r.
+func addUserFromReader(ctx context.Context, store userStore, account user, r io.Reader) error {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("empty password")
+	}
+	u, err := newUser(account.Username, password)
+	if err != nil {
+		return err
+	}
+	u.Admin = account.Admin
+	u.ClientIDs = account.ClientIDs
+	return store.PutUser(ctx, u)
+}
+
+type inMemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]user
+}
+
+func newInMemoryUserStore() *inMemoryUserStore {
+	return &inMemoryUserStore{users: map[string]user{}}
+}
+
+func (s *inMemoryUserStore) GetUser(ctx context.Context, username string) (user, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return user{}, errUserNotFound
+	}
+	return u, nil
+}
+
+func (s *inMemoryUserStore) PutUser(ctx context.Context, u user) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.Username] = u
+	return nil
+}
+
+// mongoUserStore keeps accounts in the users collection of the file store
+// database.
+type mongoUserStore struct {
+	users *mongo.Collection
+}
+
+func newMongoUserStore(db *mongo.Database) *mongoUserStore {
+	return &mongoUserStore{users: db.Collection("users")}
+}
+
+func (s *mongoUserStore) GetUser(ctx context.Context, username string) (user, error) {
+	var u user
+	err := s.users.FindOne(ctx, bson.M{"_id": username}).Decode(&u)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user{}, errUserNotFound
+	}
+	if err != nil {
+		return user{}, blobstore.MongoError(err)
+	}
+	return u, nil
+}
+
+func (s *mongoUserStore) PutUser(ctx context.Context, u user) error {
+	_, err := s.users.ReplaceOne(ctx, bson.M{"_id": u.Username}, u, options.Replace().SetUpsert(true))
+	if err != nil {
+		return blobstore.MongoError(err)
+	}
+	return nil
+}